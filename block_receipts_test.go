@@ -0,0 +1,329 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jsonRPCRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   interface{}     `json:"error,omitempty"`
+}
+
+// receiptsServer answers receipt calls from a fake chain and records the requests it gets
+type receiptsServer struct {
+	chain                 *fakechain.Chain
+	supportsBlockReceipts bool
+	// blockReceiptsErr is answered to eth_getBlockReceipts if set
+	blockReceiptsErr interface{}
+
+	lock     sync.Mutex
+	requests [][]string
+}
+
+func (s *receiptsServer) answer(req jsonRPCRequest) jsonRPCResponse {
+	resp := jsonRPCResponse{JSONRPC: "2.0", ID: req.ID}
+
+	var hash common.Hash
+	_ = json.Unmarshal(req.Params[0], &hash)
+
+	switch {
+	case req.Method == "eth_getBlockReceipts" && s.blockReceiptsErr != nil:
+		resp.Error = s.blockReceiptsErr
+	case req.Method == "eth_getBlockReceipts" && s.supportsBlockReceipts:
+		block := s.chain.Block(s.chain.Head())
+		var txHashes []string
+		for _, tx := range block.Transactions() {
+			txHashes = append(txHashes, tx.Hash().String())
+		}
+
+		resp.Result, _ = s.chain.GetTransactionReceiptsInBlock(hash.String(), txHashes)
+	case req.Method == "eth_getTransactionReceipt":
+		resp.Result, _ = s.chain.GetTransactionReceipt(hash.String())
+	default:
+		resp.Error = map[string]interface{}{"code": -32601, "message": "the method " + req.Method + " does not exist/is not available"}
+	}
+
+	return resp
+}
+
+func (s *receiptsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var batch []jsonRPCRequest
+	isBatch := json.Unmarshal(raw, &batch) == nil
+	if !isBatch {
+		var req jsonRPCRequest
+		_ = json.Unmarshal(raw, &req)
+		batch = []jsonRPCRequest{req}
+	}
+
+	var methods []string
+	var responses []jsonRPCResponse
+	for _, req := range batch {
+		methods = append(methods, req.Method)
+		responses = append(responses, s.answer(req))
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, methods)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if isBatch {
+		_ = json.NewEncoder(w).Encode(responses)
+	} else {
+		_ = json.NewEncoder(w).Encode(responses[0])
+	}
+}
+
+func newReceiptsServer(t *testing.T, supportsBlockReceipts bool) (*receiptsServer, []string, *rpc.EthBlockChainRPC) {
+	chain := fakechain.New()
+	block := chain.AddBlock(fakeTransferTx(), fakeTransferTx(), fakeTransferTx())
+
+	var txHashes []string
+	for _, tx := range block.Transactions() {
+		txHashes = append(txHashes, tx.Hash().String())
+	}
+
+	s := &receiptsServer{chain: chain, supportsBlockReceipts: supportsBlockReceipts}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	client, err := rpc.DialEthRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, txHashes, client
+}
+
+func checkReceiptsInOrder(t *testing.T, client *rpc.EthBlockChainRPC, s *receiptsServer, txHashes []string) {
+	t.Helper()
+
+	// ask out of block order, receipts come in the order asked
+	asked := []string{txHashes[2], txHashes[0], txHashes[1]}
+
+	receipts, err := client.GetTransactionReceiptsInBlock(s.chain.Block(1).Hash().String(), asked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receipts) != len(asked) {
+		t.Fatalf("expect %d receipts, got %d", len(asked), len(receipts))
+	}
+
+	for i, receipt := range receipts {
+		if receipt.TxHash != common.HexToHash(asked[i]) {
+			t.Fatalf("receipt %d: expect tx %s, got %s", i, asked[i], receipt.TxHash)
+		}
+	}
+}
+
+func TestGetTransactionReceiptsInBlockWithBlockReceipts(t *testing.T) {
+	s, txHashes, client := newReceiptsServer(t, true)
+
+	checkReceiptsInOrder(t, client, s, txHashes)
+
+	if len(s.requests) != 1 || s.requests[0][0] != "eth_getBlockReceipts" {
+		t.Fatalf("expect a single eth_getBlockReceipts, got %v", s.requests)
+	}
+}
+
+func TestGetTransactionReceiptsInBlockFallsBackToBatches(t *testing.T) {
+	s, txHashes, client := newReceiptsServer(t, false)
+	client.SetReceiptsBatchSize(2)
+
+	checkReceiptsInOrder(t, client, s, txHashes)
+
+	// eth_getBlockReceipts, then batches of 2 and 1
+	if len(s.requests) != 3 || s.requests[0][0] != "eth_getBlockReceipts" || len(s.requests[1]) != 2 || len(s.requests[2]) != 1 {
+		t.Fatalf("unexpected requests: %v", s.requests)
+	}
+
+	// node is known to lack eth_getBlockReceipts by now
+	s.requests = nil
+	checkReceiptsInOrder(t, client, s, txHashes)
+
+	if len(s.requests) != 2 || s.requests[0][0] != "eth_getTransactionReceipt" {
+		t.Fatalf("expect batches only, got %v", s.requests)
+	}
+}
+
+func TestGetTransactionReceiptsInBlockKeepsBlockReceiptsOnOtherErrors(t *testing.T) {
+	s, txHashes, client := newReceiptsServer(t, true)
+	s.blockReceiptsErr = map[string]interface{}{"code": -32000, "message": "block does not exist"}
+
+	if _, err := client.GetTransactionReceiptsInBlock(s.chain.Block(1).Hash().String(), txHashes); err == nil {
+		t.Fatal("expect err of eth_getBlockReceipts")
+	}
+
+	// node still has eth_getBlockReceipts
+	s.blockReceiptsErr = nil
+	s.requests = nil
+	checkReceiptsInOrder(t, client, s, txHashes)
+
+	if len(s.requests) != 1 || s.requests[0][0] != "eth_getBlockReceipts" {
+		t.Fatalf("expect a single eth_getBlockReceipts, got %v", s.requests)
+	}
+}
+
+var errReceiptNotFound = errors.New("receipt not found")
+
+// receiptFailingRPC has no IBlockReceiptsRPC, so receipts are fetched one tx at a time.
+// Receipt of tx fails while failures are left, others wait for ctx to be canceled if hang.
+type receiptFailingRPC struct {
+	rpc.IBlockChainRPC
+	ctx      context.Context
+	tx       string
+	failures *int32
+	hang     bool
+	inFlight *int32
+}
+
+func (r receiptFailingRPC) WithContext(ctx context.Context) rpc.IBlockChainRPC {
+	r.ctx = ctx
+	return r
+}
+
+func (r receiptFailingRPC) GetTransactionReceipt(txHash string) (*types.Receipt, error) {
+	atomic.AddInt32(r.inFlight, 1)
+	defer atomic.AddInt32(r.inFlight, -1)
+
+	if txHash == r.tx && atomic.AddInt32(r.failures, -1) >= 0 {
+		return nil, errReceiptNotFound
+	}
+
+	if r.hang && r.ctx != nil {
+		<-r.ctx.Done()
+		return nil, r.ctx.Err()
+	}
+
+	return r.IBlockChainRPC.GetTransactionReceipt(txHash)
+}
+
+func newReceiptFailingRPC(chain *fakechain.Chain, tx string, failures int32, hang bool) receiptFailingRPC {
+	return receiptFailingRPC{IBlockChainRPC: chain, tx: tx, failures: &failures, hang: hang, inFlight: new(int32)}
+}
+
+func TestGetTransactionReceiptsCanceledOnFirstError(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock(fakeTransferTx(), fakeTransferTx(), fakeTransferTx(), fakeTransferTx())
+
+	block := chain.Block(1)
+
+	var txHashes []string
+	for _, tx := range block.Transactions() {
+		txHashes = append(txHashes, tx.Hash().String())
+	}
+
+	client := newReceiptFailingRPC(chain, txHashes[2], 1, true)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := rpc.GetTransactionReceiptsInBlockContext(context.Background(), client, block.Hash().String(), txHashes)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, errReceiptNotFound) {
+			t.Fatalf("expect %s, got %v", errReceiptNotFound, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetches in flight are not canceled")
+	}
+
+	if n := atomic.LoadInt32(client.inFlight); n != 0 {
+		t.Fatalf("expect no fetch left running, got %d", n)
+	}
+}
+
+func TestReceiptErrorRetriesBlock(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy rpc.RetryPolicy
+	}{
+		{"retried", &rpc.BackoffRetryPolicy{MaxRetries: 5, BaseDelay: time.Millisecond}},
+		{"no retry", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			for i := 0; i < 3; i++ {
+				chain.AddBlock(fakeTransferTx(), fakeTransferTx())
+			}
+
+			client := newReceiptFailingRPC(chain, chain.Block(2).Transactions()[1].Hash().String(), 2, false)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			w := NewEthWatcher(ctx, client)
+			w.SetSleepSecondsForNewBlock(1)
+			w.SetSyncRetryPolicy(tc.policy)
+
+			receipts := make(chan *structs.RemovableTxAndReceipt, 16)
+			w.RegisterTxReceiptPlugin(plugin.NewTxReceiptPlugin(func(tx *structs.RemovableTxAndReceipt) {
+				receipts <- tx
+			}))
+
+			done := runFakeWatcher(t, w, 1)
+
+			if tc.policy == nil {
+				select {
+				case err := <-done:
+					if !errors.Is(err, errReceiptNotFound) {
+						t.Fatalf("expect %s, got %v", errReceiptNotFound, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("watcher didn't exit on receipt error")
+				}
+
+				return
+			}
+
+			// receipts of block 2 are delivered once, after the whole block is fetched again
+			for _, num := range []uint64{1, 1, 2, 2, 3, 3} {
+				select {
+				case tx := <-receipts:
+					if tx.Receipt.BlockNumber.Uint64() != num {
+						t.Fatalf("expect receipt of block %d, got %d", num, tx.Receipt.BlockNumber)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no receipt of block %d", num)
+				}
+			}
+
+			waitWatcherExit(t, cancel, done)
+
+			if len(receipts) != 0 {
+				t.Fatalf("expect no receipt delivered twice, got %d more", len(receipts))
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"fmt"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// SetCatchUp makes watcher catch up on blocks more than liveDistance behind the head in big steps of receipt logs,
+// with up to workers steps fetched at once, instead of block by block.
+// Blocks that far behind are taken as final: logs of each step are checked against the last block of the step only,
+// and are not kept for withdrawing. A reorg deeper than liveDistance may leave logs of orphaned blocks delivered,
+// with logs of the new branch delivered once more, so plugins can get duplicates then.
+// Within liveDistance of the head, watcher follows it block by block handling reorgs, and tells plugins
+// implementing plugin.ILivePlugin once it gets there. Only watchers with receipt log plugins alone catch up in steps,
+// others sync block by block all the way, see SetCatchUpPrefetch to fetch blocks ahead.
+func (watcher *AbstractWatcher) SetCatchUp(liveDistance uint64, workers int) {
+	watcher.liveDistance = liveDistance
+	watcher.catchUpWorkers = workers
+}
+
+// catchUpTill returns the last block to catch up in steps from next on, 0 if next is to be synced block by block
+func (watcher *AbstractWatcher) catchUpTill(next, head, syncTo uint64) uint64 {
+	// logs of blocks held in bigStep mode are not fetched yet
+	if watcher.catchUpWorkers <= 0 || watcher.ReceiptCatchUpFromBlock != 0 {
+		return 0
+	}
+
+	blockPlugins, _ := watcher.blockPlugins()
+	txPlugins, _ := watcher.txPlugins()
+	txReceiptPlugins, _ := watcher.txReceiptPlugins()
+	if len(blockPlugins) > 0 || len(txPlugins) > 0 || len(txReceiptPlugins) > 0 {
+		return 0
+	}
+
+	// blocks caught up are delivered without waiting for confirmations
+	distance := watcher.liveDistance
+	if watcher.confirmations > distance {
+		distance = watcher.confirmations
+	}
+
+	if head <= distance {
+		return 0
+	}
+
+	till := head - distance
+	if till > syncTo {
+		till = syncTo
+	}
+
+	if till < next {
+		return 0
+	}
+
+	return till
+}
+
+// catchUp delivers logs of a round of steps from block from on, up to till
+func (watcher *AbstractWatcher) catchUp(ctx context.Context, from, till uint64) error {
+	step := uint64(watcher.logStep.size())
+
+	to := from + step*uint64(watcher.catchUpWorkers) - 1
+	if to > till {
+		to = till
+	}
+
+	logs, toBlock, err := watcher.getReceiptLogsInSteps(ctx, from, to, step, watcher.getReceiptLogFilters())
+	if err == errChainChanged {
+		logrus.Infof("chain changed while catching up block range: %d - %d, try again", from, to)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("caught up block %d - %d, %d receipt logs", from, to, len(logs))
+
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	// logs that far behind are not kept for withdrawing
+	for _, l := range logs {
+		watcher.sendReceiptLog(&structs.RemovableReceiptLog{Log: l})
+	}
+
+	watcher.lastConfirmedBlockNum = to
+	watcher.rangeSummary.Blocks += to - from + 1
+
+	watcher.trimSyncedBlocks()
+	watcher.SyncedBlocks.PushBack(toBlock)
+
+	return watcher.saveCheckpoint()
+}
+
+// errChainChanged is logs of a step not from the branch of its last block
+var errChainChanged = errors.New("chain changed while getting logs")
+
+// getReceiptLogsInSteps gets logs of block from - to with a request per step at once, in order, along with block to.
+// Logs of each step are checked against its last block, fetched before them, errChainChanged if any is off it.
+// The first failed step cancels the others.
+func (watcher *AbstractWatcher) getReceiptLogsInSteps(ctx context.Context, from, to, step uint64, filters []rpc.LogFilter) ([]*types.Log, *types.Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := rpc.BindContext(ctx, watcher.rpc)
+
+	type stepLogs struct {
+		from, to uint64
+		toBlock  *types.Block
+		logs     []*types.Log
+		span     uint64
+	}
+
+	var (
+		steps    []*stepLogs
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for f := from; f <= to; f += step {
+		s := &stepLogs{from: f, to: f + step - 1}
+		if s.to > to {
+			s.to = to
+		}
+
+		steps = append(steps, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := func() (err error) {
+				if s.toBlock, err = client.GetBlockByNum(s.to); err != nil {
+					return err
+				}
+
+				if s.toBlock == nil {
+					return fmt.Errorf("GetBlockByNum(%d) returns nil block", s.to)
+				}
+
+				if s.logs, s.span, err = getReceiptLogs(client, s.from, s.to, filters); err != nil {
+					return err
+				}
+
+				if !logsOnBranchOf(s.logs, s.toBlock) {
+					return errChainChanged
+				}
+
+				return nil
+			}()
+
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+
+	var logs []*types.Log
+	for _, s := range steps {
+		if len(filters) > 0 {
+			watcher.logStep.fetched(int(s.to-s.from+1), int(s.span))
+		}
+
+		logs = append(logs, s.logs...)
+	}
+
+	return logs, steps[len(steps)-1].toBlock, nil
+}
+
+// liveNotice is the item plugins are told watcher is live with
+type liveNotice uint64
+
+// checkLive tells plugins implementing plugin.ILivePlugin watcher is live,
+// once it's within liveDistance of head with logs of all blocks synced fetched
+func (watcher *AbstractWatcher) checkLive(head uint64) {
+	if watcher.live || watcher.ReceiptCatchUpFromBlock != 0 {
+		return
+	}
+
+	synced := watcher.LatestSyncedBlockNum()
+	if synced == 0 || synced+watcher.liveDistance < head {
+		return
+	}
+
+	// blocks held for confirmations are delivered later on
+	num := synced
+	if unconfirmed := watcher.firstUnconfirmedBlockNum(); unconfirmed != 0 {
+		num = unconfirmed - 1
+	}
+
+	if num == 0 {
+		return
+	}
+
+	watcher.live = true
+	logrus.Infof("caught up with head %d at block %d, following it block by block", head, num)
+
+	// items sent before are queued to plugins ahead of the notice
+	watcher.itemsInFlight.Wait()
+
+	watcher.deliveries.sent(num)
+	d := watcher.newDispatch(num)
+
+	for _, live := range watcher.livePlugins() {
+		p := live.p
+
+		watcher.runPlugin(live.runner, d, liveNotice(num), func(calls *pluginCalls) bool {
+			err := calls.call(func() error {
+				p.OnLive(num)
+				return nil
+			})
+
+			if err != nil {
+				logrus.Warnf("plugin failed to take live notice of block %d: %s", num, err)
+			}
+
+			return err == nil
+		})
+	}
+
+	d.done(true)
+}
+
+type livePlugin struct {
+	p      plugin.ILivePlugin
+	runner *pluginRunner
+}
+
+// livePlugins returns registered plugins implementing plugin.ILivePlugin, of all kinds
+func (watcher *AbstractWatcher) livePlugins() []livePlugin {
+	var plugins []interface{}
+	var runners []*pluginRunner
+
+	blockPlugins, blockRunners := watcher.blockPlugins()
+	for _, p := range blockPlugins {
+		plugins = append(plugins, p)
+	}
+	runners = append(runners, blockRunners...)
+
+	txPlugins, txRunners := watcher.txPlugins()
+	for _, p := range txPlugins {
+		plugins = append(plugins, p)
+	}
+	runners = append(runners, txRunners...)
+
+	txReceiptPlugins, txReceiptRunners := watcher.txReceiptPlugins()
+	for _, p := range txReceiptPlugins {
+		plugins = append(plugins, p)
+	}
+	runners = append(runners, txReceiptRunners...)
+
+	receiptLogPlugins, receiptLogRunners := watcher.receiptLogPlugins()
+	for _, p := range receiptLogPlugins {
+		plugins = append(plugins, p)
+	}
+	runners = append(runners, receiptLogRunners...)
+
+	var live []livePlugin
+	for i, p := range plugins {
+		if lp, ok := livePluginOf(p); ok {
+			live = append(live, livePlugin{lp, runners[i]})
+		}
+	}
+
+	return live
+}
+
+// livePluginOf returns p as a plugin.ILivePlugin, looking into plugins added by Register*ErrPlugin
+func livePluginOf(p interface{}) (plugin.ILivePlugin, bool) {
+	switch registered := p.(type) {
+	case *blockErrPlugin:
+		p = registered.p
+	case *txErrPlugin:
+		p = registered.p
+	case *txReceiptErrPlugin:
+		p = registered.p
+	case *receiptLogErrPlugin:
+		p = registered.p
+	}
+
+	lp, ok := p.(plugin.ILivePlugin)
+	return lp, ok
+}
@@ -0,0 +1,207 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockCountingRPC counts blocks fetched
+type blockCountingRPC struct {
+	*fakechain.Chain
+	blocks int32
+}
+
+func (c *blockCountingRPC) GetBlockByNum(num uint64) (*types.Block, error) {
+	atomic.AddInt32(&c.blocks, 1)
+
+	return c.Chain.GetBlockByNum(num)
+}
+
+// staleLogsRPC returns logs of block stale once as if they were from a block orphaned meanwhile
+type staleLogsRPC struct {
+	*fakechain.Chain
+	stale  uint64
+	served int32
+}
+
+func (c *staleLogsRPC) GetLogsWithFilter(from, to uint64, filter rpc.LogFilter) ([]*types.Log, error) {
+	logs, err := c.Chain.GetLogsWithFilter(from, to, filter)
+	if err != nil || c.stale < from || c.stale > to || atomic.AddInt32(&c.served, 1) > 1 {
+		return logs, err
+	}
+
+	for i, l := range logs {
+		if l.BlockNumber == c.stale {
+			orphaned := *l
+			orphaned.BlockHash = common.HexToHash("0xdead")
+			logs[i] = &orphaned
+		}
+	}
+
+	return logs, nil
+}
+
+// liveEvent is a block number, of a log or of the live notice if live
+type liveEvent struct {
+	blockNum uint64
+	live     bool
+}
+
+type liveReceiptLogPlugin struct {
+	*plugin.ReceiptLogPlugin
+	events chan liveEvent
+}
+
+func (p liveReceiptLogPlugin) OnLive(blockNum uint64) {
+	p.events <- liveEvent{blockNum, true}
+}
+
+type liveBlockPlugin struct {
+	plugin.SimpleBlockPlugin
+	events chan liveEvent
+}
+
+func (p liveBlockPlugin) OnLive(blockNum uint64) {
+	p.events <- liveEvent{blockNum, true}
+}
+
+func expectLiveEvent(t *testing.T, events <-chan liveEvent, expected liveEvent) {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		if e != expected {
+			t.Fatalf("expect %+v, got %+v", expected, e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %+v", expected)
+	}
+}
+
+func TestCatchUpInStepsThenLive(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 40; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	client := &blockCountingRPC{Chain: chain}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, client)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCatchUp(5, 2)
+	w.logStep = logRangeStep{max: 5}
+
+	events := make(chan liveEvent, 64)
+	w.RegisterReceiptLogPlugin(liveReceiptLogPlugin{
+		ReceiptLogPlugin: plugin.NewReceiptLogPluginWithFilter(rpc.NewLogFilter(fakeContract.String(), []string{fakeTopic.String()}), func(l *structs.RemovableReceiptLog) {
+			events <- liveEvent{l.Log.BlockNumber, false}
+		}),
+		events: events,
+	})
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 35; i++ {
+		expectLiveEvent(t, events, liveEvent{i, false})
+	}
+
+	// within 5 blocks of the head
+	expectLiveEvent(t, events, liveEvent{35, true})
+
+	for i := uint64(36); i <= 40; i++ {
+		expectLiveEvent(t, events, liveEvent{i, false})
+	}
+
+	// the last block of each of 7 steps up to block 35, then block by block
+	if blocks := atomic.LoadInt32(&client.blocks); blocks > 7+5 {
+		t.Fatalf("expect blocks 1 - 35 caught up in 7 steps, got %d blocks fetched", blocks)
+	}
+
+	chain.AddBlock(fakeTransferTx())
+	expectLiveEvent(t, events, liveEvent{41, false})
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(events) != 0 {
+		t.Fatalf("expect a single live notice, got %d more events", len(events))
+	}
+}
+
+func TestCatchUpChecksLastBlockOfEachStep(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 20; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	// the last block of the first step of the first round
+	client := &staleLogsRPC{Chain: chain, stale: 5}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, client)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCatchUp(5, 2)
+	w.logStep = logRangeStep{max: 5}
+
+	logs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPluginWithFilter(rpc.NewLogFilter(fakeContract.String(), []string{fakeTopic.String()}), func(l *structs.RemovableReceiptLog) {
+		logs <- l
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 20; i++ {
+		select {
+		case l := <-logs:
+			if l.Log.BlockNumber != i || l.Log.BlockHash != chain.Block(i).Hash() {
+				t.Fatalf("expect log of block %d(%s), got %d(%s)", i, chain.Block(i).Hash().Hex(), l.Log.BlockNumber, l.Log.BlockHash.Hex())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no log of block %d", i)
+		}
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(logs) != 0 {
+		t.Fatalf("expect no more log, got %d", len(logs))
+	}
+}
+
+func TestLiveNoticeWithoutCatchUp(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	events := make(chan liveEvent, 64)
+	w.RegisterBlockPlugin(liveBlockPlugin{
+		SimpleBlockPlugin: plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+			events <- liveEvent{b.NumberU64(), false}
+		}),
+		events: events,
+	})
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 10; i++ {
+		expectLiveEvent(t, events, liveEvent{i, false})
+	}
+
+	expectLiveEvent(t, events, liveEvent{10, true})
+
+	chain.AddBlock()
+	expectLiveEvent(t, events, liveEvent{11, false})
+
+	waitWatcherExit(t, cancel, done)
+}
@@ -0,0 +1,267 @@
+package ethereum_watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"ethereum-watcher/rpc"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var ErrCheckpointNotOnChain = errors.New("none of the checkpoint blocks is on the current chain")
+
+type BlockRef struct {
+	Num  uint64      `json:"num"`
+	Hash common.Hash `json:"hash"`
+}
+
+// Checkpoint is the progress of a watcher,
+// RecentBlocks are processed blocks(oldest first, ending with BlockNum) used to find
+// where to resume if the chain reorged, all recent ones are kept and older ones thinned out exponentially
+type Checkpoint struct {
+	BlockNum     uint64      `json:"blockNum"`
+	BlockHash    common.Hash `json:"blockHash"`
+	RecentBlocks []BlockRef  `json:"recentBlocks"`
+}
+
+func newCheckpoint(recentBlocks []BlockRef) *Checkpoint {
+	last := recentBlocks[len(recentBlocks)-1]
+
+	return &Checkpoint{
+		BlockNum:     last.Num,
+		BlockHash:    last.Hash,
+		RecentBlocks: recentBlocks,
+	}
+}
+
+// denseCheckpointBlocks is the distance from the newest checkpoint block within which all blocks are kept
+const denseCheckpointBlocks = 64
+
+// appendBlockRefs appends newer refs to the checkpoint blocks, replacing existing ones from refs[0].Num on,
+// and thins out old blocks to at most one per power of two distance
+func appendBlockRefs(blocks []BlockRef, refs ...BlockRef) []BlockRef {
+	if len(refs) == 0 {
+		return blocks
+	}
+
+	i := len(blocks)
+	for i > 0 && blocks[i-1].Num >= refs[0].Num {
+		i--
+	}
+
+	blocks = append(blocks[:i:i], refs...)
+	tip := blocks[len(blocks)-1].Num
+
+	kept := make([]BlockRef, 0, len(blocks))
+	lastBucket := -1
+	for _, ref := range blocks {
+		distance := tip - ref.Num
+
+		if distance >= denseCheckpointBlocks {
+			// keep the oldest block of each bucket, so the oldest checkpoint block never gets lost
+			bucket := bits.Len64(distance)
+			if bucket == lastBucket {
+				continue
+			}
+
+			lastBucket = bucket
+		}
+
+		kept = append(kept, ref)
+	}
+
+	return kept
+}
+
+// truncateBlockRefs returns a copy of refs up to block num
+func truncateBlockRefs(refs []BlockRef, num uint64) []BlockRef {
+	rst := make([]BlockRef, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Num <= num {
+			rst = append(rst, ref)
+		}
+	}
+
+	return rst
+}
+
+// CheckpointStore persists the progress of a watcher, so it can resume after restart
+type CheckpointStore interface {
+	// Load returns nil if no checkpoint is saved yet
+	Load() (*Checkpoint, error)
+	Save(checkpoint *Checkpoint) error
+}
+
+// FileCheckpointStore keeps the checkpoint as json in a single file
+type FileCheckpointStore struct {
+	path string
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path}
+}
+
+func (s *FileCheckpointStore) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %s", s.path, err)
+	}
+
+	return &checkpoint, nil
+}
+
+func (s *FileCheckpointStore) Save(checkpoint *Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file synced to disk and rename, so a crash never leaves a half written checkpoint
+	dir := filepath.Dir(s.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir persists entries of dir, e.g. a file renamed into it, windows can't sync a directory
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// KVCheckpointStore keeps the checkpoint under a key of an embedded key-value db,
+// watchers sharing one db need different names
+type KVCheckpointStore struct {
+	db     ethdb.KeyValueStore
+	key    []byte
+	ownsDB bool
+}
+
+func NewKVCheckpointStore(db ethdb.KeyValueStore, name string) *KVCheckpointStore {
+	return &KVCheckpointStore{
+		db:  db,
+		key: []byte("ethereum-watcher-checkpoint-" + name),
+	}
+}
+
+// NewLevelDBCheckpointStore opens(or creates) a leveldb at dir, Close the store to release it
+func NewLevelDBCheckpointStore(dir string, name string) (*KVCheckpointStore, error) {
+	db, err := leveldb.New(dir, 16, 16, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewKVCheckpointStore(db, name)
+	store.ownsDB = true
+
+	return store, nil
+}
+
+func (s *KVCheckpointStore) Load() (*Checkpoint, error) {
+	has, err := s.db.Has(s.key)
+	if err != nil || !has {
+		return nil, err
+	}
+
+	data, err := s.db.Get(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %s", s.key, err)
+	}
+
+	return &checkpoint, nil
+}
+
+func (s *KVCheckpointStore) Save(checkpoint *Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Put(s.key, data)
+}
+
+// Close closes the db if it's opened by NewLevelDBCheckpointStore
+func (s *KVCheckpointStore) Close() error {
+	if !s.ownsDB {
+		return nil
+	}
+
+	return s.db.Close()
+}
+
+// findLastCanonicalBlock goes thru checkpoint blocks from the newest,
+// returns the first one still on the chain
+func findLastCanonicalBlock(rpcClient rpc.IBlockChainRPC, checkpoint *Checkpoint) (*types.Block, error) {
+	for i := len(checkpoint.RecentBlocks) - 1; i >= 0; i-- {
+		ref := checkpoint.RecentBlocks[i]
+
+		block, err := rpcClient.GetBlockByNum(ref.Num)
+		if errors.Is(err, ethereum.NotFound) {
+			// node is behind our checkpoint
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if block.Hash() == ref.Hash {
+			return block, nil
+		}
+	}
+
+	return nil, ErrCheckpointNotOnChain
+}
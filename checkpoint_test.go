@@ -0,0 +1,196 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testCheckpointStore(t *testing.T, store CheckpointStore) {
+	checkpoint, err := store.Load()
+	if err != nil || checkpoint != nil {
+		t.Fatalf("expect no checkpoint, got %+v, err: %v", checkpoint, err)
+	}
+
+	saved := newCheckpoint([]BlockRef{
+		{1, common.HexToHash("0x01")},
+		{2, common.HexToHash("0x02")},
+	})
+
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(saved, loaded) {
+		t.Fatalf("expect %+v, got %+v", saved, loaded)
+	}
+
+	if loaded.BlockNum != 2 || loaded.BlockHash != common.HexToHash("0x02") {
+		t.Fatalf("unexpected checkpoint head: %d(%s)", loaded.BlockNum, loaded.BlockHash)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json")))
+}
+
+func TestKVCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, NewKVCheckpointStore(memorydb.New(), "test"))
+}
+
+func TestLevelDBCheckpointStore(t *testing.T) {
+	store, err := NewLevelDBCheckpointStore(t.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testCheckpointStore(t, store)
+}
+
+func TestAbstractWatcherResumesFromCheckpoint(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	run := func(startBlockNum uint64) (chan *structs.RemovableBlock, context.CancelFunc, <-chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := NewEthWatcher(ctx, chain)
+		w.SetSleepSecondsForNewBlock(1)
+		w.SetCheckpointStore(store)
+
+		blocks := make(chan *structs.RemovableBlock, 64)
+		w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+			blocks <- b
+		}))
+
+		return blocks, cancel, runFakeWatcher(t, w, startBlockNum)
+	}
+
+	blocks, cancel, done := run(1)
+	for i := uint64(1); i <= 10; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+	waitWatcherExit(t, cancel, done)
+
+	// chain reorgs while watcher is down
+	chain.Reorg(2, nil, nil, nil)
+
+	blocks, cancel, done = run(1)
+	for i := uint64(9); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+	waitWatcherExit(t, cancel, done)
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint.BlockNum != 11 || checkpoint.BlockHash != chain.Block(11).Hash() {
+		t.Fatalf("unexpected checkpoint: %d(%s)", checkpoint.BlockNum, checkpoint.BlockHash)
+	}
+}
+
+func TestReceiptLogWatcherResumesFromCheckpoint(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(5)
+
+	store := NewKVCheckpointStore(memorydb.New(), "test")
+
+	run := func() []int {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var froms []int
+		handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+			froms = append(froms, from)
+
+			if isUpToHighestBlock {
+				cancel()
+			}
+
+			return nil
+		}
+
+		w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+			ReceiptLogWatcherConfig{
+				IntervalForPollingNewBlockInSec: 1,
+				ReturnForBlockWithNoReceiptLog:  true,
+				CheckpointStore:                 store,
+			},
+		)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- w.Run()
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Run returns err: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ReceiptLogWatcher didn't reach highest block")
+		}
+
+		return froms
+	}
+
+	if froms := run(); !reflect.DeepEqual(froms, []int{1}) {
+		t.Fatalf("unexpected ranges of 1st run: %v", froms)
+	}
+
+	chain.AddBlocks(3)
+	if froms := run(); !reflect.DeepEqual(froms, []int{6}) {
+		t.Fatalf("unexpected ranges of 2nd run: %v", froms)
+	}
+
+	// chain reorgs while watcher is down
+	chain.Reorg(1, nil, nil)
+	if froms := run(); !reflect.DeepEqual(froms, []int{6}) {
+		t.Fatalf("unexpected ranges after reorg: %v", froms)
+	}
+}
+
+func TestAppendBlockRefsThinsOutOldBlocks(t *testing.T) {
+	var refs []BlockRef
+	for i := uint64(1); i <= 10000; i++ {
+		refs = appendBlockRefs(refs, BlockRef{Num: i})
+	}
+
+	if len(refs) > denseCheckpointBlocks+14 {
+		t.Fatalf("too many checkpoint blocks kept: %d", len(refs))
+	}
+
+	for i := 0; i < denseCheckpointBlocks; i++ {
+		if refs[len(refs)-1-i].Num != uint64(10000-i) {
+			t.Fatalf("recent blocks should all be kept, got %+v", refs[len(refs)-denseCheckpointBlocks:])
+		}
+	}
+
+	if refs[0].Num > 10000-4096 {
+		t.Fatalf("oldest checkpoint block %d is too recent", refs[0].Num)
+	}
+
+	// appending an earlier block replaces the ones after it
+	refs = appendBlockRefs(refs, BlockRef{Num: 9990, Hash: common.HexToHash("0x01")})
+	if last := refs[len(refs)-1]; last.Num != 9990 || last.Hash != common.HexToHash("0x01") {
+		t.Fatalf("unexpected last checkpoint block: %+v", last)
+	}
+}
@@ -0,0 +1,171 @@
+package ethereum_watcher
+
+import (
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// unconfirmedBlock holds a block with its receipts and logs until it's deep enough to be delivered
+type unconfirmedBlock struct {
+	num           uint64
+	block         *structs.RemovableBlock
+	txAndReceipts []*structs.RemovableTxAndReceipt
+	receiptLogs   []*structs.RemovableReceiptLog
+}
+
+// SetConfirmations makes watcher hold blocks, tx-receipts and receipt logs
+// until the block has n blocks on top of it(counting itself), 0 means deliver at once.
+// Pending txs mined in a block are told mined once it's delivered too.
+// A reorg only touching held blocks is invisible to plugins,
+// blocks already delivered are still withdrawn with IsRemoved.
+func (watcher *AbstractWatcher) SetConfirmations(n uint64) {
+	watcher.confirmations = n
+}
+
+// findUnconfirmedBlock returns the held entry of block num,
+// creates it if num is not delivered yet, nil means it's confirmed already
+func (watcher *AbstractWatcher) findUnconfirmedBlock(num uint64) *unconfirmedBlock {
+	if watcher.confirmations == 0 || (watcher.lastConfirmedBlockNum > 0 && num <= watcher.lastConfirmedBlockNum) {
+		return nil
+	}
+
+	for e := watcher.unconfirmedBlocks.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*unconfirmedBlock)
+
+		if entry.num == num {
+			return entry
+		}
+
+		if entry.num < num {
+			break
+		}
+	}
+
+	entry := &unconfirmedBlock{num: num}
+	watcher.unconfirmedBlocks.PushBack(entry)
+
+	return entry
+}
+
+// heldBlock returns the held entry of block num, nil if it's not held
+func (watcher *AbstractWatcher) heldBlock(num uint64) *unconfirmedBlock {
+	if watcher.confirmations == 0 {
+		return nil
+	}
+
+	for e := watcher.unconfirmedBlocks.Back(); e != nil; e = e.Prev() {
+		if entry := e.Value.(*unconfirmedBlock); entry.num == num {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// holdsLog tells if log index of block blockHash is held already
+func (entry *unconfirmedBlock) holdsLog(blockHash common.Hash, index uint) bool {
+	for _, l := range entry.receiptLogs {
+		if l.Log.BlockHash == blockHash && l.Log.Index == index {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (watcher *AbstractWatcher) deliverBlock(block *structs.RemovableBlock) {
+	if !block.IsRemoved {
+		if entry := watcher.findUnconfirmedBlock(block.NumberU64()); entry != nil {
+			entry.block = block
+			return
+		}
+	}
+
+	watcher.sendBlock(block)
+
+	if !block.IsRemoved {
+		watcher.mempool.mined(block.Block)
+	}
+}
+
+func (watcher *AbstractWatcher) deliverTxAndReceipt(txAndReceipt *structs.RemovableTxAndReceipt) {
+	if !txAndReceipt.IsRemoved {
+		if entry := watcher.findUnconfirmedBlock(txAndReceipt.Receipt.BlockNumber.Uint64()); entry != nil {
+			entry.txAndReceipts = append(entry.txAndReceipts, txAndReceipt)
+			return
+		}
+	}
+
+	watcher.sendTxAndReceipt(txAndReceipt)
+}
+
+func (watcher *AbstractWatcher) deliverReceiptLog(receiptLog *structs.RemovableReceiptLog) {
+	if !receiptLog.IsRemoved {
+		if entry := watcher.findUnconfirmedBlock(receiptLog.Log.BlockNumber); entry != nil {
+			entry.receiptLogs = append(entry.receiptLogs, receiptLog)
+			return
+		}
+	}
+
+	watcher.sendReceiptLog(receiptLog)
+}
+
+// releaseConfirmedBlocks delivers held blocks with enough confirmations under given chain head
+func (watcher *AbstractWatcher) releaseConfirmedBlocks(headBlockNum uint64) {
+	for watcher.unconfirmedBlocks.Front() != nil {
+		entry := watcher.unconfirmedBlocks.Front().Value.(*unconfirmedBlock)
+
+		if entry.block == nil || entry.num+watcher.confirmations > headBlockNum+1 {
+			return
+		}
+
+		watcher.unconfirmedBlocks.Remove(watcher.unconfirmedBlocks.Front())
+		watcher.lastConfirmedBlockNum = entry.num
+
+		logrus.Debugf("block %d confirmed, head: %d", entry.num, headBlockNum)
+
+		for _, txAndReceipt := range entry.txAndReceipts {
+			watcher.sendTxAndReceipt(txAndReceipt)
+		}
+
+		for _, receiptLog := range entry.receiptLogs {
+			watcher.sendReceiptLog(receiptLog)
+		}
+
+		watcher.sendBlock(entry.block)
+		watcher.mempool.mined(entry.block.Block)
+	}
+}
+
+// dropUnconfirmedBlock discards held entry of a block popped by reorg,
+// returns false if the block is delivered already and needs to be withdrawn
+func (watcher *AbstractWatcher) dropUnconfirmedBlock(num uint64) bool {
+	for e := watcher.unconfirmedBlocks.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*unconfirmedBlock).num == num {
+			watcher.unconfirmedBlocks.Remove(e)
+			return true
+		}
+	}
+
+	if watcher.lastConfirmedBlockNum >= num {
+		watcher.lastConfirmedBlockNum = num - 1
+	}
+
+	return false
+}
+
+// confirmedUnderSynced tells if block num has the confirmations set under the latest block synced,
+// any block does without confirmations
+func (watcher *AbstractWatcher) confirmedUnderSynced(num uint64) bool {
+	return watcher.confirmations == 0 || num+watcher.confirmations <= watcher.LatestSyncedBlockNum()+1
+}
+
+// firstUnconfirmedBlockNum returns the lowest held block, 0 if nothing is held
+func (watcher *AbstractWatcher) firstUnconfirmedBlockNum() uint64 {
+	if watcher.unconfirmedBlocks.Front() == nil {
+		return 0
+	}
+
+	return watcher.unconfirmedBlocks.Front().Value.(*unconfirmedBlock).num
+}
@@ -0,0 +1,87 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"testing"
+	"time"
+)
+
+func expectNoBlock(t *testing.T, blocks <-chan *structs.RemovableBlock, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case b := <-blocks:
+		t.Fatalf("unexpected block %d(removed: %t)", b.NumberU64(), b.IsRemoved)
+	case <-time.After(wait):
+	}
+}
+
+func TestAbstractWatcherWithConfirmations(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(18)
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetConfirmations(3)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	receiptLogs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			receiptLogs <- l
+		},
+	))
+
+	done := runFakeWatcher(t, w, 1)
+
+	// head is 20, block 18 is the highest one with 3 confirmations
+	for i := uint64(1); i <= 18; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+	expectNoBlock(t, blocks, 1500*time.Millisecond)
+
+	if len(receiptLogs) != 0 {
+		t.Fatal("receipt log of unconfirmed block delivered")
+	}
+
+	// reorg within unconfirmed blocks is invisible
+	chain.Reorg(1, nil, nil)
+	expectBlock(t, blocks, chain.Block(19), false)
+
+	select {
+	case l := <-receiptLogs:
+		if l.Log.BlockNumber != 19 || l.IsRemoved {
+			t.Fatalf("unexpected receipt log: %+v", l.Log)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for receipt log")
+	}
+
+	chain.AddBlock()
+	expectBlock(t, blocks, chain.Block(20), false)
+
+	// reorg deeper than confirmations withdraws delivered blocks
+	orphaned := []*types.Block{chain.Block(19), chain.Block(20)}
+	chain.Reorg(4, nil, nil, nil, nil, nil)
+
+	expectBlock(t, blocks, orphaned[1], true)
+	expectBlock(t, blocks, orphaned[0], true)
+
+	for i := uint64(19); i <= 21; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+	expectNoBlock(t, blocks, 1500*time.Millisecond)
+
+	waitWatcherExit(t, cancel, done)
+}
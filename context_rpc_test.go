@@ -0,0 +1,135 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newHangingServer accepts JSON-RPC requests but never answers them
+func newHangingServer(t *testing.T) *httptest.Server {
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+
+	t.Cleanup(func() {
+		close(stop)
+		server.Close()
+	})
+
+	return server
+}
+
+func TestCancelingCtxStopsHangingRequests(t *testing.T) {
+	server := newHangingServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewHttpBasedEthWatcher(ctx, server.URL)
+
+	done := runFakeWatcher(t, w, 1)
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expect watcher to exit without err, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watcher didn't exit while a request hangs")
+	}
+}
+
+func TestReceiptLogWatcherExitsWhileRetrying(t *testing.T) {
+	server := newHangingServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client := rpc.NewEthRPCWithRetry(server.URL, 5)
+	client.SetCallTimeout(50 * time.Millisecond)
+
+	w := NewReceiptLogWatcherWithRPC(ctx, client, 1, fakeContract.String(), nil,
+		func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+			return nil
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	// requests time out quickly, so the watcher is mostly waiting to retry
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expect Run to return nil, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return while waiting to retry")
+	}
+}
+
+func TestListenForReceiptLogExitsWhileRequestHangs(t *testing.T) {
+	server := newHangingServer(t)
+
+	client, err := rpc.DialEthRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan int, 1)
+	go func() {
+		done <- ListenForReceiptLogTillExitWithRPC(ctx, client, 1, fakeContract.String(), nil, func(structs.RemovableReceiptLog) {})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenForReceiptLogTillExitWithRPC didn't exit while a request hangs")
+	}
+}
+
+func TestListenForReceiptLogExitsWhileWaitingForBlock(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan int, 1)
+	go func() {
+		done <- ListenForReceiptLogTillExitWithRPC(ctx, chain, 1, fakeContract.String(), nil, func(structs.RemovableReceiptLog) {})
+	}()
+
+	// all blocks processed, waiting for a new one
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case highest := <-done:
+		if highest != 2 {
+			t.Fatalf("expect blocks up to 2 processed, got %d", highest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenForReceiptLogTillExitWithRPC didn't exit while waiting for a new block")
+	}
+}
@@ -0,0 +1,146 @@
+package ethereum_watcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrDeepReorg = errors.New("reorg deeper than synced blocks")
+
+// DeepReorgPolicy decides what watcher does when a reorg goes beyond the synced blocks it keeps
+type DeepReorgPolicy int
+
+const (
+	// DeepReorgFail stops the watcher with ErrDeepReorg
+	DeepReorgFail DeepReorgPolicy = iota
+	// DeepReorgRewindToCheckpoint syncs again from the last checkpoint block still on chain,
+	// falls back to DeepReorgFail if there is no checkpoint store
+	DeepReorgRewindToCheckpoint
+	// DeepReorgResync syncs again from a fixed number of blocks below the synced ones
+	DeepReorgResync
+)
+
+func (p DeepReorgPolicy) String() string {
+	switch p {
+	case DeepReorgRewindToCheckpoint:
+		return "rewind-to-checkpoint"
+	case DeepReorgResync:
+		return "resync"
+	default:
+		return "fail"
+	}
+}
+
+// DeepReorgEvent describes a reorg which orphaned all synced blocks.
+// Blocks from LowestPoppedBlockNum to HighestPoppedBlockNum are withdrawn as usual,
+// blocks delivered before LowestPoppedBlockNum may be orphaned too but can't be withdrawn.
+type DeepReorgEvent struct {
+	LowestPoppedBlockNum  uint64
+	HighestPoppedBlockNum uint64
+	Policy                DeepReorgPolicy
+	// ResumeFromBlockNum is the block watcher syncs again from, 0 if watcher stops
+	ResumeFromBlockNum uint64
+}
+
+// SetDeepReorgPolicy sets how to recover from a reorg deeper than MaxSyncedBlockToKeep,
+// resyncRange is only used by DeepReorgResync
+func (watcher *AbstractWatcher) SetDeepReorgPolicy(policy DeepReorgPolicy, resyncRange uint64) {
+	watcher.deepReorgPolicy = policy
+	watcher.deepReorgResyncRange = resyncRange
+}
+
+// SetDeepReorgCallback registers callback called from the sync loop once a deep reorg is detected,
+// after the policy is applied
+func (watcher *AbstractWatcher) SetDeepReorgCallback(callback func(event *DeepReorgEvent)) {
+	watcher.deepReorgCallback = callback
+}
+
+// checkBelowSyncedBlocks is called once all synced blocks are popped,
+// it's not a deep reorg if the parent of the lowest popped block is still on chain, caller holds the lock
+func (watcher *AbstractWatcher) checkBelowSyncedBlocks(lowestPopped, highestPopped *types.Block) (*DeepReorgEvent, error) {
+	if lowestPopped.NumberU64() > 0 {
+		parent, err := watcher.rpc.GetBlockByNum(lowestPopped.NumberU64() - 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if parent.Hash() == lowestPopped.ParentHash() {
+			watcher.SyncedBlocks.PushBack(parent)
+			return nil, watcher.saveCheckpoint()
+		}
+	}
+
+	return &DeepReorgEvent{
+		LowestPoppedBlockNum:  lowestPopped.NumberU64(),
+		HighestPoppedBlockNum: highestPopped.NumberU64(),
+		Policy:                watcher.deepReorgPolicy,
+	}, nil
+}
+
+func (watcher *AbstractWatcher) handleDeepReorg(event *DeepReorgEvent) (err error) {
+	logrus.Warnf("deep reorg, all synced blocks(%d - %d) are orphaned, policy: %s",
+		event.LowestPoppedBlockNum, event.HighestPoppedBlockNum, event.Policy)
+
+	var resumeFrom *types.Block
+
+	switch event.Policy {
+	case DeepReorgRewindToCheckpoint:
+		if watcher.checkpointStore == nil {
+			err = fmt.Errorf("%w, no checkpoint store to rewind to", ErrDeepReorg)
+			break
+		}
+
+		checkpoint, loadErr := watcher.checkpointStore.Load()
+		if loadErr != nil {
+			err = loadErr
+			break
+		}
+
+		if checkpoint == nil {
+			err = fmt.Errorf("%w, no checkpoint to rewind to", ErrDeepReorg)
+			break
+		}
+
+		resumeFrom, err = findLastCanonicalBlock(watcher.rpc, checkpoint)
+	case DeepReorgResync:
+		var from uint64
+		if event.LowestPoppedBlockNum > watcher.deepReorgResyncRange+1 {
+			from = event.LowestPoppedBlockNum - watcher.deepReorgResyncRange - 1
+		}
+
+		resumeFrom, err = watcher.rpc.GetBlockByNum(from)
+	default:
+		err = fmt.Errorf("%w, blocks %d - %d", ErrDeepReorg, event.LowestPoppedBlockNum, event.HighestPoppedBlockNum)
+	}
+
+	if err == nil {
+		watcher.rewindTo(resumeFrom)
+		event.ResumeFromBlockNum = resumeFrom.NumberU64() + 1
+
+		logrus.Warnf("sync again from block %d", event.ResumeFromBlockNum)
+	}
+
+	if watcher.deepReorgCallback != nil {
+		watcher.deepReorgCallback(event)
+	}
+
+	return
+}
+
+// rewindTo makes block the only synced one, so syncing goes on from its child
+func (watcher *AbstractWatcher) rewindTo(block *types.Block) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	watcher.SyncedBlocks.Init()
+	watcher.SyncedBlocks.PushBack(block)
+	watcher.ReceiptCatchUpFromBlock = 0
+	watcher.checkpointBlocks = truncateBlockRefs(watcher.checkpointBlocks, block.NumberU64())
+	watcher.uncheckpointedBlocks = truncateBlockRefs(watcher.uncheckpointedBlocks, block.NumberU64())
+
+	if watcher.lastConfirmedBlockNum > block.NumberU64() {
+		watcher.lastConfirmedBlockNum = block.NumberU64()
+	}
+}
@@ -0,0 +1,133 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"testing"
+	"time"
+)
+
+// runDeepReorg syncs blocks 1-10 with 4 blocks kept, then replaces blocks from 11-depth on
+func runDeepReorg(t *testing.T, depth int, setup func(w *AbstractWatcher)) (*fakechain.Chain, chan *structs.RemovableBlock, chan *DeepReorgEvent, context.CancelFunc, <-chan error) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.MaxSyncedBlockToKeep = 4
+
+	events := make(chan *DeepReorgEvent, 1)
+	w.SetDeepReorgCallback(func(event *DeepReorgEvent) {
+		events <- event
+	})
+
+	setup(w)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 10; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	orphaned := []*types.Block{chain.Block(7), chain.Block(8), chain.Block(9), chain.Block(10)}
+	chain.Reorg(depth, make([][]fakechain.Tx, depth+1)...)
+
+	// synced blocks are withdrawn anyway
+	for i := 3; i >= 0; i-- {
+		expectBlock(t, blocks, orphaned[i], true)
+	}
+
+	return chain, blocks, events, cancel, done
+}
+
+func receiveDeepReorgEvent(t *testing.T, events <-chan *DeepReorgEvent) *DeepReorgEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for deep reorg event")
+		return nil
+	}
+}
+
+func TestReorgAsDeepAsSyncedBlocksIsNotDeepReorg(t *testing.T) {
+	chain, blocks, events, cancel, done := runDeepReorg(t, 4, func(w *AbstractWatcher) {})
+
+	for i := uint64(7); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(events) != 0 {
+		t.Fatalf("unexpected deep reorg event: %+v", <-events)
+	}
+}
+
+func TestDeepReorgFail(t *testing.T) {
+	_, _, events, cancel, done := runDeepReorg(t, 6, func(w *AbstractWatcher) {})
+	defer cancel()
+
+	event := receiveDeepReorgEvent(t, events)
+	if event.LowestPoppedBlockNum != 7 || event.HighestPoppedBlockNum != 10 || event.ResumeFromBlockNum != 0 {
+		t.Fatalf("unexpected deep reorg event: %+v", event)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeepReorg) {
+			t.Fatalf("expect ErrDeepReorg, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't stop on deep reorg")
+	}
+}
+
+func TestDeepReorgRewindToCheckpoint(t *testing.T) {
+	chain, blocks, events, cancel, done := runDeepReorg(t, 6, func(w *AbstractWatcher) {
+		w.SetCheckpointStore(NewKVCheckpointStore(memorydb.New(), "test"))
+		w.SetDeepReorgPolicy(DeepReorgRewindToCheckpoint, 0)
+	})
+
+	// block 4 is the last checkpoint block on chain
+	event := receiveDeepReorgEvent(t, events)
+	if event.ResumeFromBlockNum != 5 {
+		t.Fatalf("unexpected deep reorg event: %+v", event)
+	}
+
+	for i := uint64(5); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestDeepReorgResync(t *testing.T) {
+	chain, blocks, events, cancel, done := runDeepReorg(t, 6, func(w *AbstractWatcher) {
+		w.SetDeepReorgPolicy(DeepReorgResync, 3)
+	})
+
+	event := receiveDeepReorgEvent(t, events)
+	if event.ResumeFromBlockNum != 4 {
+		t.Fatalf("unexpected deep reorg event: %+v", event)
+	}
+
+	for i := uint64(4); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+}
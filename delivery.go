@@ -0,0 +1,509 @@
+package ethereum_watcher
+
+import (
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"fmt"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// OnDeliveryFailure is what watcher does with an item a plugin failed to accept, after retries if any
+type OnDeliveryFailure int
+
+const (
+	// StopOnFailure makes RunTillExit return a *DeliveryError, plugins get nothing more
+	StopOnFailure OnDeliveryFailure = iota
+	// DeadLetterOnFailure hands the item to DeliveryPolicy.DeadLetter and moves on
+	DeadLetterOnFailure
+)
+
+// DeliveryPolicy is how errors of a plugin registered by Register*ErrPlugin are handled
+type DeliveryPolicy struct {
+	// Retry decides if and when the plugin is given the item again, nil for no retry.
+	// Retrying gives up when watcher's context is done.
+	Retry     rpc.RetryPolicy
+	OnFailure OnDeliveryFailure
+	// DeadLetter is where DeadLetterOnFailure sends items, watcher stops if it's nil or fails
+	DeadLetter DeadLetterSink
+}
+
+// RetryUntilAccepted retries with backoff of 0.5s, 1s, 2s... up to 30s, until the plugin accepts or watcher exits
+func RetryUntilAccepted() DeliveryPolicy {
+	return DeliveryPolicy{Retry: newDeliveryRetryPolicy(math.MaxInt32)}
+}
+
+// StopOnError stops watcher at the first error
+func StopOnError() DeliveryPolicy {
+	return DeliveryPolicy{OnFailure: StopOnFailure}
+}
+
+// DeadLetterAfterRetries retries maxRetries times with backoff, then hands the item to sink
+func DeadLetterAfterRetries(maxRetries int, sink DeadLetterSink) DeliveryPolicy {
+	return DeliveryPolicy{
+		Retry:      newDeliveryRetryPolicy(maxRetries),
+		OnFailure:  DeadLetterOnFailure,
+		DeadLetter: sink,
+	}
+}
+
+func newDeliveryRetryPolicy(maxRetries int) *rpc.BackoffRetryPolicy {
+	p := rpc.NewBackoffRetryPolicy(maxRetries)
+	// errors of plugins are not rpc errors, all of them are worth a retry
+	p.Classify = func(error) rpc.ErrorClass {
+		return rpc.ErrorRetryable
+	}
+
+	return p
+}
+
+// DeadLetter is an item a plugin failed to accept
+type DeadLetter struct {
+	BlockNum uint64
+	// Item is a *structs.RemovableBlock, structs.RemovableTx, *structs.RemovableTxAndReceipt or *structs.RemovableReceiptLog
+	Item interface{}
+	// Err is the last error of the plugin
+	Err      error
+	Attempts int
+}
+
+// DeadLetterSink keeps items plugins failed to accept, e.g. in a db table or a queue for replaying
+type DeadLetterSink interface {
+	Put(letter *DeadLetter) error
+}
+
+// DeadLetterFunc is a func as DeadLetterSink
+type DeadLetterFunc func(letter *DeadLetter) error
+
+func (f DeadLetterFunc) Put(letter *DeadLetter) error {
+	return f(letter)
+}
+
+// DeliveryError is returned by RunTillExit when watcher stops for a plugin failing to accept an item
+type DeliveryError struct {
+	BlockNum uint64
+	Item     interface{}
+	Err      error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("plugin failed to accept %s of block %d: %s", itemKind(e.Item), e.BlockNum, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+func itemKind(item interface{}) string {
+	switch item.(type) {
+	case *structs.RemovableBlock:
+		return "block"
+	case structs.RemovableTx:
+		return "tx"
+	case *structs.RemovableTxAndReceipt:
+		return "tx receipt"
+	case *structs.RemovableReceiptLog:
+		return "receipt log"
+	case liveNotice:
+		return "live notice"
+	case *structs.PendingTx:
+		return "pending tx"
+	default:
+		return fmt.Sprintf("%T", item)
+	}
+}
+
+// RegisterBlockErrPlugin adds p like RegisterBlockPlugin, errors of p are handled by policy
+func (watcher *AbstractWatcher) RegisterBlockErrPlugin(p plugin.IBlockErrPlugin, policy DeliveryPolicy) *PluginHandle {
+	return watcher.RegisterBlockPlugin(&blockErrPlugin{watcher, p, policy})
+}
+
+// RegisterTxErrPlugin adds p like RegisterTxPlugin, errors of p are handled by policy
+func (watcher *AbstractWatcher) RegisterTxErrPlugin(p plugin.ITxErrPlugin, policy DeliveryPolicy) *PluginHandle {
+	return watcher.RegisterTxPlugin(&txErrPlugin{watcher, p, policy})
+}
+
+// RegisterTxReceiptErrPlugin adds p like RegisterTxReceiptPlugin, errors of p are handled by policy.
+// Receipts are fetched only for txs p needs if it has NeedReceipt like plugin.ITxReceiptFilterPlugin.
+func (watcher *AbstractWatcher) RegisterTxReceiptErrPlugin(p plugin.ITxReceiptErrPlugin, policy DeliveryPolicy) *PluginHandle {
+	return watcher.RegisterTxReceiptPlugin(&txReceiptErrPlugin{watcher, p, policy})
+}
+
+// RegisterReceiptLogErrPlugin adds p like RegisterReceiptLogPlugin, errors of p are handled by policy
+func (watcher *AbstractWatcher) RegisterReceiptLogErrPlugin(p plugin.IReceiptLogErrPlugin, policy DeliveryPolicy) *PluginHandle {
+	return watcher.RegisterReceiptLogPlugin(&receiptLogErrPlugin{watcher, p, policy})
+}
+
+// RegisterReceiptLogErrPluginWithBackfill adds p like RegisterReceiptLogPluginWithBackfill, errors of p are handled by policy
+func (watcher *AbstractWatcher) RegisterReceiptLogErrPluginWithBackfill(p plugin.IReceiptLogErrPlugin, policy DeliveryPolicy, fromBlockNum uint64) *PluginHandle {
+	return watcher.RegisterReceiptLogPluginWithBackfill(&receiptLogErrPlugin{watcher, p, policy}, fromBlockNum)
+}
+
+// error plugins are registered wrapped in these, dispatchers call tryAccept* to learn if the item is taken care of
+
+type blockErrPlugin struct {
+	watcher *AbstractWatcher
+	p       plugin.IBlockErrPlugin
+	policy  DeliveryPolicy
+}
+
+func (a *blockErrPlugin) AcceptBlock(block *structs.RemovableBlock) {
+	a.tryAcceptBlock(block, nil)
+}
+
+func (a *blockErrPlugin) tryAcceptBlock(block *structs.RemovableBlock, calls *pluginCalls) bool {
+	return a.watcher.deliver(a.policy, "AcceptBlock", block.NumberU64(), block, func() error {
+		return calls.call(func() error {
+			return a.p.AcceptBlock(block)
+		})
+	})
+}
+
+type txErrPlugin struct {
+	watcher *AbstractWatcher
+	p       plugin.ITxErrPlugin
+	policy  DeliveryPolicy
+}
+
+func (a *txErrPlugin) AcceptTx(tx structs.RemovableTx) {
+	a.tryAcceptTx(tx, 0, nil)
+}
+
+func (a *txErrPlugin) tryAcceptTx(tx structs.RemovableTx, blockNum uint64, calls *pluginCalls) bool {
+	return a.watcher.deliver(a.policy, "AcceptTx", blockNum, tx, func() error {
+		return calls.call(func() error {
+			return a.p.AcceptTx(tx)
+		})
+	})
+}
+
+type txReceiptErrPlugin struct {
+	watcher *AbstractWatcher
+	p       plugin.ITxReceiptErrPlugin
+	policy  DeliveryPolicy
+}
+
+func (a *txReceiptErrPlugin) NeedReceipt(tx *types.Transaction) bool {
+	if fp, ok := a.p.(interface {
+		NeedReceipt(tx *types.Transaction) bool
+	}); ok {
+		return fp.NeedReceipt(tx)
+	}
+
+	return true
+}
+
+func (a *txReceiptErrPlugin) Accept(txAndReceipt *structs.RemovableTxAndReceipt) {
+	a.tryAccept(txAndReceipt, nil)
+}
+
+func (a *txReceiptErrPlugin) tryAccept(txAndReceipt *structs.RemovableTxAndReceipt, calls *pluginCalls) bool {
+	return a.watcher.deliver(a.policy, "Accept", txAndReceipt.Receipt.BlockNumber.Uint64(), txAndReceipt, func() error {
+		return calls.call(func() error {
+			return a.p.Accept(txAndReceipt)
+		})
+	})
+}
+
+type receiptLogErrPlugin struct {
+	watcher *AbstractWatcher
+	p       plugin.IReceiptLogErrPlugin
+	policy  DeliveryPolicy
+}
+
+func (a *receiptLogErrPlugin) FromContract() string {
+	return a.p.FromContract()
+}
+
+func (a *receiptLogErrPlugin) InterestedTopics() []string {
+	return a.p.InterestedTopics()
+}
+
+func (a *receiptLogErrPlugin) NeedReceiptLog(receiptLog *structs.RemovableReceiptLog) bool {
+	return a.p.NeedReceiptLog(receiptLog)
+}
+
+func (a *receiptLogErrPlugin) LogFilter() rpc.LogFilter {
+	if fp, ok := a.p.(interface {
+		LogFilter() rpc.LogFilter
+	}); ok {
+		return fp.LogFilter()
+	}
+
+	return rpc.NewLogFilter(a.p.FromContract(), a.p.InterestedTopics())
+}
+
+func (a *receiptLogErrPlugin) Accept(receiptLog *structs.RemovableReceiptLog) {
+	a.tryAcceptLog(receiptLog, nil)
+}
+
+func (a *receiptLogErrPlugin) tryAcceptLog(receiptLog *structs.RemovableReceiptLog, calls *pluginCalls) bool {
+	return a.watcher.deliver(a.policy, "Accept", receiptLog.Log.BlockNumber, receiptLog, func() error {
+		return calls.call(func() error {
+			return a.p.Accept(receiptLog)
+		})
+	})
+}
+
+// deliver calls accept until it succeeds or policy gives up,
+// returns false if the item is neither accepted nor dead lettered
+func (watcher *AbstractWatcher) deliver(policy DeliveryPolicy, method string, blockNum uint64, item interface{}, accept func() error) bool {
+	for attempt := 0; ; attempt++ {
+		if watcher.deliveries.isStopped() {
+			return false
+		}
+
+		err := accept()
+		if err == nil {
+			return true
+		}
+
+		// not given to the plugin, watcher is exiting
+		if err == errPluginBusy {
+			return false
+		}
+
+		if policy.Retry != nil {
+			if wait, retry := policy.Retry.Backoff(method, attempt, err); retry {
+				logrus.Warnf("plugin failed to accept %s of block %d, retry in %s: %s", itemKind(item), blockNum, wait, err)
+
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+					continue
+				case <-watcher.Ctx.Done():
+				case <-watcher.deliveries.stopped:
+				}
+
+				timer.Stop()
+				return false
+			}
+		}
+
+		if policy.OnFailure == DeadLetterOnFailure && policy.DeadLetter != nil {
+			letter := &DeadLetter{BlockNum: blockNum, Item: item, Err: err, Attempts: attempt + 1}
+
+			putErr := policy.DeadLetter.Put(letter)
+			if putErr == nil {
+				logrus.Warnf("plugin failed to accept %s of block %d, sent to dead letter: %s", itemKind(item), blockNum, err)
+				return true
+			}
+
+			err = fmt.Errorf("%s, put to dead letter err: %w", err, putErr)
+		}
+
+		watcher.deliveries.stop(&DeliveryError{BlockNum: blockNum, Item: item, Err: err})
+
+		return false
+	}
+}
+
+// acceptBlock gives block to p, returns false if p failed to take care of it
+func (watcher *AbstractWatcher) acceptBlock(p plugin.IBlockPlugin, block *structs.RemovableBlock, calls *pluginCalls) bool {
+	if watcher.deliveries.isStopped() {
+		return false
+	}
+
+	if ep, ok := p.(*blockErrPlugin); ok {
+		return ep.tryAcceptBlock(block, calls)
+	}
+
+	return acceptWithoutErr(block.NumberU64(), block, calls, func() {
+		p.AcceptBlock(block)
+	})
+}
+
+func (watcher *AbstractWatcher) acceptTx(p plugin.ITxPlugin, tx structs.RemovableTx, blockNum uint64, calls *pluginCalls) bool {
+	if watcher.deliveries.isStopped() {
+		return false
+	}
+
+	if ep, ok := p.(*txErrPlugin); ok {
+		return ep.tryAcceptTx(tx, blockNum, calls)
+	}
+
+	return acceptWithoutErr(blockNum, tx, calls, func() {
+		p.AcceptTx(tx)
+	})
+}
+
+func (watcher *AbstractWatcher) acceptTxAndReceipt(p plugin.ITxReceiptPlugin, txAndReceipt *structs.RemovableTxAndReceipt, calls *pluginCalls) bool {
+	if watcher.deliveries.isStopped() {
+		return false
+	}
+
+	if ep, ok := p.(*txReceiptErrPlugin); ok {
+		return ep.tryAccept(txAndReceipt, calls)
+	}
+
+	return acceptWithoutErr(txAndReceipt.Receipt.BlockNumber.Uint64(), txAndReceipt, calls, func() {
+		p.Accept(txAndReceipt)
+	})
+}
+
+func (watcher *AbstractWatcher) acceptReceiptLog(p plugin.IReceiptLogPlugin, receiptLog *structs.RemovableReceiptLog, calls *pluginCalls) bool {
+	if watcher.deliveries.isStopped() {
+		return false
+	}
+
+	if ep, ok := p.(*receiptLogErrPlugin); ok {
+		return ep.tryAcceptLog(receiptLog, calls)
+	}
+
+	return acceptWithoutErr(receiptLog.Log.BlockNumber, receiptLog, calls, func() {
+		p.Accept(receiptLog)
+	})
+}
+
+func (watcher *AbstractWatcher) acceptPendingTx(p plugin.IPendingTxPlugin, tx *structs.PendingTx, calls *pluginCalls) bool {
+	if watcher.deliveries.isStopped() {
+		return false
+	}
+
+	return acceptWithoutErr(tx.BlockNumber, tx, calls, func() {
+		p.AcceptPendingTx(tx)
+	})
+}
+
+// acceptWithoutErr calls a plugin returning no error, it fails by panic or timeout only.
+// Such a plugin can't be given the item again, the failure is logged and the item is taken as done,
+// so checkpoint moves on. Plugins needing each item go thru Register*ErrPlugin.
+func acceptWithoutErr(blockNum uint64, item interface{}, calls *pluginCalls, accept func()) bool {
+	err := calls.call(func() error {
+		accept()
+		return nil
+	})
+
+	// not given to the plugin, watcher is exiting
+	if err == errPluginBusy {
+		return false
+	}
+
+	if err != nil {
+		logrus.Errorf("plugin failed to accept %s of block %d, skip it: %s", itemKind(item), blockNum, err)
+	}
+
+	return true
+}
+
+// sendBlock, sendTxAndReceipt and sendReceiptLog hand items to the dispatching goroutines
+
+func (watcher *AbstractWatcher) sendBlock(block *structs.RemovableBlock) {
+	watcher.rangeSummary.Blocks++
+	watcher.rangeSummary.Txs += uint64(len(block.Transactions()))
+
+	watcher.itemsInFlight.Add(1)
+	watcher.deliveries.sent(block.NumberU64())
+	watcher.NewBlockChan <- block
+}
+
+func (watcher *AbstractWatcher) sendTxAndReceipt(txAndReceipt *structs.RemovableTxAndReceipt) {
+	watcher.itemsInFlight.Add(1)
+	watcher.deliveries.sent(txAndReceipt.Receipt.BlockNumber.Uint64())
+	watcher.NewTxAndReceiptChan <- txAndReceipt
+}
+
+func (watcher *AbstractWatcher) sendReceiptLog(l *structs.RemovableReceiptLog) {
+	watcher.rangeSummary.Logs++
+
+	watcher.itemsInFlight.Add(1)
+	watcher.deliveries.sent(l.Log.BlockNumber)
+	watcher.NewReceiptLogChan <- l
+}
+
+// deliveryTracker follows items sent to plugins, so checkpoint never passes a block not accepted by all plugins
+type deliveryTracker struct {
+	lock sync.Mutex
+	// items sent but not dispatched yet, by block
+	pending map[uint64]int
+	// lowest block with an item not accepted, 0 for none.
+	// Only items of a watcher stopping are left unaccepted, by a *DeliveryError or its context done.
+	undelivered uint64
+
+	err      error
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		pending: make(map[uint64]int),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (t *deliveryTracker) sent(blockNum uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.pending[blockNum]++
+}
+
+// dispatched is called when an item is gone thru plugins, accepted is false if any of them failed
+func (t *deliveryTracker) dispatched(blockNum uint64, accepted bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.pending[blockNum]--; t.pending[blockNum] <= 0 {
+		delete(t.pending, blockNum)
+	}
+
+	if !accepted {
+		t.markUndelivered(blockNum)
+	}
+}
+
+func (t *deliveryTracker) markUndelivered(blockNum uint64) {
+	if t.undelivered == 0 || blockNum < t.undelivered {
+		t.undelivered = blockNum
+	}
+}
+
+// firstPending returns the lowest block not accepted by all plugins yet, 0 if there is none
+func (t *deliveryTracker) firstPending() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	first := t.undelivered
+	for blockNum := range t.pending {
+		if first == 0 || blockNum < first {
+			first = blockNum
+		}
+	}
+
+	return first
+}
+
+func (t *deliveryTracker) stop(err *DeliveryError) {
+	t.stopOnce.Do(func() {
+		logrus.Errorf("stop watcher: %s", err)
+
+		t.lock.Lock()
+		t.err = err
+		t.markUndelivered(err.BlockNum)
+		t.lock.Unlock()
+
+		close(t.stopped)
+	})
+}
+
+func (t *deliveryTracker) isStopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// error returns the *DeliveryError watcher is stopped for, nil if it's not stopped
+func (t *deliveryTracker) error() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.err
+}
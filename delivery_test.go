@@ -0,0 +1,155 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errDBDown = errors.New("db down")
+
+func TestBlockErrPluginRetried(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	failures := 2
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockErrPlugin(plugin.NewBlockErrPlugin(func(b *structs.RemovableBlock) error {
+		if b.NumberU64() == 2 && failures > 0 {
+			failures--
+			return errDBDown
+		}
+
+		blocks <- b
+		return nil
+	}), DeliveryPolicy{Retry: &rpc.BackoffRetryPolicy{MaxRetries: 5, BaseDelay: time.Millisecond}})
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if failures != 0 {
+		t.Fatalf("expect block 2 retried till accepted, %d failures left", failures)
+	}
+}
+
+func TestReceiptLogErrPluginStopsWatcher(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 5; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCheckpointStore(store)
+
+	w.RegisterReceiptLogErrPlugin(plugin.NewReceiptLogErrPlugin(rpc.NewLogFilter(fakeContract.String(), []string{fakeTopic.String()}),
+		func(l *structs.RemovableReceiptLog) error {
+			if l.Log.BlockNumber == 3 {
+				return errDBDown
+			}
+
+			return nil
+		},
+	), StopOnError())
+
+	select {
+	case err := <-runFakeWatcher(t, w, 1):
+		var deliveryErr *DeliveryError
+		if !errors.As(err, &deliveryErr) || !errors.Is(err, errDBDown) || deliveryErr.BlockNum != 3 {
+			t.Fatalf("expect DeliveryError of block 3, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't stop on plugin error")
+	}
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint == nil || checkpoint.BlockNum != 2 {
+		t.Fatalf("expect checkpoint at block 2, got %+v", checkpoint)
+	}
+}
+
+func TestTxReceiptErrPluginDeadLetter(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 3; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCheckpointStore(store)
+
+	letters := make(chan *DeadLetter, 16)
+	receipts := make(chan *structs.RemovableTxAndReceipt, 16)
+	w.RegisterTxReceiptErrPlugin(plugin.NewTxReceiptErrPlugin(func(tx *structs.RemovableTxAndReceipt) error {
+		if tx.Receipt.BlockNumber.Uint64() == 2 {
+			return errDBDown
+		}
+
+		receipts <- tx
+		return nil
+	}, nil), DeadLetterAfterRetries(0, DeadLetterFunc(func(letter *DeadLetter) error {
+		letters <- letter
+		return nil
+	})))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for _, num := range []uint64{1, 3} {
+		select {
+		case tx := <-receipts:
+			if tx.Receipt.BlockNumber.Uint64() != num {
+				t.Fatalf("expect receipt of block %d, got %d", num, tx.Receipt.BlockNumber)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no receipt of block %d", num)
+		}
+	}
+
+	waitSyncedTo(t, w, 3)
+	waitWatcherExit(t, cancel, done)
+
+	if len(letters) != 1 {
+		t.Fatalf("expect 1 dead letter, got %d", len(letters))
+	}
+
+	if letter := <-letters; letter.BlockNum != 2 || letter.Attempts != 1 || !errors.Is(letter.Err, errDBDown) {
+		t.Fatalf("unexpected dead letter: %+v", letter)
+	}
+
+	// dead lettered items don't hold checkpoint back
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint == nil || checkpoint.BlockNum != 3 {
+		t.Fatalf("expect checkpoint at block 3, got %+v", checkpoint)
+	}
+}
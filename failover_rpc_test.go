@@ -0,0 +1,209 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errEndpointDown = errors.New("endpoint down")
+
+// flakyRPC fails every call while down is set
+type flakyRPC struct {
+	*fakechain.Chain
+	down atomic.Bool
+}
+
+func (f *flakyRPC) err() error {
+	if f.down.Load() {
+		return errEndpointDown
+	}
+
+	return nil
+}
+
+func (f *flakyRPC) GetCurrentBlockNum() (uint64, error) {
+	if err := f.err(); err != nil {
+		return 0, err
+	}
+
+	return f.Chain.GetCurrentBlockNum()
+}
+
+func (f *flakyRPC) GetBlockByNum(num uint64) (*types.Block, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+
+	return f.Chain.GetBlockByNum(num)
+}
+
+func (f *flakyRPC) GetTransactionReceipt(txHash string) (*types.Receipt, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+
+	return f.Chain.GetTransactionReceipt(txHash)
+}
+
+func (f *flakyRPC) GetLogs(from, to uint64, address string, topics []string) ([]*types.Log, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+
+	return f.Chain.GetLogs(from, to, address, topics)
+}
+
+func (f *flakyRPC) GetLogsWithFilter(from, to uint64, filter rpc.LogFilter) ([]*types.Log, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+
+	return f.Chain.GetLogsWithFilter(from, to, filter)
+}
+
+func TestWatcherFailsOverToHealthyEndpoint(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	flaky := &flakyRPC{Chain: chain}
+	failover := rpc.NewFailoverRPCWithEndpoints(
+		rpc.FailoverEndpoint{Name: "flaky", Client: flaky},
+		rpc.FailoverEndpoint{Name: "stable", Client: chain},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, failover)
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	flaky.down.Store(true)
+
+	expectBlock(t, blocks, chain.AddBlock(), false)
+	expectBlock(t, blocks, chain.AddBlock(), false)
+
+	waitWatcherExit(t, cancel, done)
+
+	stats := failover.EndpointStats()
+	if stats[0].Name != "stable" || stats[1].ErrorRate == 0 {
+		t.Fatalf("expect failing endpoint scored below stable one, got %+v", stats)
+	}
+}
+
+func TestFailoverRPCPrefersEndpointNotLagging(t *testing.T) {
+	lagging := fakechain.New()
+	lagging.AddBlocks(5)
+
+	upToDate := fakechain.New()
+	upToDate.AddBlocks(8)
+
+	failover := rpc.NewFailoverRPCWithEndpoints(
+		rpc.FailoverEndpoint{Name: "lagging", Client: lagging},
+		rpc.FailoverEndpoint{Name: "up-to-date", Client: upToDate},
+	)
+
+	head, err := failover.GetCurrentBlockNum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head != 8 {
+		t.Fatalf("expect head 8 of endpoint not lagging, got %d", head)
+	}
+
+	block, err := failover.GetBlockByNum(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if block.Hash() != upToDate.Block(7).Hash() {
+		t.Fatal("expect block from endpoint not lagging")
+	}
+}
+
+// hangingHeadRPC doesn't answer the head until released
+type hangingHeadRPC struct {
+	*fakechain.Chain
+	release chan struct{}
+	calls   int32
+}
+
+func (h *hangingHeadRPC) GetCurrentBlockNum() (uint64, error) {
+	atomic.AddInt32(&h.calls, 1)
+	<-h.release
+
+	return h.Chain.GetCurrentBlockNum()
+}
+
+func TestFailoverRPCHeadNotStalledByHangingEndpoint(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(5)
+
+	hanging := &hangingHeadRPC{Chain: chain, release: make(chan struct{})}
+	failover := rpc.NewFailoverRPCWithEndpoints(
+		rpc.FailoverEndpoint{Name: "hanging", Client: hanging},
+		rpc.FailoverEndpoint{Name: "stable", Client: chain},
+	)
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+
+		head, err := failover.GetCurrentBlockNum()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if head != 5 {
+			t.Fatalf("expect head 5, got %d", head)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("expect head without waiting for the hanging endpoint, took %s", elapsed)
+		}
+	}
+
+	// it's not asked again while the first poll hangs
+	if calls := atomic.LoadInt32(&hanging.calls); calls != 1 {
+		t.Fatalf("expect 1 head poll of hanging endpoint, got %d", calls)
+	}
+
+	close(hanging.release)
+
+	// its answer is taken in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var head uint64
+		for _, stat := range failover.EndpointStats() {
+			if stat.Name == "hanging" {
+				head = stat.Head
+			}
+		}
+
+		if head == 5 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("head of hanging endpoint not recorded once it answered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
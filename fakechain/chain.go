@@ -0,0 +1,423 @@
+// Package fakechain provides an in-memory blockchain implementing rpc.IBlockChainRPC,
+// so watchers can be driven offline and deterministically in tests.
+package fakechain
+
+import (
+	"context"
+	"encoding/binary"
+	"ethereum-watcher/rpc"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"sync"
+)
+
+var _ rpc.IBlockChainRPC = (*Chain)(nil)
+
+const genesisTime = 1600000000
+
+// Tx describes a transaction to be mined into a fake block.
+// Raw is used as is if given, otherwise a transaction to To with Data is built.
+// Logs only need Address, Topics and Data, positions are filled when mined.
+type Tx struct {
+	Raw  *types.Transaction
+	To   common.Address
+	Data []byte
+	Logs []*types.Log
+}
+
+type Chain struct {
+	lock sync.RWMutex
+
+	// canonical chain, index == block number
+	blocks    []*types.Block
+	receipts  map[common.Hash][]*types.Receipt
+	head      uint64
+	finalized uint64
+	safe      uint64
+
+	// salt in header.Extra, so blocks of different branches never share a hash
+	branch uint64
+	nonce  uint64
+
+	headSubs   map[*headSubscription]struct{}
+	headSubErr error
+
+	// txs in the mempool, see AddPendingTx
+	pending     map[common.Hash]*rpc.MempoolTx
+	pendingSubs map[*pendingTxSubscription]struct{}
+}
+
+var (
+	_ rpc.IHeadSubscriber   = (*Chain)(nil)
+	_ rpc.ISyncTargetRPC    = (*Chain)(nil)
+	_ rpc.IBlockReceiptsRPC = (*Chain)(nil)
+	_ rpc.ILogFilterRPC     = (*Chain)(nil)
+)
+
+// headSubscription never blocks the chain, heads are dropped if ch is full
+type headSubscription struct {
+	chain *Chain
+	ch    chan<- *types.Header
+	err   chan error
+	once  sync.Once
+}
+
+func (s *headSubscription) Err() <-chan error {
+	return s.err
+}
+
+func (s *headSubscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.chain.lock.Lock()
+		delete(s.chain.headSubs, s)
+		s.chain.lock.Unlock()
+
+		close(s.err)
+	})
+}
+
+// New returns a chain holding only the genesis block
+func New() *Chain {
+	c := &Chain{
+		receipts: make(map[common.Hash][]*types.Receipt),
+		headSubs: make(map[*headSubscription]struct{}),
+
+		pending:     make(map[common.Hash]*rpc.MempoolTx),
+		pendingSubs: make(map[*pendingTxSubscription]struct{}),
+	}
+
+	c.appendBlock(nil)
+
+	return c
+}
+
+// AddBlock mines a block with given txs on top of the chain and moves head to it
+func (c *Chain) AddBlock(txs ...Tx) *types.Block {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	block := c.appendBlock(txs)
+	c.head = block.NumberU64()
+	c.notifyHead()
+
+	return block
+}
+
+// AddBlocks mines n empty blocks
+func (c *Chain) AddBlocks(n int) {
+	for i := 0; i < n; i++ {
+		c.AddBlock()
+	}
+}
+
+// Reorg atomically replaces the top depth blocks with a new branch,
+// one block per element of branch, and moves head to the new tip
+func (c *Chain) Reorg(depth int, branch ...[]Tx) []*types.Block {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if depth >= len(c.blocks) {
+		depth = len(c.blocks) - 1
+	}
+
+	for _, b := range c.blocks[len(c.blocks)-depth:] {
+		delete(c.receipts, b.Hash())
+	}
+
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+	c.branch++
+
+	newBlocks := make([]*types.Block, 0, len(branch))
+	for _, txs := range branch {
+		newBlocks = append(newBlocks, c.appendBlock(txs))
+	}
+
+	c.head = uint64(len(c.blocks) - 1)
+	c.notifyHead()
+
+	return newBlocks
+}
+
+// SetHead sets the highest block visible through rpc,
+// blocks above it are kept but can't be queried until head moves on
+func (c *Chain) SetHead(num uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if num >= uint64(len(c.blocks)) {
+		num = uint64(len(c.blocks) - 1)
+	}
+
+	c.head = num
+	c.notifyHead()
+}
+
+// SetFinalized sets the block number tagged finalized, it's not checked against reorgs
+func (c *Chain) SetFinalized(num uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.finalized = num
+}
+
+// SetSafe sets the block number tagged safe
+func (c *Chain) SetSafe(num uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.safe = num
+}
+
+func (c *Chain) Head() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.head
+}
+
+// Block returns the canonical block at num, regardless of head
+func (c *Chain) Block(num uint64) *types.Block {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if num >= uint64(len(c.blocks)) {
+		return nil
+	}
+
+	return c.blocks[num]
+}
+
+func (c *Chain) GetCurrentBlockNum() (uint64, error) {
+	return c.Head(), nil
+}
+
+func (c *Chain) GetFinalizedBlockNum() (uint64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.finalized, nil
+}
+
+func (c *Chain) GetSafeBlockNum() (uint64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.safe, nil
+}
+
+func (c *Chain) GetBlockByNum(num uint64) (*types.Block, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if num > c.head {
+		return nil, ethereum.NotFound
+	}
+
+	return c.blocks[num], nil
+}
+
+func (c *Chain) GetTransactionReceipt(txHash string) (*types.Receipt, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	hash := common.HexToHash(txHash)
+
+	for i := int(c.head); i >= 0; i-- {
+		for _, receipt := range c.receipts[c.blocks[i].Hash()] {
+			if receipt.TxHash == hash {
+				return copyReceipt(receipt), nil
+			}
+		}
+	}
+
+	return nil, ethereum.NotFound
+}
+
+func (c *Chain) GetTransactionReceiptsInBlock(blockHash string, txHashes []string) ([]*types.Receipt, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	blockReceipts, ok := c.receipts[common.HexToHash(blockHash)]
+	if !ok || (len(blockReceipts) > 0 && blockReceipts[0].BlockNumber.Uint64() > c.head) {
+		return nil, ethereum.NotFound
+	}
+
+	receipts := make([]*types.Receipt, len(txHashes))
+	for i, txHash := range txHashes {
+		for _, receipt := range blockReceipts {
+			if receipt.TxHash == common.HexToHash(txHash) {
+				receipts[i] = copyReceipt(receipt)
+			}
+		}
+
+		if receipts[i] == nil {
+			return nil, ethereum.NotFound
+		}
+	}
+
+	return receipts, nil
+}
+
+func (c *Chain) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.headSubErr != nil {
+		return nil, c.headSubErr
+	}
+
+	sub := &headSubscription{chain: c, ch: ch, err: make(chan error, 1)}
+	c.headSubs[sub] = struct{}{}
+
+	return sub, nil
+}
+
+// SetHeadSubscriptionError drops all head subscriptions with err and fails new ones,
+// nil makes subscribing work again
+func (c *Chain) SetHeadSubscriptionError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.headSubErr = err
+	if err == nil {
+		return
+	}
+
+	for sub := range c.headSubs {
+		sub.err <- err
+		delete(c.headSubs, sub)
+	}
+}
+
+// notifyHead pushes the head to subscribers, caller holds the lock
+func (c *Chain) notifyHead() {
+	header := c.blocks[c.head].Header()
+
+	for sub := range c.headSubs {
+		select {
+		case sub.ch <- header:
+		default:
+		}
+	}
+}
+
+func (c *Chain) GetLogs(from, to uint64, address string, topics []string) ([]*types.Log, error) {
+	return c.GetLogsWithFilter(from, to, rpc.NewLogFilter(address, topics))
+}
+
+func (c *Chain) GetLogsWithFilter(from, to uint64, filter rpc.LogFilter) ([]*types.Log, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if to > c.head {
+		to = c.head
+	}
+
+	var rst []*types.Log
+	for num := from; num <= to; num++ {
+		for _, receipt := range c.receipts[c.blocks[num].Hash()] {
+			for _, l := range receipt.Logs {
+				if !filter.Match(l) {
+					continue
+				}
+
+				cp := *l
+				rst = append(rst, &cp)
+			}
+		}
+	}
+
+	return rst, nil
+}
+
+// appendBlock mines txs into a new block on top of the current tip, caller holds the lock
+func (c *Chain) appendBlock(txs []Tx) *types.Block {
+	var parentHash common.Hash
+	num := uint64(len(c.blocks))
+	if num > 0 {
+		parentHash = c.blocks[num-1].Hash()
+	}
+
+	extra := make([]byte, 8)
+	binary.BigEndian.PutUint64(extra, c.branch)
+
+	header := &types.Header{
+		ParentHash: parentHash,
+		Number:     new(big.Int).SetUint64(num),
+		Time:       genesisTime + num,
+		Difficulty: big.NewInt(1),
+		GasLimit:   30000000,
+		Extra:      extra,
+	}
+
+	transactions := make([]*types.Transaction, 0, len(txs))
+	for _, tx := range txs {
+		raw := tx.Raw
+		if raw == nil {
+			to := tx.To
+			raw = types.NewTx(&types.LegacyTx{
+				Nonce:    c.nonce,
+				To:       &to,
+				Value:    big.NewInt(0),
+				Gas:      21000,
+				GasPrice: big.NewInt(1),
+				Data:     tx.Data,
+			})
+			c.nonce++
+		}
+
+		transactions = append(transactions, raw)
+	}
+
+	block := types.NewBlockWithHeader(header).WithBody(transactions, nil)
+
+	receipts := make([]*types.Receipt, 0, len(txs))
+	logIndex := uint(0)
+	for i, tx := range txs {
+		receipt := &types.Receipt{
+			Status:            types.ReceiptStatusSuccessful,
+			TxHash:            transactions[i].Hash(),
+			GasUsed:           21000,
+			CumulativeGasUsed: 21000 * uint64(i+1),
+			BlockHash:         block.Hash(),
+			BlockNumber:       block.Number(),
+			TransactionIndex:  uint(i),
+		}
+
+		for _, l := range tx.Logs {
+			receipt.Logs = append(receipt.Logs, &types.Log{
+				Address:     l.Address,
+				Topics:      l.Topics,
+				Data:        l.Data,
+				BlockNumber: num,
+				TxHash:      receipt.TxHash,
+				TxIndex:     uint(i),
+				BlockHash:   block.Hash(),
+				Index:       logIndex,
+			})
+			logIndex++
+		}
+
+		receipts = append(receipts, receipt)
+	}
+
+	c.blocks = append(c.blocks, block)
+	c.receipts[block.Hash()] = receipts
+
+	c.removeMinedTxs(transactions)
+
+	return block
+}
+
+func copyReceipt(r *types.Receipt) *types.Receipt {
+	cp := *r
+	cp.Logs = make([]*types.Log, len(r.Logs))
+	for i, l := range r.Logs {
+		logCopy := *l
+		cp.Logs[i] = &logCopy
+	}
+
+	return &cp
+}
@@ -0,0 +1,161 @@
+package fakechain
+
+import (
+	"bytes"
+	"context"
+	"ethereum-watcher/rpc"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sort"
+	"sync"
+)
+
+var (
+	_ rpc.IPendingTxSubscriber = (*Chain)(nil)
+	_ rpc.ITxPoolRPC           = (*Chain)(nil)
+)
+
+// pendingTxSubscription never blocks the chain, hashes or txs are dropped if ch is full
+type pendingTxSubscription struct {
+	chain *Chain
+	// one of them is set
+	ch   chan<- common.Hash
+	txs  chan<- *rpc.MempoolTx
+	err  chan error
+	once sync.Once
+}
+
+func (s *pendingTxSubscription) Err() <-chan error {
+	return s.err
+}
+
+func (s *pendingTxSubscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.chain.lock.Lock()
+		delete(s.chain.pendingSubs, s)
+		s.chain.lock.Unlock()
+
+		close(s.err)
+	})
+}
+
+// AddPendingTx puts tx sent by from into the mempool, replacing the pending tx of the same sender and nonce.
+// tx stays there until it's mined as a Tx.Raw, or removed by RemovePendingTx.
+func (c *Chain) AddPendingTx(tx *types.Transaction, from common.Address) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for hash, pending := range c.pending {
+		if pending.From == from && pending.Tx.Nonce() == tx.Nonce() {
+			delete(c.pending, hash)
+		}
+	}
+
+	c.pending[tx.Hash()] = &rpc.MempoolTx{Tx: tx, From: from}
+
+	for sub := range c.pendingSubs {
+		if sub.txs != nil {
+			select {
+			case sub.txs <- &rpc.MempoolTx{Tx: tx, From: from}:
+			default:
+			}
+
+			continue
+		}
+
+		select {
+		case sub.ch <- tx.Hash():
+		default:
+		}
+	}
+}
+
+// RemovePendingTx drops tx hash from the mempool without mining it
+func (c *Chain) RemovePendingTx(hash common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.pending, hash)
+}
+
+// PendingTxSubscribers returns how many subscribe pending txs, txs added before they subscribe are not pushed to them
+func (c *Chain) PendingTxSubscribers() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.pendingSubs)
+}
+
+func (c *Chain) SubscribeFullPendingTransactions(ctx context.Context, ch chan<- *rpc.MempoolTx) (ethereum.Subscription, error) {
+	return c.subscribePending(&pendingTxSubscription{chain: c, txs: ch, err: make(chan error, 1)}), nil
+}
+
+func (c *Chain) SubscribePendingTransactions(ctx context.Context, ch chan<- common.Hash) (ethereum.Subscription, error) {
+	return c.subscribePending(&pendingTxSubscription{chain: c, ch: ch, err: make(chan error, 1)}), nil
+}
+
+func (c *Chain) subscribePending(sub *pendingTxSubscription) *pendingTxSubscription {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pendingSubs[sub] = struct{}{}
+
+	return sub
+}
+
+// GetPendingTransactions returns txs of txHashes still in the mempool
+func (c *Chain) GetPendingTransactions(txHashes []string) ([]*rpc.MempoolTx, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var txs []*rpc.MempoolTx
+	for _, txHash := range txHashes {
+		if tx, ok := c.pending[common.HexToHash(txHash)]; ok {
+			cp := *tx
+			txs = append(txs, &cp)
+		}
+	}
+
+	return txs, nil
+}
+
+// GetTxPoolContent returns txs in the mempool by sender and nonce
+func (c *Chain) GetTxPoolContent() ([]*rpc.MempoolTx, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	txs := make([]*rpc.MempoolTx, 0, len(c.pending))
+	for _, tx := range c.pending {
+		cp := *tx
+		txs = append(txs, &cp)
+	}
+
+	sort.Slice(txs, func(i, j int) bool {
+		if c := bytes.Compare(txs[i].From[:], txs[j].From[:]); c != 0 {
+			return c < 0
+		}
+
+		return txs[i].Tx.Nonce() < txs[j].Tx.Nonce()
+	})
+
+	return txs, nil
+}
+
+// removeMinedTxs drops txs mined, and the ones they replace, from the mempool, caller holds the lock
+func (c *Chain) removeMinedTxs(txs []*types.Transaction) {
+	for _, tx := range txs {
+		delete(c.pending, tx.Hash())
+
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil {
+			continue
+		}
+
+		for hash, pending := range c.pending {
+			if pending.From == from && pending.Tx.Nonce() == tx.Nonce() {
+				delete(c.pending, hash)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fakeOtherContract = common.HexToAddress("0x5555555555555555555555555555555555555555")
+
+func fakeTokenTransferTx(token, to common.Address) fakechain.Tx {
+	return fakechain.Tx{
+		To: token,
+		Logs: []*types.Log{{
+			Address: token,
+			Topics:  []common.Hash{fakeTopic, common.BytesToHash(fakeSender.Bytes()), common.BytesToHash(to.Bytes())},
+		}},
+	}
+}
+
+// countingRPC counts eth_getLogs requests
+type countingRPC struct {
+	*fakechain.Chain
+	getLogs int32
+}
+
+func (c *countingRPC) GetLogs(from, to uint64, address string, topics []string) ([]*types.Log, error) {
+	return c.GetLogsWithFilter(from, to, rpc.NewLogFilter(address, topics))
+}
+
+func (c *countingRPC) GetLogsWithFilter(from, to uint64, filter rpc.LogFilter) ([]*types.Log, error) {
+	atomic.AddInt32(&c.getLogs, 1)
+
+	return c.Chain.GetLogsWithFilter(from, to, filter)
+}
+
+func TestMergeLogFilters(t *testing.T) {
+	transfer, approval := fakeTopic, common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+
+	on := func(addresses ...common.Address) rpc.LogFilter {
+		return rpc.LogFilter{Addresses: addresses, Topics: [][]common.Hash{{transfer}}}
+	}
+
+	merged := rpc.MergeLogFilters(on(fakeContract), on(fakeOtherContract), on(fakeContract))
+	if len(merged) != 1 || len(merged[0].Addresses) != 2 {
+		t.Fatalf("expect contracts with the same topics in 1 filter, got %+v", merged)
+	}
+
+	merged = rpc.MergeLogFilters(on(fakeContract), on())
+	if len(merged) != 1 || len(merged[0].Addresses) != 0 {
+		t.Fatalf("expect any contract to cover the others, got %+v", merged)
+	}
+
+	approvals := rpc.LogFilter{Addresses: []common.Address{fakeContract}, Topics: [][]common.Hash{{approval}}}
+	deposits := rpc.LogFilter{Topics: depositTopics()}
+
+	merged = rpc.MergeLogFilters(on(fakeContract), approvals, deposits, on(fakeOtherContract))
+	if len(merged) != 3 {
+		t.Fatalf("expect 3 filters, got %+v", merged)
+	}
+
+	if f := merged[0]; len(f.Addresses) != 1 || len(f.Topics) != 1 || len(f.Topics[0]) != 2 {
+		t.Fatalf("expect topics of the same contract merged, got %+v", f)
+	}
+
+	if f := merged[1]; len(f.Addresses) != 0 || len(f.Topics) != 3 {
+		t.Fatalf("expect deposits of any contract kept apart, got %+v", f)
+	}
+}
+
+func TestReceiptLogWatcherOnManyAndAnyContracts(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		client    func(chain *fakechain.Chain) rpc.IBlockChainRPC
+		addresses []common.Address
+		expected  []common.Address
+	}{
+		{"any contract", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return chain }, nil,
+			[]common.Address{fakeOtherContract, fakeContract, fakeContract}},
+		{"many contracts", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return chain }, []common.Address{fakeContract, fakeOtherContract},
+			[]common.Address{fakeOtherContract, fakeContract, fakeContract}},
+		{"many contracts client side", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return topic0OnlyRPC{chain} },
+			[]common.Address{fakeContract, fakeOtherContract},
+			[]common.Address{fakeOtherContract, fakeContract, fakeContract}},
+		{"one of them", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return chain }, []common.Address{fakeOtherContract},
+			[]common.Address{fakeOtherContract}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			chain.AddBlock(fakeTokenTransferTx(fakeOtherContract, fakeDeposit[0]), fakeTokenTransferTx(fakeContract, fakeDeposit[1]))
+			chain.AddBlock(fakeTokenTransferTx(fakeOtherContract, fakeOther))
+			chain.AddBlock(fakeTokenTransferTx(fakeContract, fakeDeposit[0]))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var logs []*types.Log
+			handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+				logs = append(logs, receiptLogs...)
+
+				if isUpToHighestBlock {
+					cancel()
+				}
+
+				return nil
+			}
+
+			w := NewReceiptLogWatcherWithRPC(ctx, tc.client(chain), 1, "", nil, handler,
+				ReceiptLogWatcherConfig{
+					IntervalForPollingNewBlockInSec: 1,
+					ReturnForBlockWithNoReceiptLog:  true,
+					Addresses:                       tc.addresses,
+					Topics:                          depositTopics(),
+				},
+			)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- w.Run()
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run returns err: %s", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ReceiptLogWatcher didn't reach highest block")
+			}
+
+			if len(logs) != len(tc.expected) {
+				t.Fatalf("expect %d logs, got %d", len(tc.expected), len(logs))
+			}
+
+			for i, l := range logs {
+				if l.Address != tc.expected[i] {
+					t.Fatalf("log %d: expect from %s, got %s", i, tc.expected[i], l.Address)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiptLogPluginsShareGetLogs(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(1)
+
+	client := &countingRPC{Chain: chain}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, client)
+	w.SetSleepSecondsForNewBlock(1)
+
+	receiptLogs := make(chan *structs.RemovableReceiptLog, 16)
+	for _, contract := range []common.Address{fakeContract, fakeOtherContract} {
+		w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(contract.String(), []string{fakeTopic.String()},
+			func(l *structs.RemovableReceiptLog) {
+				receiptLogs <- l
+			},
+		))
+	}
+
+	deposits := make(chan *structs.RemovableReceiptLog, 16)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPluginWithFilter(rpc.LogFilter{Topics: depositTopics()},
+		func(l *structs.RemovableReceiptLog) {
+			deposits <- l
+		},
+	))
+
+	done := runFakeWatcher(t, w, 1)
+
+	chain.AddBlock(
+		fakeTokenTransferTx(fakeContract, fakeOther),
+		fakeTokenTransferTx(fakeOtherContract, fakeDeposit[0]),
+		fakeTokenTransferTx(fakeSender, fakeDeposit[1]),
+	)
+
+	receiveLog := func(ch chan *structs.RemovableReceiptLog) {
+		t.Helper()
+
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no receipt log received")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		receiveLog(receiptLogs)
+		receiveLog(deposits)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	// block 1 and 2
+	if n := atomic.LoadInt32(&client.getLogs); n != 4 {
+		t.Fatalf("expect 2 eth_getLogs per block, got %d", n)
+	}
+
+	if len(receiptLogs) != 0 || len(deposits) != 0 {
+		t.Fatalf("unexpected receipt logs: %d, deposits: %d", len(receiptLogs), len(deposits))
+	}
+}
@@ -0,0 +1,48 @@
+package ethereum_watcher
+
+import "github.com/sirupsen/logrus"
+
+// successes in a row at full step before it doubles
+const logRangeGrowAfter = 3
+
+// logRangeStep is how many blocks to get logs of at once.
+// It shrinks to the range the node accepted when GetLogs had to be split, and grows back up to max after successes.
+type logRangeStep struct {
+	max       int
+	cur       int
+	successes int
+}
+
+func (s *logRangeStep) size() int {
+	if s.cur <= 0 || s.cur > s.max {
+		return s.max
+	}
+
+	return s.cur
+}
+
+// fetched records logs of requested blocks are got, the largest range fetched at once was span blocks
+func (s *logRangeStep) fetched(requested, span int) {
+	if span < requested {
+		if span < s.size() {
+			logrus.Infof("node rejected getting logs of %d blocks, shrink step to %d", requested, span)
+			s.cur = span
+		}
+
+		s.successes = 0
+		return
+	}
+
+	// a short range tells nothing about the limit
+	if requested < s.size() || s.size() >= s.max {
+		return
+	}
+
+	s.successes++
+	if s.successes >= logRangeGrowAfter {
+		s.cur = s.size() * 2
+		s.successes = 0
+
+		logrus.Debugf("grow step of getting logs to %d", s.size())
+	}
+}
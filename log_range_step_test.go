@@ -0,0 +1,142 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/rpc"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeLimitedRPC rejects getting logs of more than limit blocks at once, like most providers
+type rangeLimitedRPC struct {
+	*fakechain.Chain
+	limit int32
+}
+
+func (r *rangeLimitedRPC) GetLogs(from, to uint64, address string, topics []string) ([]*types.Log, error) {
+	return r.GetLogsWithFilter(from, to, rpc.NewLogFilter(address, topics))
+}
+
+func (r *rangeLimitedRPC) GetLogsWithFilter(from, to uint64, filter rpc.LogFilter) ([]*types.Log, error) {
+	if to-from+1 > uint64(atomic.LoadInt32(&r.limit)) {
+		return nil, errors.New("query returned more than 10000 results")
+	}
+
+	return r.Chain.GetLogsWithFilter(from, to, filter)
+}
+
+func TestGetLogsSplitting(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 20; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	client := &rangeLimitedRPC{Chain: chain, limit: 3}
+
+	logs, span, err := rpc.GetLogsSplitting(client, 1, 20, rpc.NewLogFilter(fakeContract.String(), []string{fakeTopic.String()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if span > 3 {
+		t.Fatalf("expect ranges of up to 3 blocks, got %d", span)
+	}
+
+	if len(logs) != 20 {
+		t.Fatalf("expect 20 logs, got %d", len(logs))
+	}
+
+	for i, l := range logs {
+		if l.BlockNumber != uint64(i+1) {
+			t.Fatalf("log %d: expect block %d, got %d", i, i+1, l.BlockNumber)
+		}
+	}
+
+	client.limit = 0
+	if _, _, err := rpc.GetLogsSplitting(client, 1, 20, rpc.LogFilter{}); !rpc.IsLogRangeTooLarge(err) {
+		t.Fatalf("expect too large err once a single block is rejected, got %v", err)
+	}
+}
+
+func TestReceiptLogWatcherAdaptsLogStep(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 120; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	client := &rangeLimitedRPC{Chain: chain, limit: 4}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type handled struct {
+		from, to int
+		logs     int
+	}
+
+	var calls []handled
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		calls = append(calls, handled{from, to, len(receiptLogs)})
+
+		// provider raises the limit
+		if to >= 40 {
+			atomic.StoreInt32(&client.limit, 100)
+		}
+
+		if isUpToHighestBlock {
+			cancel()
+		}
+
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, client, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			StepSizeForBigLag:               16,
+			IntervalForPollingNewBlockInSec: 1,
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returns err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiptLogWatcher didn't reach highest block")
+	}
+
+	next := 1
+	for i, call := range calls {
+		if call.from != next || call.logs != call.to-call.from+1 {
+			t.Fatalf("call %d: expect range from %d with a log per block, got %+v", i, next, call)
+		}
+
+		next = call.to + 1
+	}
+
+	if next != 121 {
+		t.Fatalf("expect all 120 blocks handled, handled till %d", next-1)
+	}
+
+	if first := calls[0]; first.to-first.from+1 != 16 {
+		t.Fatalf("expect first range split but handled as a whole, got %+v", first)
+	}
+
+	if second := calls[1]; second.to-second.from+1 != 4 {
+		t.Fatalf("expect step shrunk to 4, got %+v", second)
+	}
+
+	if last := calls[len(calls)-2]; last.to-last.from+1 != 16 {
+		t.Fatalf("expect step grown back to 16, got %+v", last)
+	}
+}
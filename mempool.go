@@ -0,0 +1,491 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMempoolPollInterval = 2 * time.Second
+	DefaultMempoolDropAfter    = time.Minute
+)
+
+// MempoolOptions tune how txs are taken from the mempool for pending tx plugins
+type MempoolOptions struct {
+	// PollInterval is how often txpool_content is polled, or txs followed are checked if subscribed,
+	// DefaultMempoolPollInterval if 0
+	PollInterval time.Duration
+	// DropAfter is how long a tx followed can be missing from the mempool before it's taken as dropped,
+	// DefaultMempoolDropAfter if 0
+	DropAfter time.Duration
+	// Poll makes watcher poll txpool_content even if rpc can push new pending txs
+	Poll bool
+}
+
+// SetMempoolOptions sets how pending tx plugins are fed, takes effect on the next run.
+// Txs are pushed by rpc if it's an rpc.IPendingTxSubscriber that can subscribe, e.g. over WebSocket,
+// otherwise polled from txpool_content if it's an rpc.ITxPoolRPC. rpc.FailoverRPC is both, thru its endpoints.
+func (watcher *AbstractWatcher) SetMempoolOptions(options MempoolOptions) {
+	watcher.mempoolOptions = options
+}
+
+// canTellPendingTxs tells if client is a source of pending txs
+func canTellPendingTxs(client rpc.IBlockChainRPC) bool {
+	_, canSubscribe := client.(rpc.IPendingTxSubscriber)
+	_, canPoll := client.(rpc.ITxPoolRPC)
+
+	return canSubscribe || canPoll
+}
+
+type trackedTx struct {
+	tx       *types.Transaction
+	from     common.Address
+	lastSeen time.Time
+}
+
+type senderNonce struct {
+	from  common.Address
+	nonce uint64
+}
+
+// mempoolWatcher follows pending txs needed by plugins until they are mined, replaced or dropped
+type mempoolWatcher struct {
+	watcher *AbstractWatcher
+	options MempoolOptions
+
+	lock     sync.Mutex
+	tracked  map[common.Hash]*trackedTx
+	bySender map[senderNonce]common.Hash
+	// count of tracked txs by nonce, senders of mined txs are only recovered if they may replace one
+	nonces map[uint64]int
+
+	cancel context.CancelFunc
+	exited chan struct{}
+}
+
+func (watcher *AbstractWatcher) startMempool() {
+	options := watcher.mempoolOptions
+	if options.PollInterval <= 0 {
+		options.PollInterval = DefaultMempoolPollInterval
+	}
+
+	if options.DropAfter <= 0 {
+		options.DropAfter = DefaultMempoolDropAfter
+	}
+
+	ctx, cancel := context.WithCancel(watcher.Ctx)
+
+	m := &mempoolWatcher{
+		watcher:  watcher,
+		options:  options,
+		tracked:  make(map[common.Hash]*trackedTx),
+		bySender: make(map[senderNonce]common.Hash),
+		nonces:   make(map[uint64]int),
+		cancel:   cancel,
+		exited:   make(chan struct{}),
+	}
+
+	watcher.mempool = m
+	go m.run(ctx)
+}
+
+// stop returns once no more pending tx is sent to plugins
+func (m *mempoolWatcher) stop() {
+	if m == nil {
+		return
+	}
+
+	m.cancel()
+	<-m.exited
+}
+
+func (m *mempoolWatcher) run(ctx context.Context) {
+	defer close(m.exited)
+
+	subscriber, canSubscribe := m.watcher.rpc.(rpc.IPendingTxSubscriber)
+	canSubscribe = canSubscribe && !m.options.Poll
+	poller, canPoll := m.watcher.rpc.(rpc.ITxPoolRPC)
+
+	if !canSubscribe && !canPoll {
+		if plugins, _ := m.watcher.pendingTxPlugins(); len(plugins) > 0 {
+			logrus.Warnln("rpc can't tell pending txs, pending tx plugins get none")
+		} else {
+			logrus.Debugln("rpc can't tell pending txs, pending tx plugins get none")
+		}
+
+		return
+	}
+
+	var (
+		sub ethereum.Subscription
+		// whole txs are pushed if the node can, otherwise hashes to look up
+		full       = true
+		fullPushed bool
+		txs        = make(chan *rpc.MempoolTx, 256)
+		hashes     = make(chan common.Hash, 256)
+	)
+
+	unsubscribe := func() {
+		if sub != nil {
+			sub.Unsubscribe()
+			sub = nil
+		}
+	}
+	defer unsubscribe()
+
+	subscribe := func() {
+		var err error
+		if full {
+			if sub, err = subscriber.SubscribeFullPendingTransactions(ctx, txs); err == nil {
+				return
+			}
+
+			logrus.Infof("fail to subscribe full pending txs: %s, subscribe tx hashes", err)
+			full = false
+		}
+
+		if sub, err = subscriber.SubscribePendingTransactions(ctx, hashes); err != nil {
+			logrus.Warnf("fail to subscribe pending txs: %s", err)
+			sub = nil
+		}
+	}
+
+	check := func() {
+		// idle without plugins
+		if plugins, _ := m.watcher.pendingTxPlugins(); len(plugins) == 0 {
+			unsubscribe()
+			return
+		}
+
+		if canSubscribe && sub == nil {
+			subscribe()
+		}
+
+		if sub != nil {
+			m.refresh(subscriber)
+		} else if canPoll {
+			m.poll(poller)
+		}
+
+		m.sweep()
+	}
+
+	ticker := time.NewTicker(m.options.PollInterval)
+	defer ticker.Stop()
+
+	check()
+
+	for {
+		var subErr <-chan error
+		if sub != nil {
+			subErr = sub.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case tx := <-txs:
+			fullPushed = true
+
+			// along with the ones queued meanwhile
+			batch := []*rpc.MempoolTx{tx}
+			for len(txs) > 0 && len(batch) < cap(txs) {
+				batch = append(batch, <-txs)
+			}
+
+			m.seen(batch)
+		case hash := <-hashes:
+			batch := []common.Hash{hash}
+			for len(hashes) > 0 && len(batch) < cap(hashes) {
+				batch = append(batch, <-hashes)
+			}
+
+			m.fetch(subscriber, batch)
+		case err := <-subErr:
+			// the node pushes hashes only
+			if full && !fullPushed {
+				logrus.Infof("full pending tx subscription down: %v, subscribe tx hashes", err)
+				full = false
+			} else {
+				logrus.Warnf("pending tx subscription down: %v, subscribe again", err)
+			}
+
+			unsubscribe()
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// fetch follows tx hashes pushed by the subscription
+func (m *mempoolWatcher) fetch(subscriber rpc.IPendingTxSubscriber, hashes []common.Hash) {
+	txHashes := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		txHashes = append(txHashes, hash.Hex())
+	}
+
+	// mined or dropped already are left out
+	txs, err := subscriber.GetPendingTransactions(txHashes)
+	if err != nil {
+		logrus.Warnf("fail to get %d pending txs: %s", len(txHashes), err)
+		return
+	}
+
+	m.seen(txs)
+}
+
+// refresh checks txs followed are still in the mempool, when they are not polled
+func (m *mempoolWatcher) refresh(subscriber rpc.IPendingTxSubscriber) {
+	var txHashes []string
+
+	m.lock.Lock()
+	for hash := range m.tracked {
+		txHashes = append(txHashes, hash.Hex())
+	}
+	m.lock.Unlock()
+
+	if len(txHashes) == 0 {
+		return
+	}
+
+	txs, err := subscriber.GetPendingTransactions(txHashes)
+	if err != nil {
+		logrus.Warnf("fail to get %d pending txs: %s", len(txHashes), err)
+		return
+	}
+
+	m.seen(txs)
+}
+
+func (m *mempoolWatcher) poll(poller rpc.ITxPoolRPC) {
+	txs, err := poller.GetTxPoolContent()
+	if err != nil {
+		logrus.Warnf("fail to get txpool content: %s", err)
+		return
+	}
+
+	m.seen(txs)
+}
+
+// seen follows txs in the mempool needed by any plugin, a tx with the nonce of one followed replaces it
+func (m *mempoolWatcher) seen(txs []*rpc.MempoolTx) {
+	plugins, _ := m.watcher.pendingTxPlugins()
+	now := time.Now()
+
+	var events []*structs.PendingTx
+
+	m.lock.Lock()
+	for _, t := range txs {
+		hash := t.Tx.Hash()
+		if tracked, ok := m.tracked[hash]; ok {
+			tracked.lastSeen = now
+			continue
+		}
+
+		key := senderNonce{t.From, t.Tx.Nonce()}
+		if old, ok := m.bySender[key]; ok {
+			replaced := m.untrack(old)
+			events = append(events, &structs.PendingTx{Tx: replaced.tx, From: replaced.from, Status: structs.PendingTxReplaced, ReplacedBy: t.Tx})
+		}
+
+		if !needPendingTx(plugins, t.Tx, t.From) {
+			continue
+		}
+
+		m.tracked[hash] = &trackedTx{tx: t.Tx, from: t.From, lastSeen: now}
+		m.bySender[key] = hash
+		m.nonces[key.nonce]++
+
+		events = append(events, &structs.PendingTx{Tx: t.Tx, From: t.From, Status: structs.PendingTxPending})
+	}
+	m.lock.Unlock()
+
+	m.emit(events)
+}
+
+// mined ends following txs of block, or txs replaced by them
+func (m *mempoolWatcher) mined(block *types.Block) {
+	if m == nil {
+		return
+	}
+
+	var events []*structs.PendingTx
+
+	m.lock.Lock()
+	for _, tx := range block.Transactions() {
+		if len(m.tracked) == 0 {
+			break
+		}
+
+		if _, ok := m.tracked[tx.Hash()]; ok {
+			mined := m.untrack(tx.Hash())
+			events = append(events, &structs.PendingTx{Tx: mined.tx, From: mined.from, Status: structs.PendingTxMined, BlockNumber: block.NumberU64()})
+			continue
+		}
+
+		if m.nonces[tx.Nonce()] == 0 {
+			continue
+		}
+
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil {
+			continue
+		}
+
+		if hash, ok := m.bySender[senderNonce{from, tx.Nonce()}]; ok {
+			replaced := m.untrack(hash)
+			events = append(events, &structs.PendingTx{Tx: replaced.tx, From: replaced.from, Status: structs.PendingTxReplaced, ReplacedBy: tx})
+		}
+	}
+	m.lock.Unlock()
+
+	m.emit(events)
+}
+
+// reorged follows txs of block withdrawn by a reorg again, as pending, if plugins need them.
+// Txs replaced by them are not brought back.
+func (m *mempoolWatcher) reorged(block *types.Block) {
+	if m == nil {
+		return
+	}
+
+	plugins, _ := m.watcher.pendingTxPlugins()
+	if len(plugins) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	var events []*structs.PendingTx
+
+	m.lock.Lock()
+	for _, tx := range block.Transactions() {
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil || !needPendingTx(plugins, tx, from) {
+			continue
+		}
+
+		key := senderNonce{from, tx.Nonce()}
+		if _, ok := m.bySender[key]; ok {
+			continue
+		}
+
+		m.tracked[tx.Hash()] = &trackedTx{tx: tx, from: from, lastSeen: now}
+		m.bySender[key] = tx.Hash()
+		m.nonces[key.nonce]++
+
+		events = append(events, &structs.PendingTx{Tx: tx, From: from, Status: structs.PendingTxPending})
+	}
+	m.lock.Unlock()
+
+	m.emit(events)
+}
+
+// sweep ends following txs missing from the mempool for DropAfter, as mined if they got a receipt, dropped otherwise
+func (m *mempoolWatcher) sweep() {
+	now := time.Now()
+
+	var stale []*trackedTx
+
+	m.lock.Lock()
+	for _, t := range m.tracked {
+		if now.Sub(t.lastSeen) >= m.options.DropAfter {
+			stale = append(stale, t)
+		}
+	}
+	m.lock.Unlock()
+
+	var events []*structs.PendingTx
+	for _, t := range stale {
+		event := &structs.PendingTx{Tx: t.tx, From: t.from, Status: structs.PendingTxDropped}
+
+		// mined into a block watcher doesn't sync block by block
+		receipt, err := m.watcher.rpc.GetTransactionReceipt(t.tx.Hash().Hex())
+		if err == nil && receipt != nil {
+			// told once the block is confirmed
+			if !m.watcher.confirmedUnderSynced(receipt.BlockNumber.Uint64()) {
+				continue
+			}
+
+			event.Status = structs.PendingTxMined
+			event.BlockNumber = receipt.BlockNumber.Uint64()
+		} else if !errors.Is(err, ethereum.NotFound) {
+			logrus.Warnf("fail to get receipt of pending tx %s: %v, check it later", t.tx.Hash().Hex(), err)
+			continue
+		}
+
+		m.lock.Lock()
+		// gone meanwhile
+		if m.tracked[t.tx.Hash()] == t {
+			m.untrack(t.tx.Hash())
+			events = append(events, event)
+		}
+		m.lock.Unlock()
+	}
+
+	m.emit(events)
+}
+
+// untrack stops following tx hash, caller holds the lock
+func (m *mempoolWatcher) untrack(hash common.Hash) *trackedTx {
+	t := m.tracked[hash]
+	key := senderNonce{t.from, t.tx.Nonce()}
+
+	delete(m.tracked, hash)
+	delete(m.bySender, key)
+
+	if m.nonces[key.nonce]--; m.nonces[key.nonce] <= 0 {
+		delete(m.nonces, key.nonce)
+	}
+
+	return t
+}
+
+// emit sends events to plugins needing their txs, they don't hold the checkpoint back
+func (m *mempoolWatcher) emit(events []*structs.PendingTx) {
+	if len(events) == 0 {
+		return
+	}
+
+	plugins, runners := m.watcher.pendingTxPlugins()
+
+	for _, event := range events {
+		event := event
+		d := &dispatch{left: 1}
+
+		for i := 0; i < len(plugins); i++ {
+			p := plugins[i]
+
+			if !needPendingTx(plugins[i:i+1], event.Tx, event.From) {
+				continue
+			}
+
+			m.watcher.runPlugin(runners[i], d, event, func(calls *pluginCalls) bool {
+				return m.watcher.acceptPendingTx(p, event, calls)
+			})
+		}
+
+		d.done(true)
+	}
+}
+
+// needPendingTx tells if any of plugins needs tx
+func needPendingTx(plugins []plugin.IPendingTxPlugin, tx *types.Transaction, from common.Address) bool {
+	for _, p := range plugins {
+		fp, ok := p.(plugin.IPendingTxFilterPlugin)
+		if !ok || fp.NeedPendingTx(tx, from) {
+			return true
+		}
+	}
+
+	return false
+}
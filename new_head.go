@@ -0,0 +1,110 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/rpc"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// newHeadNotifier wakes the sync loop up once rpc pushes a new head,
+// while the subscription is down it falls back to polling and resubscribes every poll.
+// A nil notifier just polls.
+type newHeadNotifier struct {
+	ctx        context.Context
+	subscriber rpc.IHeadSubscriber
+	headers    chan *types.Header
+	sub        ethereum.Subscription
+	failing    bool
+}
+
+// newNewHeadNotifier subscribes at once so no head is missed after it returns,
+// returns nil if rpcClient can't push heads at all
+func newNewHeadNotifier(ctx context.Context, rpcClient rpc.IBlockChainRPC) *newHeadNotifier {
+	subscriber, ok := rpcClient.(rpc.IHeadSubscriber)
+	if !ok {
+		logrus.Warnf("rpc %T can't subscribe to new heads, polling instead", rpcClient)
+		return nil
+	}
+
+	n := &newHeadNotifier{
+		ctx:        ctx,
+		subscriber: subscriber,
+		headers:    make(chan *types.Header, 16),
+	}
+
+	n.subscribe()
+
+	return n
+}
+
+func (n *newHeadNotifier) subscribe() {
+	sub, err := n.subscriber.SubscribeNewHead(n.ctx, n.headers)
+	if err != nil {
+		if !n.failing {
+			logrus.Warnf("subscribe to new heads err: %s, polling until subscribed again", err)
+		}
+
+		n.failing = true
+		return
+	}
+
+	if n.failing {
+		logrus.Info("subscribed to new heads again")
+	}
+
+	n.sub = sub
+	n.failing = false
+}
+
+// wait returns after a new head is pushed or interval passes, false if ctx is done
+func (n *newHeadNotifier) wait(ctx context.Context, interval time.Duration) bool {
+	var headers chan *types.Header
+	var subErr <-chan error
+
+	if n != nil && n.sub == nil {
+		n.subscribe()
+	}
+
+	if n != nil && n.sub != nil {
+		headers = n.headers
+		subErr = n.sub.Err()
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case header := <-headers:
+		logrus.Debugf("new head pushed: %d", header.Number)
+		n.drain()
+		return true
+	case err := <-subErr:
+		logrus.Warnf("new head subscription dropped: %v, polling until subscribed again", err)
+		n.sub.Unsubscribe()
+		n.sub = nil
+		n.failing = true
+		return true
+	case <-time.After(interval):
+		return true
+	}
+}
+
+// drain skips heads queued up during a sync round, the sync loop asks for the latest head anyway
+func (n *newHeadNotifier) drain() {
+	for {
+		select {
+		case <-n.headers:
+		default:
+			return
+		}
+	}
+}
+
+func (n *newHeadNotifier) close() {
+	if n != nil && n.sub != nil {
+		n.sub.Unsubscribe()
+		n.sub = nil
+	}
+}
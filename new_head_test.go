@@ -0,0 +1,93 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"testing"
+	"time"
+)
+
+func TestNewHeadNotifierFallsBackToPolling(t *testing.T) {
+	chain := fakechain.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := newNewHeadNotifier(ctx, chain)
+	defer n.close()
+
+	waitFor := func(interval time.Duration) time.Duration {
+		start := time.Now()
+		if !n.wait(ctx, interval) {
+			t.Fatal("wait returns false before ctx is done")
+		}
+
+		return time.Since(start)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		chain.AddBlock()
+	}()
+
+	if d := waitFor(time.Minute); d > 5*time.Second {
+		t.Fatalf("pushed head should wake up wait, waited %s", d)
+	}
+
+	chain.SetHeadSubscriptionError(errors.New("connection lost"))
+
+	// dropped subscription wakes up wait at once, then it polls
+	if d := waitFor(time.Minute); d > 5*time.Second {
+		t.Fatalf("dropped subscription should wake up wait, waited %s", d)
+	}
+
+	if d := waitFor(200 * time.Millisecond); d < 200*time.Millisecond {
+		t.Fatalf("expect polling interval while subscription is down, waited %s", d)
+	}
+
+	chain.SetHeadSubscriptionError(nil)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		chain.AddBlock()
+	}()
+
+	if d := waitFor(time.Minute); d > 5*time.Second {
+		t.Fatalf("resubscribed head should wake up wait, waited %s", d)
+	}
+
+	cancel()
+	if n.wait(ctx, time.Minute) {
+		t.Fatal("wait should return false once ctx is done")
+	}
+}
+
+func TestWatcherSyncsOnPushedHeads(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(60)
+	w.SetSubscribeNewHeads(true)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	// way before the 60 secs polling interval
+	expectBlock(t, blocks, chain.AddBlock(), false)
+	expectBlock(t, blocks, chain.AddBlock(), false)
+
+	waitWatcherExit(t, cancel, done)
+}
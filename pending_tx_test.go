@@ -0,0 +1,380 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var fakeSelector = [4]byte{0xa9, 0x05, 0x9c, 0xbb}
+
+func signedTx(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, gasPrice int64, to common.Address, data []byte) *types.Transaction {
+	t.Helper()
+
+	tx, err := types.SignTx(types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		To:       &to,
+		Value:    big.NewInt(0),
+		Gas:      21000,
+		GasPrice: big.NewInt(gasPrice),
+		Data:     data,
+	}), types.LatestSignerForChainID(big.NewInt(1)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func newSender(t *testing.T) (*ecdsa.PrivateKey, common.Address) {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func expectPendingTx(t *testing.T, events <-chan *structs.PendingTx, tx *types.Transaction, status structs.PendingTxStatus) *structs.PendingTx {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		if e.Tx.Hash() != tx.Hash() || e.Status != status {
+			t.Fatalf("expect tx %s %s, got tx %s %s", tx.Hash().Hex(), status, e.Tx.Hash().Hex(), e.Status)
+		}
+
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no tx %s %s", tx.Hash().Hex(), status)
+		return nil
+	}
+}
+
+func waitPendingTxSubscribed(t *testing.T, chain *fakechain.Chain) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for chain.PendingTxSubscribers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("watcher didn't subscribe pending txs")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hashOnlyChain pushes tx hashes only, like nodes without full pending tx subscription
+type hashOnlyChain struct {
+	*fakechain.Chain
+}
+
+func (c hashOnlyChain) SubscribeFullPendingTransactions(ctx context.Context, ch chan<- *rpc.MempoolTx) (ethereum.Subscription, error) {
+	return nil, errors.New("invalid params")
+}
+
+func TestPendingTxSubscribedTillMined(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client func(chain *fakechain.Chain) rpc.IBlockChainRPC
+	}{
+		{"full txs", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return chain }},
+		{"tx hashes", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return hashOnlyChain{chain} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			chain.AddBlock()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			w := NewEthWatcher(ctx, tc.client(chain))
+			w.SetSleepSecondsForNewBlock(1)
+			w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond})
+
+			events := make(chan *structs.PendingTx, 16)
+			w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{
+				To:        []common.Address{fakeContract},
+				Selectors: [][4]byte{fakeSelector},
+			}, func(tx *structs.PendingTx) {
+				events <- tx
+			}))
+
+			done := runFakeWatcher(t, w, 1)
+
+			waitPendingTxSubscribed(t, chain)
+
+			key, from := newSender(t)
+			other := signedTx(t, key, 0, 1, common.HexToAddress("0x1"), fakeSelector[:])
+			tx := signedTx(t, key, 1, 1, fakeContract, append(fakeSelector[:], 1))
+
+			chain.AddPendingTx(other, from)
+			chain.AddPendingTx(tx, from)
+
+			if e := expectPendingTx(t, events, tx, structs.PendingTxPending); e.From != from {
+				t.Fatalf("expect tx from %s, got %s", from.Hex(), e.From.Hex())
+			}
+
+			chain.AddBlock(fakechain.Tx{Raw: other}, fakechain.Tx{Raw: tx})
+
+			if e := expectPendingTx(t, events, tx, structs.PendingTxMined); e.BlockNumber != 2 {
+				t.Fatalf("expect tx mined in block 2, got %d", e.BlockNumber)
+			}
+
+			waitWatcherExit(t, cancel, done)
+
+			if len(events) != 0 {
+				t.Fatalf("expect no more event, got %d", len(events))
+			}
+		})
+	}
+}
+
+func TestPendingTxUnsubscribedWithoutPlugins(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond})
+
+	handle := w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	waitPendingTxSubscribed(t, chain)
+
+	handle.Unregister()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for chain.PendingTxSubscribers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending txs still subscribed without plugins")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// subscribed again for a new plugin
+	events := make(chan *structs.PendingTx, 16)
+	w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {
+		events <- tx
+	}))
+
+	waitPendingTxSubscribed(t, chain)
+
+	key, from := newSender(t)
+	tx := signedTx(t, key, 0, 1, fakeContract, nil)
+
+	chain.AddPendingTx(tx, from)
+	expectPendingTx(t, events, tx, structs.PendingTxPending)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestPendingTxPolledReplacedAndDropped(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	// blocks are synced well before txs missing from the mempool are dropped
+	w.SetSubscribeNewHeads(true)
+	w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond, DropAfter: 500 * time.Millisecond, Poll: true})
+
+	events := make(chan *structs.PendingTx, 16)
+	w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {
+		events <- tx
+	}))
+
+	key, from := newSender(t)
+	tx0 := signedTx(t, key, 0, 1, fakeContract, nil)
+	tx1 := signedTx(t, key, 1, 1, fakeContract, nil)
+
+	chain.AddPendingTx(tx0, from)
+	chain.AddPendingTx(tx1, from)
+
+	done := runFakeWatcher(t, w, 1)
+
+	expectPendingTx(t, events, tx0, structs.PendingTxPending)
+	expectPendingTx(t, events, tx1, structs.PendingTxPending)
+
+	// sped up in the mempool
+	speedUp := signedTx(t, key, 0, 2, fakeContract, nil)
+	chain.AddPendingTx(speedUp, from)
+
+	if e := expectPendingTx(t, events, tx0, structs.PendingTxReplaced); e.ReplacedBy.Hash() != speedUp.Hash() {
+		t.Fatalf("expect tx replaced by %s, got %s", speedUp.Hash().Hex(), e.ReplacedBy.Hash().Hex())
+	}
+
+	expectPendingTx(t, events, speedUp, structs.PendingTxPending)
+
+	// canceled by a tx never seen in the mempool
+	cancelTx := signedTx(t, key, 0, 3, from, nil)
+	chain.AddBlock(fakechain.Tx{Raw: cancelTx})
+
+	if e := expectPendingTx(t, events, speedUp, structs.PendingTxReplaced); e.ReplacedBy.Hash() != cancelTx.Hash() {
+		t.Fatalf("expect tx replaced by %s, got %s", cancelTx.Hash().Hex(), e.ReplacedBy.Hash().Hex())
+	}
+
+	chain.RemovePendingTx(tx1.Hash())
+	expectPendingTx(t, events, tx1, structs.PendingTxDropped)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestPendingTxMinedOnceConfirmed(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSubscribeNewHeads(true)
+	w.SetConfirmations(2)
+	w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond})
+
+	events := make(chan *structs.PendingTx, 16)
+	w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {
+		events <- tx
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	waitPendingTxSubscribed(t, chain)
+
+	key, from := newSender(t)
+	tx := signedTx(t, key, 0, 1, fakeContract, nil)
+
+	chain.AddPendingTx(tx, from)
+	expectPendingTx(t, events, tx, structs.PendingTxPending)
+
+	// mined into a block orphaned before it's confirmed
+	chain.AddBlock(fakechain.Tx{Raw: tx})
+	waitSyncedTo(t, w, 2)
+
+	chain.Reorg(1, []fakechain.Tx{}, []fakechain.Tx{{Raw: tx}})
+	chain.AddBlock()
+
+	if e := expectPendingTx(t, events, tx, structs.PendingTxMined); e.BlockNumber != 3 {
+		t.Fatalf("expect tx mined in block 3, got %d", e.BlockNumber)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(events) != 0 {
+		t.Fatalf("expect no more event, got %d", len(events))
+	}
+}
+
+func TestPendingTxPendingAgainOnReorg(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSubscribeNewHeads(true)
+	w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond})
+
+	events := make(chan *structs.PendingTx, 16)
+	w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {
+		events <- tx
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	waitPendingTxSubscribed(t, chain)
+
+	key, from := newSender(t)
+	tx := signedTx(t, key, 0, 1, fakeContract, nil)
+
+	chain.AddPendingTx(tx, from)
+	expectPendingTx(t, events, tx, structs.PendingTxPending)
+
+	chain.AddBlock(fakechain.Tx{Raw: tx})
+	if e := expectPendingTx(t, events, tx, structs.PendingTxMined); e.BlockNumber != 2 {
+		t.Fatalf("expect tx mined in block 2, got %d", e.BlockNumber)
+	}
+
+	// block 2 is orphaned, tx is mined again in block 3 of the new branch
+	chain.Reorg(1, []fakechain.Tx{}, []fakechain.Tx{{Raw: tx}})
+
+	if e := expectPendingTx(t, events, tx, structs.PendingTxPending); e.From != from {
+		t.Fatalf("expect tx from %s, got %s", from.Hex(), e.From.Hex())
+	}
+
+	if e := expectPendingTx(t, events, tx, structs.PendingTxMined); e.BlockNumber != 3 {
+		t.Fatalf("expect tx mined in block 3, got %d", e.BlockNumber)
+	}
+
+	waitWatcherExit(t, cancel, done)
+}
+
+// noMempoolRPC is a client that can't tell pending txs
+type noMempoolRPC struct {
+	rpc.IBlockChainRPC
+}
+
+func TestPendingTxThruFailoverRPC(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		poll bool
+	}{
+		{"subscribed", false},
+		{"polled", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			chain.AddBlock()
+
+			failover := rpc.NewFailoverRPCWithEndpoints(
+				rpc.FailoverEndpoint{Name: "no mempool", Client: noMempoolRPC{chain}},
+				rpc.FailoverEndpoint{Name: "mempool", Client: chain},
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			w := NewEthWatcher(ctx, failover)
+			w.SetSubscribeNewHeads(true)
+			w.SetMempoolOptions(MempoolOptions{PollInterval: 20 * time.Millisecond, Poll: tc.poll})
+
+			events := make(chan *structs.PendingTx, 16)
+			w.RegisterPendingTxPlugin(plugin.NewPendingTxPlugin(plugin.PendingTxFilter{}, func(tx *structs.PendingTx) {
+				events <- tx
+			}))
+
+			done := runFakeWatcher(t, w, 1)
+
+			if !tc.poll {
+				waitPendingTxSubscribed(t, chain)
+			}
+
+			key, from := newSender(t)
+			tx := signedTx(t, key, 0, 1, fakeContract, nil)
+
+			chain.AddPendingTx(tx, from)
+			expectPendingTx(t, events, tx, structs.PendingTxPending)
+
+			chain.AddBlock(fakechain.Tx{Raw: tx})
+			expectPendingTx(t, events, tx, structs.PendingTxMined)
+
+			waitWatcherExit(t, cancel, done)
+
+			for _, stat := range failover.EndpointStats() {
+				if stat.ErrorRate != 0 {
+					t.Fatalf("expect no endpoint failing, got %+v", stat)
+				}
+			}
+		})
+	}
+}
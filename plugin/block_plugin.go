@@ -40,3 +40,27 @@ func NewSimpleBlockPlugin(callback func(block *structs.RemovableBlock)) SimpleBl
 		callback: callback,
 	}
 }
+
+// IBlockErrPlugin is an IBlockPlugin telling if it failed to accept a block,
+// watcher handles the error by the DeliveryPolicy it's registered with
+type IBlockErrPlugin interface {
+	AcceptBlock(block *structs.RemovableBlock) error
+}
+
+type BlockErrPlugin struct {
+	callback func(block *structs.RemovableBlock) error
+}
+
+func (p BlockErrPlugin) AcceptBlock(b *structs.RemovableBlock) error {
+	if p.callback != nil {
+		return p.callback(b)
+	}
+
+	return nil
+}
+
+func NewBlockErrPlugin(callback func(block *structs.RemovableBlock) error) BlockErrPlugin {
+	return BlockErrPlugin{
+		callback: callback,
+	}
+}
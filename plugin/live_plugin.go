@@ -0,0 +1,7 @@
+package plugin
+
+// ILivePlugin is implemented by plugins of any kind wanting to know when watcher catches up with the head.
+// OnLive is called once, after the items of blocks up to blockNum, from then on watcher follows the head block by block.
+type ILivePlugin interface {
+	OnLive(blockNum uint64)
+}
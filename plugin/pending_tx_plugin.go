@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"bytes"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// IPendingTxPlugin gets txs entering the mempool, then whether each of them is mined, replaced or dropped
+type IPendingTxPlugin interface {
+	AcceptPendingTx(tx *structs.PendingTx)
+}
+
+// IPendingTxFilterPlugin only gets pending txs it needs, others are not followed for it
+type IPendingTxFilterPlugin interface {
+	IPendingTxPlugin
+	NeedPendingTx(tx *types.Transaction, from common.Address) bool
+}
+
+// PendingTxFilter matches txs from any of From, to any of To, calling any of Selectors, an empty field matches all
+type PendingTxFilter struct {
+	From      []common.Address
+	To        []common.Address
+	Selectors [][4]byte
+}
+
+func (f PendingTxFilter) Match(tx *types.Transaction, from common.Address) bool {
+	if len(f.From) > 0 && !containsAddress(f.From, from) {
+		return false
+	}
+
+	if len(f.To) > 0 && (tx.To() == nil || !containsAddress(f.To, *tx.To())) {
+		return false
+	}
+
+	if len(f.Selectors) > 0 {
+		data := tx.Data()
+		if len(data) < 4 {
+			return false
+		}
+
+		for _, selector := range f.Selectors {
+			if bytes.Equal(data[:4], selector[:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func containsAddress(addresses []common.Address, address common.Address) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PendingTxPlugin struct {
+	filter   PendingTxFilter
+	callback func(tx *structs.PendingTx)
+}
+
+func (p *PendingTxPlugin) AcceptPendingTx(tx *structs.PendingTx) {
+	if p.callback != nil {
+		p.callback(tx)
+	}
+}
+
+func (p *PendingTxPlugin) NeedPendingTx(tx *types.Transaction, from common.Address) bool {
+	return p.filter.Match(tx, from)
+}
+
+// NewPendingTxPlugin follows pending txs matching filter
+func NewPendingTxPlugin(filter PendingTxFilter, callback func(tx *structs.PendingTx)) *PendingTxPlugin {
+	return &PendingTxPlugin{
+		filter:   filter,
+		callback: callback,
+	}
+}
@@ -1,8 +1,9 @@
 package plugin
 
 import (
+	"ethereum-watcher/rpc"
 	"ethereum-watcher/structs"
-	"strings"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type IReceiptLogPlugin interface {
@@ -12,20 +13,83 @@ type IReceiptLogPlugin interface {
 	Accept(receiptLog *structs.RemovableReceiptLog)
 }
 
+// IReceiptLogFilterPlugin is an IReceiptLogPlugin on many or any contracts and all topic positions,
+// LogFilter is used to get logs instead of FromContract and InterestedTopics
+type IReceiptLogFilterPlugin interface {
+	IReceiptLogPlugin
+	LogFilter() rpc.LogFilter
+}
+
+// LogFilterOf returns the filter to get logs of p with,
+// FromContract and InterestedTopics at topic[0] if p is not an IReceiptLogFilterPlugin
+func LogFilterOf(p IReceiptLogPlugin) rpc.LogFilter {
+	if fp, ok := p.(IReceiptLogFilterPlugin); ok {
+		return fp.LogFilter()
+	}
+
+	return rpc.NewLogFilter(p.FromContract(), p.InterestedTopics())
+}
+
 type ReceiptLogPlugin struct {
 	contract string
 	topics   []string
-	callback func(receiptLog *structs.RemovableReceiptLog)
+	filter   rpc.LogFilter
+	// made by NewReceiptLogPlugin without topics
+	matchNone bool
+	callback  func(receiptLog *structs.RemovableReceiptLog)
 }
 
+// NewReceiptLogPlugin accepts logs of contract with any of topics at topic[0], empty contract for any contract.
+// Without topics it accepts no log, as it always did, any topic is only taken thru NewReceiptLogPluginWithFilter.
 func NewReceiptLogPlugin(
 	contract string,
 	topics []string,
 	callback func(receiptLog *structs.RemovableReceiptLog),
 ) *ReceiptLogPlugin {
+	return &ReceiptLogPlugin{
+		contract:  contract,
+		topics:    topics,
+		filter:    rpc.NewLogFilter(contract, topics),
+		matchNone: len(topics) == 0,
+		callback:  callback,
+	}
+}
+
+// NewReceiptLogPluginWithTopics accepts logs of contract matching the whole topic matrix,
+// e.g. {{Transfer}, nil, {deposit addresses...}} for transfers to any of the deposit addresses
+func NewReceiptLogPluginWithTopics(
+	contract string,
+	topics [][]common.Hash,
+	callback func(receiptLog *structs.RemovableReceiptLog),
+) *ReceiptLogPlugin {
+	filter := rpc.NewLogFilter(contract, nil)
+	filter.Topics = topics
+
+	return NewReceiptLogPluginWithFilter(filter, callback)
+}
+
+// NewReceiptLogPluginWithFilter accepts logs matching filter,
+// e.g. Transfer to any of the deposit addresses from any ERC20 contract
+func NewReceiptLogPluginWithFilter(
+	filter rpc.LogFilter,
+	callback func(receiptLog *structs.RemovableReceiptLog),
+) *ReceiptLogPlugin {
+	var contract string
+	if len(filter.Addresses) == 1 {
+		contract = filter.Addresses[0].String()
+	}
+
+	var topic0 []string
+	if len(filter.Topics) > 0 {
+		for _, t := range filter.Topics[0] {
+			topic0 = append(topic0, t.String())
+		}
+	}
+
 	return &ReceiptLogPlugin{
 		contract: contract,
-		topics:   topics,
+		topics:   topic0,
+		filter:   filter,
 		callback: callback,
 	}
 }
@@ -38,30 +102,51 @@ func (p *ReceiptLogPlugin) InterestedTopics() []string {
 	return p.topics
 }
 
+func (p *ReceiptLogPlugin) LogFilter() rpc.LogFilter {
+	return p.filter
+}
+
 func (p *ReceiptLogPlugin) Accept(receiptLog *structs.RemovableReceiptLog) {
 	if p.callback != nil {
 		p.callback(receiptLog)
 	}
 }
 
-// NeedReceiptLog simplified version of specifying topic filters
+// NeedReceiptLog matches the contracts and topic matrix like a node does
 // https://github.com/ethereum/wiki/wiki/JSON-RPC#a-note-on-specifying-topic-filters
 func (p *ReceiptLogPlugin) NeedReceiptLog(receiptLog *structs.RemovableReceiptLog) bool {
-	contract := receiptLog.Log.Address.String()
-	if strings.ToLower(p.contract) != strings.ToLower(contract) {
-		return false
-	}
+	return !p.matchNone && p.filter.Match(receiptLog.Log)
+}
+
+// IReceiptLogErrPlugin is an IReceiptLogPlugin telling if it failed to accept a log
+type IReceiptLogErrPlugin interface {
+	FromContract() string
+	InterestedTopics() []string
+	NeedReceiptLog(receiptLog *structs.RemovableReceiptLog) bool
+	Accept(receiptLog *structs.RemovableReceiptLog) error
+}
 
-	var firstTopic string
-	if len(receiptLog.Log.Topics) > 0 {
-		firstTopic = receiptLog.Log.Topics[0].String()
+// ReceiptLogErrPlugin picks logs out like ReceiptLogPlugin, callback's error is returned by Accept
+type ReceiptLogErrPlugin struct {
+	*ReceiptLogPlugin
+	callback func(receiptLog *structs.RemovableReceiptLog) error
+}
+
+// NewReceiptLogErrPlugin accepts logs matching filter, see NewReceiptLogPluginWithFilter
+func NewReceiptLogErrPlugin(
+	filter rpc.LogFilter,
+	callback func(receiptLog *structs.RemovableReceiptLog) error,
+) *ReceiptLogErrPlugin {
+	return &ReceiptLogErrPlugin{
+		ReceiptLogPlugin: NewReceiptLogPluginWithFilter(filter, nil),
+		callback:         callback,
 	}
+}
 
-	for _, interestedTopic := range p.topics {
-		if strings.ToLower(firstTopic) == strings.ToLower(interestedTopic) {
-			return true
-		}
+func (p *ReceiptLogErrPlugin) Accept(receiptLog *structs.RemovableReceiptLog) error {
+	if p.callback != nil {
+		return p.callback(receiptLog)
 	}
 
-	return false
+	return nil
 }
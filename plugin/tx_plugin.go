@@ -39,3 +39,26 @@ func NewTxPlugin(callback func(tx structs.RemovableTx)) TxPlugin {
 		callback: callback,
 	}
 }
+
+// ITxErrPlugin is an ITxPlugin telling if it failed to accept a tx
+type ITxErrPlugin interface {
+	AcceptTx(transaction structs.RemovableTx) error
+}
+
+type TxErrPlugin struct {
+	callback func(tx structs.RemovableTx) error
+}
+
+func (p TxErrPlugin) AcceptTx(transaction structs.RemovableTx) error {
+	if p.callback != nil {
+		return p.callback(transaction)
+	}
+
+	return nil
+}
+
+func NewTxErrPlugin(callback func(tx structs.RemovableTx) error) TxErrPlugin {
+	return TxErrPlugin{
+		callback: callback,
+	}
+}
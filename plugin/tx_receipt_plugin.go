@@ -11,6 +11,12 @@ type ITxReceiptPlugin interface {
 	Accept(tx *structs.RemovableTxAndReceipt)
 }
 
+// ITxReceiptFilterPlugin only gets receipts of txs it needs, others are not fetched for it
+type ITxReceiptFilterPlugin interface {
+	ITxReceiptPlugin
+	NeedReceipt(tx *types.Transaction) bool
+}
+
 type TxReceiptPluginWithFilter struct {
 	ITxReceiptPlugin
 	filterFunc func(transaction *types.Transaction) bool
@@ -42,6 +48,36 @@ func (p TxReceiptPlugin) Accept(tx *structs.RemovableTxAndReceipt) {
 	}
 }
 
+// ITxReceiptErrPlugin is an ITxReceiptPlugin telling if it failed to accept a receipt
+type ITxReceiptErrPlugin interface {
+	Accept(tx *structs.RemovableTxAndReceipt) error
+}
+
+type TxReceiptErrPlugin struct {
+	callback   func(tx *structs.RemovableTxAndReceipt) error
+	filterFunc func(transaction *types.Transaction) bool
+}
+
+// NewTxReceiptErrPlugin gets receipts of txs filterFunc returns true for, nil filterFunc for all txs
+func NewTxReceiptErrPlugin(
+	callback func(tx *structs.RemovableTxAndReceipt) error,
+	filterFunc func(transaction *types.Transaction) bool) *TxReceiptErrPlugin {
+
+	return &TxReceiptErrPlugin{callback, filterFunc}
+}
+
+func (p *TxReceiptErrPlugin) NeedReceipt(tx *types.Transaction) bool {
+	return p.filterFunc == nil || p.filterFunc(tx)
+}
+
+func (p *TxReceiptErrPlugin) Accept(tx *structs.RemovableTxAndReceipt) error {
+	if p.callback != nil {
+		return p.callback(tx)
+	}
+
+	return nil
+}
+
 type ERC20TransferPlugin struct {
 	callback func(tokenAddress, from, to string, amount decimal.Decimal, isRemoved bool)
 }
@@ -0,0 +1,412 @@
+package ethereum_watcher
+
+import (
+	"container/list"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// PluginHandle is returned by Register*Plugin to remove the plugin later
+type PluginHandle struct {
+	watcher    *AbstractWatcher
+	runner     *pluginRunner
+	unregister func()
+	once       sync.Once
+}
+
+// Unregister removes the plugin, safe to call while watcher runs and more than once.
+// Items queued for the plugin are dropped, the one being accepted at the moment still reaches it.
+func (h *PluginHandle) Unregister() {
+	h.once.Do(func() {
+		h.watcher.pluginsLock.Lock()
+		h.unregister()
+		h.watcher.pluginsLock.Unlock()
+
+		h.runner.close(true)
+	})
+}
+
+func (watcher *AbstractWatcher) newPluginHandle(runner *pluginRunner, unregister func()) *PluginHandle {
+	return &PluginHandle{watcher: watcher, runner: runner, unregister: unregister}
+}
+
+// plugins are copied on write, so the slices returned are safe to range over without the lock
+
+func (watcher *AbstractWatcher) blockPlugins() ([]plugin.IBlockPlugin, []*pluginRunner) {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	return watcher.BlockPlugins, alignRunners(watcher.blockPluginRunners, len(watcher.BlockPlugins))
+}
+
+func (watcher *AbstractWatcher) txPlugins() ([]plugin.ITxPlugin, []*pluginRunner) {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	return watcher.TxPlugins, alignRunners(watcher.txPluginRunners, len(watcher.TxPlugins))
+}
+
+func (watcher *AbstractWatcher) txReceiptPlugins() ([]plugin.ITxReceiptPlugin, []*pluginRunner) {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	return watcher.TxReceiptPlugins, alignRunners(watcher.txReceiptPluginRunners, len(watcher.TxReceiptPlugins))
+}
+
+func (watcher *AbstractWatcher) receiptLogPlugins() ([]plugin.IReceiptLogPlugin, []*pluginRunner) {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	return watcher.ReceiptLogPlugins, alignRunners(watcher.receiptLogPluginRunners, len(watcher.ReceiptLogPlugins))
+}
+
+func (watcher *AbstractWatcher) pendingTxPlugins() ([]plugin.IPendingTxPlugin, []*pluginRunner) {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	return watcher.PendingTxPlugins, alignRunners(watcher.pendingTxPluginRunners, len(watcher.PendingTxPlugins))
+}
+
+// pluginRunners returns runners of all plugins, including ones waiting for backfill
+func (watcher *AbstractWatcher) pluginRunners() []*pluginRunner {
+	watcher.pluginsLock.RLock()
+	defer watcher.pluginsLock.RUnlock()
+
+	var runners []*pluginRunner
+	for _, registered := range [][]*pluginRunner{
+		watcher.blockPluginRunners, watcher.txPluginRunners, watcher.txReceiptPluginRunners, watcher.receiptLogPluginRunners,
+		watcher.pendingTxPluginRunners,
+	} {
+		for _, r := range registered {
+			if r != nil {
+				runners = append(runners, r)
+			}
+		}
+	}
+
+	for _, backfill := range watcher.pendingBackfills {
+		runners = append(runners, backfill.runner)
+	}
+
+	return runners
+}
+
+// RegisterBlockPlugin adds p, safe to call while watcher runs, p gets blocks dispatched from then on
+func (watcher *AbstractWatcher) RegisterBlockPlugin(p plugin.IBlockPlugin) *PluginHandle {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	runner := watcher.newPluginRunner()
+
+	n := len(watcher.BlockPlugins)
+	watcher.BlockPlugins = append(watcher.BlockPlugins[:n:n], p)
+	watcher.blockPluginRunners = append(alignRunners(watcher.blockPluginRunners, n), runner)
+
+	return watcher.newPluginHandle(runner, func() {
+		if i := indexOfRunner(watcher.blockPluginRunners, runner); i >= 0 {
+			watcher.BlockPlugins = append(watcher.BlockPlugins[:i:i], watcher.BlockPlugins[i+1:]...)
+			watcher.blockPluginRunners = append(watcher.blockPluginRunners[:i:i], watcher.blockPluginRunners[i+1:]...)
+		}
+	})
+}
+
+// RegisterTxPlugin adds p, safe to call while watcher runs, p gets txs of blocks dispatched from then on
+func (watcher *AbstractWatcher) RegisterTxPlugin(p plugin.ITxPlugin) *PluginHandle {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	runner := watcher.newPluginRunner()
+
+	n := len(watcher.TxPlugins)
+	watcher.TxPlugins = append(watcher.TxPlugins[:n:n], p)
+	watcher.txPluginRunners = append(alignRunners(watcher.txPluginRunners, n), runner)
+
+	return watcher.newPluginHandle(runner, func() {
+		if i := indexOfRunner(watcher.txPluginRunners, runner); i >= 0 {
+			watcher.TxPlugins = append(watcher.TxPlugins[:i:i], watcher.TxPlugins[i+1:]...)
+			watcher.txPluginRunners = append(watcher.txPluginRunners[:i:i], watcher.txPluginRunners[i+1:]...)
+		}
+	})
+}
+
+// RegisterTxReceiptPlugin adds p, safe to call while watcher runs, p gets receipts dispatched from then on
+func (watcher *AbstractWatcher) RegisterTxReceiptPlugin(p plugin.ITxReceiptPlugin) *PluginHandle {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	runner := watcher.newPluginRunner()
+
+	n := len(watcher.TxReceiptPlugins)
+	watcher.TxReceiptPlugins = append(watcher.TxReceiptPlugins[:n:n], p)
+	watcher.txReceiptPluginRunners = append(alignRunners(watcher.txReceiptPluginRunners, n), runner)
+
+	return watcher.newPluginHandle(runner, func() {
+		if i := indexOfRunner(watcher.txReceiptPluginRunners, runner); i >= 0 {
+			watcher.TxReceiptPlugins = append(watcher.TxReceiptPlugins[:i:i], watcher.TxReceiptPlugins[i+1:]...)
+			watcher.txReceiptPluginRunners = append(watcher.txReceiptPluginRunners[:i:i], watcher.txReceiptPluginRunners[i+1:]...)
+		}
+	})
+}
+
+// RegisterReceiptLogPlugin adds p, safe to call while watcher runs, p gets logs dispatched from then on
+func (watcher *AbstractWatcher) RegisterReceiptLogPlugin(p plugin.IReceiptLogPlugin) *PluginHandle {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	runner := watcher.newPluginRunner()
+	watcher.addReceiptLogPlugin(p, runner)
+
+	return watcher.newPluginHandle(runner, func() {
+		watcher.removeReceiptLogPlugin(runner)
+	})
+}
+
+// RegisterPendingTxPlugin adds p, safe to call while watcher runs, p gets txs entering the mempool from then on,
+// see SetMempoolOptions
+func (watcher *AbstractWatcher) RegisterPendingTxPlugin(p plugin.IPendingTxPlugin) *PluginHandle {
+	if !canTellPendingTxs(watcher.rpc) {
+		logrus.Warnln("rpc can't tell pending txs, pending tx plugin gets none")
+	}
+
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	runner := watcher.newPluginRunner()
+
+	n := len(watcher.PendingTxPlugins)
+	watcher.PendingTxPlugins = append(watcher.PendingTxPlugins[:n:n], p)
+	watcher.pendingTxPluginRunners = append(alignRunners(watcher.pendingTxPluginRunners, n), runner)
+
+	return watcher.newPluginHandle(runner, func() {
+		if i := indexOfRunner(watcher.pendingTxPluginRunners, runner); i >= 0 {
+			watcher.PendingTxPlugins = append(watcher.PendingTxPlugins[:i:i], watcher.PendingTxPlugins[i+1:]...)
+			watcher.pendingTxPluginRunners = append(watcher.pendingTxPluginRunners[:i:i], watcher.pendingTxPluginRunners[i+1:]...)
+		}
+	})
+}
+
+// alignRunners returns a copy of runners of the first n plugins,
+// nil for plugins put into the exported slices directly, they are run by the dispatcher itself
+func alignRunners(runners []*pluginRunner, n int) []*pluginRunner {
+	aligned := make([]*pluginRunner, n, n+1)
+	copy(aligned, runners)
+
+	return aligned
+}
+
+func indexOfRunner(runners []*pluginRunner, runner *pluginRunner) int {
+	for i, r := range runners {
+		if r == runner {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// logBackfill is a log plugin waiting for its logs since block from
+type logBackfill struct {
+	runner *pluginRunner
+	plugin plugin.IReceiptLogPlugin
+	from   uint64
+}
+
+// RegisterReceiptLogPluginWithBackfill adds p with its logs since block fromBlockNum,
+// past logs are delivered first, then the live ones, in order and each once.
+// The backfill runs in the sync loop before the next block, p gets nothing till it's done.
+func (watcher *AbstractWatcher) RegisterReceiptLogPluginWithBackfill(p plugin.IReceiptLogPlugin, fromBlockNum uint64) *PluginHandle {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	backfill := &logBackfill{runner: watcher.newPluginRunner(), plugin: p, from: fromBlockNum}
+	watcher.pendingBackfills = append(watcher.pendingBackfills, backfill)
+
+	return watcher.newPluginHandle(backfill.runner, func() {
+		for i, pending := range watcher.pendingBackfills {
+			if pending == backfill {
+				watcher.pendingBackfills = append(watcher.pendingBackfills[:i:i], watcher.pendingBackfills[i+1:]...)
+				return
+			}
+		}
+
+		watcher.removeReceiptLogPlugin(backfill.runner)
+	})
+}
+
+// addReceiptLogPlugin and removeReceiptLogPlugin are called with pluginsLock held
+func (watcher *AbstractWatcher) addReceiptLogPlugin(p plugin.IReceiptLogPlugin, runner *pluginRunner) {
+	n := len(watcher.ReceiptLogPlugins)
+	watcher.ReceiptLogPlugins = append(watcher.ReceiptLogPlugins[:n:n], p)
+	watcher.receiptLogPluginRunners = append(alignRunners(watcher.receiptLogPluginRunners, n), runner)
+}
+
+func (watcher *AbstractWatcher) removeReceiptLogPlugin(runner *pluginRunner) {
+	if i := indexOfRunner(watcher.receiptLogPluginRunners, runner); i >= 0 {
+		watcher.ReceiptLogPlugins = append(watcher.ReceiptLogPlugins[:i:i], watcher.ReceiptLogPlugins[i+1:]...)
+		watcher.receiptLogPluginRunners = append(watcher.receiptLogPluginRunners[:i:i], watcher.receiptLogPluginRunners[i+1:]...)
+	}
+}
+
+// runBackfills delivers past logs of plugins registered with backfill and makes them live,
+// nextBlockNum is the block to sync next if nothing is synced yet
+func (watcher *AbstractWatcher) runBackfills(nextBlockNum uint64) error {
+	watcher.pluginsLock.RLock()
+	pending := len(watcher.pendingBackfills)
+	watcher.pluginsLock.RUnlock()
+
+	if pending == 0 {
+		return nil
+	}
+
+	// logs are fetched up to here, later ones are fetched with the new plugins on board.
+	// Nothing is fetched yet if the sync starts at block 0.
+	fetchedTill, fetched := nextBlockNum-1, nextBlockNum > 0
+	if back := watcher.SyncedBlocks.Back(); back != nil {
+		fetchedTill, fetched = back.Value.(*types.Block).NumberU64(), true
+	}
+
+	if watcher.ReceiptCatchUpFromBlock != 0 {
+		fetchedTill, fetched = watcher.ReceiptCatchUpFromBlock-1, true
+	}
+
+	// logs sent before go to plugins registered before only,
+	// no more is sent meanwhile as runBackfills is called by the sync loop
+	watcher.itemsInFlight.Wait()
+
+	for {
+		watcher.pluginsLock.Lock()
+		if len(watcher.pendingBackfills) == 0 {
+			watcher.pluginsLock.Unlock()
+			return nil
+		}
+
+		backfill := watcher.pendingBackfills[0]
+		watcher.pluginsLock.Unlock()
+
+		if fetched {
+			if err := watcher.backfill(backfill, fetchedTill); err != nil {
+				return err
+			}
+		}
+
+		watcher.pluginsLock.Lock()
+		// unless unregistered while backfilling
+		if len(watcher.pendingBackfills) > 0 && watcher.pendingBackfills[0] == backfill {
+			watcher.pendingBackfills = watcher.pendingBackfills[1:]
+			watcher.addReceiptLogPlugin(backfill.plugin, backfill.runner)
+		}
+		watcher.pluginsLock.Unlock()
+	}
+}
+
+// insertLogInOrder keeps logs in block and index order, logs of synced blocks are trimmed from the front
+func insertLogInOrder(logs *list.List, l *types.Log) {
+	for e := logs.Back(); e != nil; e = e.Prev() {
+		prev := e.Value.(*types.Log)
+		if prev.BlockNumber < l.BlockNumber || prev.BlockNumber == l.BlockNumber && prev.Index < l.Index {
+			logs.InsertAfter(l, e)
+			return
+		}
+	}
+
+	logs.PushFront(l)
+}
+
+// backfill delivers logs of b.plugin from b.from up to block till
+func (watcher *AbstractWatcher) backfill(b *logBackfill, till uint64) error {
+	logrus.Infof("backfill receipt logs of block %d - %d", b.from, till)
+
+	type logKey struct {
+		block common.Hash
+		index uint
+	}
+
+	watcher.lock.RLock()
+
+	// logs of synced blocks are kept for withdrawing them on reorg
+	kept := make(map[logKey]bool, watcher.SyncedReceiptLogs.Len())
+	for e := watcher.SyncedReceiptLogs.Front(); e != nil; e = e.Next() {
+		l := e.Value.(*types.Log)
+		kept[logKey{l.BlockHash, l.Index}] = true
+	}
+
+	var firstSynced uint64
+	if front := watcher.SyncedBlocks.Front(); front != nil {
+		firstSynced = front.Value.(*types.Block).NumberU64()
+	}
+
+	watcher.lock.RUnlock()
+
+	filter := plugin.LogFilterOf(b.plugin)
+
+	for from := b.from; from <= till; {
+		to := from + uint64(watcher.logStep.size()) - 1
+		if to > till {
+			to = till
+		}
+
+		logs, span, err := rpc.GetLogsSplitting(watcher.rpc, from, to, filter)
+		if err != nil {
+			return err
+		}
+
+		watcher.logStep.fetched(int(to-from+1), int(span))
+
+		// plugin is called without the lock, it may ask watcher for progress
+		var deliver []*structs.RemovableReceiptLog
+
+		watcher.lock.Lock()
+
+		for _, l := range logs {
+			receiptLog := &structs.RemovableReceiptLog{Log: l}
+			if !b.plugin.NeedReceiptLog(receiptLog) {
+				continue
+			}
+
+			key := logKey{l.BlockHash, l.Index}
+
+			if firstSynced != 0 && l.BlockNumber >= firstSynced && !kept[key] {
+				insertLogInOrder(watcher.SyncedReceiptLogs, l)
+				kept[key] = true
+			}
+
+			// block still waiting for confirmations, the log goes out with it
+			if entry := watcher.heldBlock(l.BlockNumber); entry != nil {
+				if !entry.holdsLog(key.block, key.index) {
+					entry.receiptLogs = append(entry.receiptLogs, receiptLog)
+				}
+
+				continue
+			}
+
+			deliver = append(deliver, receiptLog)
+		}
+
+		watcher.lock.Unlock()
+
+		// queued ahead of live logs, which come after the plugin is added
+		for _, receiptLog := range deliver {
+			receiptLog := receiptLog
+
+			watcher.deliveries.sent(receiptLog.Log.BlockNumber)
+			d := watcher.newDispatch(receiptLog.Log.BlockNumber)
+			watcher.runPlugin(b.runner, d, receiptLog, func(calls *pluginCalls) bool {
+				return watcher.acceptReceiptLog(b.plugin, receiptLog, calls)
+			})
+			d.done(true)
+		}
+
+		if to == till {
+			break
+		}
+
+		from = to + 1
+	}
+
+	return nil
+}
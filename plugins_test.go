@@ -0,0 +1,226 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitSyncedTo(t *testing.T, w *AbstractWatcher, num uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.LatestSyncedBlockNum() < num {
+		if time.Now().After(deadline) {
+			t.Fatalf("watcher didn't sync to block %d", num)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitDispatched waits till plugins are given all items synced
+func waitDispatched(t *testing.T, w *AbstractWatcher) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.deliveries.firstPending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("items not dispatched to plugins")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterAndUnregisterPluginsWhileRunning(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	done := runFakeWatcher(t, w, 1)
+
+	// plugins come and go while blocks are synced
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				h := w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {}))
+				l := w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+					func(l *structs.RemovableReceiptLog) {},
+				))
+
+				time.Sleep(time.Millisecond)
+
+				h.Unregister()
+				l.Unregister()
+				l.Unregister()
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		chain.AddBlock(fakeTransferTx())
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	wg.Wait()
+
+	blockPlugins, _ := w.blockPlugins()
+	receiptLogPlugins, _ := w.receiptLogPlugins()
+	if n := len(blockPlugins) + len(receiptLogPlugins); n != 0 {
+		t.Fatalf("expect all plugins unregistered, %d left", n)
+	}
+
+	waitSyncedTo(t, w, 11)
+	waitDispatched(t, w)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	h := w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	chain.AddBlock()
+	expectBlock(t, blocks, chain.Block(12), false)
+
+	h.Unregister()
+	chain.AddBlock()
+	waitSyncedTo(t, w, 13)
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(blocks) != 0 {
+		t.Fatalf("expect no block after Unregister, got %d", len(blocks))
+	}
+}
+
+func TestReceiptLogPluginBackfill(t *testing.T) {
+	for _, confirmations := range []uint64{0, 3} {
+		t.Run(fmt.Sprintf("confirmations %d", confirmations), func(t *testing.T) {
+			chain := fakechain.New()
+			for i := 0; i < 10; i++ {
+				chain.AddBlock(fakeTransferTx())
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			w := NewEthWatcher(ctx, chain)
+			w.SetSleepSecondsForNewBlock(1)
+			w.SetConfirmations(confirmations)
+
+			live := make(chan *structs.RemovableReceiptLog, 64)
+			w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+				func(l *structs.RemovableReceiptLog) {
+					live <- l
+				},
+			))
+
+			done := runFakeWatcher(t, w, 5)
+			waitSyncedTo(t, w, 10)
+
+			backfilled := make(chan *structs.RemovableReceiptLog, 64)
+			w.RegisterReceiptLogPluginWithBackfill(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+				func(l *structs.RemovableReceiptLog) {
+					backfilled <- l
+				},
+			), 2)
+
+			chain.AddBlock(fakeTransferTx())
+			chain.AddBlocks(int(confirmations))
+
+			for num := uint64(2); num <= 11; num++ {
+				select {
+				case l := <-backfilled:
+					if l.Log.BlockNumber != num || l.IsRemoved {
+						t.Fatalf("expect log of block %d, got %d(removed: %t)", num, l.Log.BlockNumber, l.IsRemoved)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no log of block %d", num)
+				}
+			}
+
+			waitSyncedTo(t, w, 11+confirmations)
+			waitWatcherExit(t, cancel, done)
+
+			if len(backfilled) != 0 {
+				t.Fatalf("expect each log once, got %d more", len(backfilled))
+			}
+
+			if len(live) != 7 {
+				t.Fatalf("expect live plugin to get logs of block 5 - 11 only, got %d", len(live))
+			}
+		})
+	}
+}
+
+func TestBackfilledLogsKeptInBlockOrder(t *testing.T) {
+	otherContract := common.HexToAddress("0x2")
+
+	chain := fakechain.New()
+	for i := 0; i < 6; i++ {
+		chain.AddBlock(fakeTransferTx(), fakechain.Tx{
+			To:   otherContract,
+			Logs: []*types.Log{{Address: otherContract, Topics: []common.Hash{fakeTopic}}},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {},
+	))
+
+	done := runFakeWatcher(t, w, 1)
+	waitSyncedTo(t, w, 6)
+
+	backfilled := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPluginWithBackfill(plugin.NewReceiptLogPlugin(otherContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			backfilled <- l
+		},
+	), 1)
+
+	for num := uint64(1); num <= 6; num++ {
+		select {
+		case l := <-backfilled:
+			if l.Log.BlockNumber != num {
+				t.Fatalf("expect log of block %d, got %d", num, l.Log.BlockNumber)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no log of block %d", num)
+		}
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	// logs of both plugins, interleaved by block
+	var prev *types.Log
+	n := 0
+	for e := w.SyncedReceiptLogs.Front(); e != nil; e = e.Next() {
+		l := e.Value.(*types.Log)
+		if prev != nil && (prev.BlockNumber > l.BlockNumber || prev.BlockNumber == l.BlockNumber && prev.Index >= l.Index) {
+			t.Fatalf("log %d of block %d kept after log %d of block %d", l.Index, l.BlockNumber, prev.Index, prev.BlockNumber)
+		}
+
+		prev = l
+		n++
+	}
+
+	if n != 12 {
+		t.Fatalf("expect 12 logs kept, got %d", n)
+	}
+}
@@ -0,0 +1,156 @@
+package ethereum_watcher
+
+import (
+	"ethereum-watcher/rpc"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+// how many blocks each prefetch worker may run ahead of the sync loop
+const prefetchBlocksPerWorker = 2
+
+// prefetchedBlock is a block fetched ahead with receipts of the txs watcher needs,
+// receipts is nil if they couldn't be fetched along, the sync loop fetches them again then
+type prefetchedBlock struct {
+	done     chan struct{}
+	block    *types.Block
+	receipts map[common.Hash]*types.Receipt
+	err      error
+}
+
+// blockPrefetcher fetches blocks ahead of the sync loop with a bounded number of workers,
+// while the sync loop still takes them one by one in order and checks their parents as usual.
+// Only used from the sync loop.
+type blockPrefetcher struct {
+	watcher *AbstractWatcher
+	workers chan struct{}
+	window  uint64
+
+	pending map[uint64]*prefetchedBlock
+	// block the sync loop is expected to ask for next, anything else drops what's prefetched
+	next uint64
+}
+
+// SetCatchUpPrefetch makes watcher fetch blocks and receipts ahead with n workers while catching up,
+// up to 2n blocks ahead of the block being synced, 0 fetches one block at a time
+func (watcher *AbstractWatcher) SetCatchUpPrefetch(n int) {
+	if n <= 0 {
+		watcher.prefetcher = nil
+		return
+	}
+
+	watcher.prefetcher = &blockPrefetcher{
+		watcher: watcher,
+		workers: make(chan struct{}, n),
+		window:  uint64(n * prefetchBlocksPerWorker),
+		pending: make(map[uint64]*prefetchedBlock),
+	}
+}
+
+// fetchBlock returns block num, prefetching blocks after it up to head
+func (watcher *AbstractWatcher) fetchBlock(num, head uint64) (*prefetchedBlock, error) {
+	var fetched *prefetchedBlock
+	if watcher.prefetcher == nil {
+		fetched = &prefetchedBlock{}
+		fetched.block, fetched.err = watcher.rpc.GetBlockByNum(num)
+	} else {
+		fetched = watcher.prefetcher.get(num, head)
+	}
+
+	if fetched.err != nil {
+		return nil, fetched.err
+	}
+
+	if fetched.block == nil {
+		return nil, fmt.Errorf("GetBlockByNum(%d) returns nil block: %w", num, ethereum.NotFound)
+	}
+
+	return fetched, nil
+}
+
+func (p *blockPrefetcher) get(num, head uint64) *prefetchedBlock {
+	if num != p.next && len(p.pending) > 0 {
+		// fork or rewind, blocks fetched ahead may be on the old branch
+		logrus.Debugf("prefetch expects block %d but %d asked, dropping %d prefetched blocks", p.next, num, len(p.pending))
+		p.pending = make(map[uint64]*prefetchedBlock)
+	}
+
+	last := num + p.window - 1
+	if last > head {
+		last = head
+	}
+
+	for n := num; n <= last; n++ {
+		if _, ok := p.pending[n]; !ok {
+			p.pending[n] = p.prefetch(n)
+		}
+	}
+
+	fetched, ok := p.pending[num]
+	if !ok {
+		// num above head, fetch it anyway like the sync loop would
+		fetched = p.prefetch(num)
+	}
+
+	delete(p.pending, num)
+	p.next = num + 1
+
+	<-fetched.done
+
+	return fetched
+}
+
+func (p *blockPrefetcher) prefetch(num uint64) *prefetchedBlock {
+	fetched := &prefetchedBlock{done: make(chan struct{})}
+
+	go func() {
+		defer close(fetched.done)
+
+		p.workers <- struct{}{}
+		defer func() { <-p.workers }()
+
+		fetched.block, fetched.err = p.watcher.rpc.GetBlockByNum(num)
+		if fetched.err != nil || fetched.block == nil {
+			return
+		}
+
+		fetched.receipts = p.watcher.prefetchReceipts(fetched.block)
+	}()
+
+	return fetched
+}
+
+// prefetchReceipts fetches receipts of txs in block watcher needs, nil on any failure
+func (watcher *AbstractWatcher) prefetchReceipts(block *types.Block) map[common.Hash]*types.Receipt {
+	var txHashes []string
+	for _, tx := range block.Transactions() {
+		if watcher.needReceipt(tx) {
+			txHashes = append(txHashes, tx.Hash().String())
+		}
+	}
+
+	receipts := make(map[common.Hash]*types.Receipt, len(txHashes))
+	if len(txHashes) == 0 {
+		return receipts
+	}
+
+	fetched, err := rpc.GetTransactionReceiptsInBlockContext(watcher.Ctx, watcher.rpc, block.Hash().String(), txHashes)
+	if err != nil {
+		logrus.Debugf("prefetch receipts of block %d err: %s", block.NumberU64(), err)
+		return nil
+	}
+
+	for _, receipt := range fetched {
+		// receipts by tx hash may come from another branch
+		if receipt.BlockHash != block.Hash() {
+			return nil
+		}
+
+		receipts[receipt.TxHash] = receipt
+	}
+
+	return receipts
+}
@@ -0,0 +1,86 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowRPC makes GetBlockByNum take a while and records how many run at once
+type slowRPC struct {
+	*fakechain.Chain
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (s *slowRPC) GetBlockByNum(num uint64) (*types.Block, error) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	return s.Chain.GetBlockByNum(num)
+}
+
+func TestCatchUpPrefetchKeepsOrder(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 100; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	slow := &slowRPC{Chain: chain}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, slow)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCatchUpPrefetch(4)
+
+	blocks := make(chan *structs.RemovableBlock, 256)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	receipts := make(chan *structs.RemovableTxAndReceipt, 256)
+	w.RegisterTxReceiptPlugin(plugin.NewTxReceiptPlugin(func(r *structs.RemovableTxAndReceipt) {
+		receipts <- r
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 100; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	// once caught up, a reorg makes the sync loop go back to a block fetched before
+	orphaned := chain.Block(100)
+	chain.Reorg(1, nil, nil)
+
+	expectBlock(t, blocks, orphaned, true)
+	expectBlock(t, blocks, chain.Block(100), false)
+	expectBlock(t, blocks, chain.Block(101), false)
+
+	waitWatcherExit(t, cancel, done)
+
+	for i := uint64(1); i < 100; i++ {
+		r := <-receipts
+		if r.Receipt.TxHash != chain.Block(i).Transactions()[0].Hash() {
+			t.Fatalf("receipt %d out of order: %+v", i, r.Receipt)
+		}
+	}
+
+	if max := atomic.LoadInt32(&slow.maxInFlight); max > 4 || max < 2 {
+		t.Fatalf("expect 2 to 4 blocks fetched at once, got %d", max)
+	}
+}
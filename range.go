@@ -0,0 +1,105 @@
+package ethereum_watcher
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/core/types"
+	"time"
+)
+
+// RangeSummary is what RunRange went thru
+type RangeSummary struct {
+	From uint64
+	To   uint64
+
+	// Blocks, Txs and Logs count what is delivered to plugins or the handler,
+	// including items withdrawn and delivered again on reorg.
+	// Blocks caught up in steps of logs by SetCatchUp are counted too.
+	Blocks uint64
+	Txs    uint64
+	Logs   uint64
+
+	Duration time.Duration
+}
+
+// RunRange syncs blocks from - to with the plugins registered, the same way RunTillExitFromBlock does,
+// and returns once plugins are done with all of them, or Ctx is done.
+// Blocks beyond the head are waited for, so are confirmations set by SetConfirmations.
+// The checkpoint store is neither resumed from nor saved to, the range always starts at from.
+// The summary is returned along with an error if the range isn't done.
+func (watcher *AbstractWatcher) RunRange(from, to uint64) (*RangeSummary, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: %d - %d, from is after to", from, to)
+	}
+
+	start := time.Now()
+
+	watcher.inRange = true
+	watcher.rangeEnd = to
+	watcher.rangeSummary = RangeSummary{From: from, To: to}
+
+	err := watcher.RunTillExitFromBlock(from)
+
+	summary := watcher.rangeSummary
+	summary.Duration = time.Since(start)
+
+	if err == nil && !watcher.rangeDone() {
+		err = fmt.Errorf("block range %d - %d not done, synced to %d: %w", from, to, watcher.LatestSyncedBlockNum(), watcher.Ctx.Err())
+	}
+
+	return &summary, err
+}
+
+// rangeDone tells if blocks up to rangeEnd are synced and none is waiting for confirmations
+func (watcher *AbstractWatcher) rangeDone() bool {
+	if !watcher.syncedTo(watcher.rangeEnd) {
+		return false
+	}
+
+	watcher.lock.RLock()
+	defer watcher.lock.RUnlock()
+
+	return watcher.firstUnconfirmedBlockNum() == 0
+}
+
+// RunRange handles logs of blocks from - to the same way Run does, and returns once the handler is done with them,
+// or ctx is done. startBlockNum is ignored, so is CheckpointStore, the range always starts at from.
+// Txs in the summary are the ones with logs handled.
+// The summary is returned along with an error if the range isn't done.
+func (w *ReceiptLogWatcher) RunRange(from, to int) (*RangeSummary, error) {
+	if from < 0 || from > to {
+		return nil, fmt.Errorf("invalid block range: %d - %d", from, to)
+	}
+
+	start := time.Now()
+
+	w.rangeEnd = to
+	w.rangeSummary = RangeSummary{From: uint64(from), To: uint64(to)}
+
+	err := w.run(from)
+	if err != nil && w.ctx.Err() != nil {
+		// a request aborted by shutdown
+		err = nil
+	}
+
+	summary := w.rangeSummary
+	summary.Duration = time.Since(start)
+
+	if err == nil && !w.rangeDone {
+		err = fmt.Errorf("block range %d - %d not done, synced to %d: %w", from, to, w.GetHighestSyncedBlockNum(), w.ctx.Err())
+	}
+
+	return &summary, err
+}
+
+// countHandled adds a range handled to rangeSummary
+func (w *ReceiptLogWatcher) countHandled(from, to int, logs []*types.Log) {
+	w.rangeSummary.Blocks += uint64(to - from + 1)
+	w.rangeSummary.Logs += uint64(len(logs))
+
+	// logs of a tx are next to each other
+	for i, l := range logs {
+		if i == 0 || l.TxHash != logs[i-1].TxHash {
+			w.rangeSummary.Txs++
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func runRange(w *AbstractWatcher, from, to uint64) <-chan *RangeSummary {
+	done := make(chan *RangeSummary, 1)
+	go func() {
+		summary, err := w.RunRange(from, to)
+		if err != nil {
+			summary = nil
+		}
+
+		done <- summary
+	}()
+
+	return done
+}
+
+func expectSummary(t *testing.T, summary *RangeSummary, blocks, txs, logs uint64) {
+	t.Helper()
+
+	if summary == nil {
+		t.Fatal("range not done")
+	}
+
+	if summary.Blocks != blocks || summary.Txs != txs || summary.Logs != logs || summary.Duration <= 0 {
+		t.Fatalf("expect %d blocks, %d txs and %d logs, got %+v", blocks, txs, logs, summary)
+	}
+}
+
+func TestRunRange(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 10; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	logs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()}, func(l *structs.RemovableReceiptLog) {
+		logs <- l
+	}))
+
+	select {
+	case summary := <-runRange(w, 3, 6):
+		expectSummary(t, summary, 4, 4, 4)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRange didn't return")
+	}
+
+	// plugins are done with the range once RunRange returns
+	for i := uint64(3); i <= 6; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+
+		if l := <-logs; l.Log.BlockNumber != i {
+			t.Fatalf("expect log of block %d, got %d", i, l.Log.BlockNumber)
+		}
+	}
+
+	if len(blocks) != 0 || len(logs) != 0 {
+		t.Fatalf("expect nothing beyond the range, got %d blocks and %d logs", len(blocks), len(logs))
+	}
+}
+
+func TestRunRangeFromGenesis(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	select {
+	case summary := <-runRange(w, 0, 2):
+		expectSummary(t, summary, 3, 0, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRange didn't return")
+	}
+
+	for i := uint64(0); i <= 2; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	if len(blocks) != 0 {
+		t.Fatalf("expect nothing beyond the range, got %d blocks", len(blocks))
+	}
+}
+
+func TestRunRangeFromGenesisWithBackfill(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 6; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	// nothing is fetched before block 0, the plugin gets the logs live
+	logs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPluginWithBackfill(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			logs <- l
+		},
+	), 0)
+
+	select {
+	case summary := <-runRange(w, 0, 4):
+		expectSummary(t, summary, 5, 4, 4)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRange didn't return")
+	}
+
+	for i := uint64(1); i <= 4; i++ {
+		if l := <-logs; l.Log.BlockNumber != i {
+			t.Fatalf("expect log of block %d, got %d", i, l.Log.BlockNumber)
+		}
+	}
+
+	if len(logs) != 0 {
+		t.Fatalf("expect each log once within the range, got %d more", len(logs))
+	}
+}
+
+func TestRunRangeWaitsForConfirmations(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetConfirmations(2)
+
+	done := runRange(w, 4, 6)
+
+	select {
+	case <-done:
+		t.Fatal("block 6 returned before it's confirmed")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	chain.AddBlock()
+
+	select {
+	case summary := <-done:
+		expectSummary(t, summary, 3, 0, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRange didn't return")
+	}
+}
+
+func TestReceiptLogWatcherRunRange(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 10; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ranges [][2]int
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		ranges = append(ranges, [2]int{from, to})
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			IntervalForPollingNewBlockInSec: 1,
+			StepSizeForBigLag:               3,
+			ReturnForBlockWithNoReceiptLog:  true,
+		},
+	)
+
+	summary, err := w.RunRange(2, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSummary(t, summary, 7, 7, 7)
+
+	next := 2
+	for _, r := range ranges {
+		if r[0] != next {
+			t.Fatalf("expect range from %d, got %v", next, ranges)
+		}
+
+		next = r[1] + 1
+	}
+
+	if next != 9 {
+		t.Fatalf("expect ranges up to block 8, got %v", ranges)
+	}
+}
+
+func TestReceiptLogWatcherRunRangeLeavesCheckpoint(t *testing.T) {
+	chain := fakechain.New()
+	for i := 0; i < 10; i++ {
+		chain.AddBlock(fakeTransferTx())
+	}
+
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+	saved := newCheckpoint([]BlockRef{{8, chain.Block(8).Hash()}})
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ranges [][2]int
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		ranges = append(ranges, [2]int{from, to})
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			IntervalForPollingNewBlockInSec: 1,
+			StepSizeForBigLag:               10,
+			ReturnForBlockWithNoReceiptLog:  true,
+			CheckpointStore:                 store,
+		},
+	)
+
+	if _, err := w.RunRange(2, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranges) != 1 || ranges[0] != [2]int{2, 4} {
+		t.Fatalf("expect range 2 - 4 regardless of checkpoint, got %v", ranges)
+	}
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint == nil || checkpoint.BlockNum != 8 {
+		t.Fatalf("expect checkpoint left at block 8, got %+v", checkpoint)
+	}
+}
@@ -0,0 +1,106 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/rpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterQueuesCallers(t *testing.T) {
+	limiter := rpc.NewRateLimiter(20, 1)
+	limiter.SetMethodCost("eth_getLogs", 5)
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.Wait(context.Background(), "eth_blockNumber", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 1 token in the bucket, 4 more at 20/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("expect callers to queue for 200ms, took %s", elapsed)
+	}
+
+	start = time.Now()
+	if err := limiter.Wait(context.Background(), "eth_getLogs", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expect eth_getLogs to cost 5 tokens, waited %s", elapsed)
+	}
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	limiter := rpc.NewRateLimiter(1, 1)
+
+	if err := limiter.Wait(context.Background(), "eth_blockNumber", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx, "eth_blockNumber", 10); err != context.DeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+
+	// tokens of the canceled wait are given back
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), "eth_blockNumber", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("expect canceled wait refunded, waited %s", elapsed)
+	}
+}
+
+func TestRateLimiterSharedByClients(t *testing.T) {
+	server, requests := newBlockNumServer(t, 0, nil)
+
+	limiter := rpc.NewRateLimiter(10, 2)
+
+	var clients []*rpc.EthBlockChainRPCWithRetry
+	for i := 0; i < 3; i++ {
+		client := rpc.NewEthRPCWithRetry(server.URL, 0)
+		client.SetRateLimiter(limiter)
+		clients = append(clients, client)
+	}
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(client *rpc.EthBlockChainRPCWithRetry) {
+				defer wg.Done()
+				if _, err := client.GetCurrentBlockNum(); err != nil {
+					t.Error(err)
+				}
+			}(client)
+		}
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(requests); n != 6 {
+		t.Fatalf("expect 6 requests, got %d", n)
+	}
+
+	// 2 tokens in the bucket, 4 more at 10/s
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Fatalf("expect clients to share the limit, took %s", elapsed)
+	}
+}
@@ -19,6 +19,22 @@ func ListenForReceiptLogTillExit(
 	interestedTopics []string,
 	handler func(receiptLog structs.RemovableReceiptLog),
 	steps ...int,
+) int {
+	rpcWithRetry := rpc.NewEthRPCWithRetry(api, 5)
+
+	return ListenForReceiptLogTillExitWithRPC(ctx, rpcWithRetry, startBlock, contract, interestedTopics, handler, steps...)
+}
+
+// ListenForReceiptLogTillExitWithRPC is ListenForReceiptLogTillExit reading the chain through the given IBlockChainRPC,
+// requests are made with ctx if rpcClient is an rpc.IContextRPC, so canceling ctx aborts them
+func ListenForReceiptLogTillExitWithRPC(
+	ctx context.Context,
+	rpcClient rpc.IBlockChainRPC,
+	startBlock int,
+	contract string,
+	interestedTopics []string,
+	handler func(receiptLog structs.RemovableReceiptLog),
+	steps ...int,
 ) int {
 	var stepSizeForBigLag int
 	if len(steps) > 0 && steps[0] > 0 {
@@ -27,7 +43,9 @@ func ListenForReceiptLogTillExit(
 		stepSizeForBigLag = DefaultStepSizeForBigLag
 	}
 
-	rpcWithRetry := rpc.NewEthRPCWithRetry(api, 5)
+	rpcClient = rpc.BindContext(ctx, rpcClient)
+	logStep := logRangeStep{max: stepSizeForBigLag}
+	filter := rpc.NewLogFilter(contract, interestedTopics)
 
 	var blockNumToBeProcessedNext = startBlock
 
@@ -36,7 +54,7 @@ func ListenForReceiptLogTillExit(
 		case <-ctx.Done():
 			return blockNumToBeProcessedNext - 1
 		default:
-			highestBlock, err := rpcWithRetry.GetCurrentBlockNum()
+			highestBlock, err := rpcClient.GetCurrentBlockNum()
 			if err != nil {
 				return blockNumToBeProcessedNext - 1
 			}
@@ -48,24 +66,32 @@ func ListenForReceiptLogTillExit(
 			numOfBlocksToProcess := int(highestBlock) - blockNumToBeProcessedNext + 1
 			if numOfBlocksToProcess <= 0 {
 				logrus.Debugf("no ready block after %d, sleep 3 seconds", highestBlock)
-				time.Sleep(3 * time.Second)
+
+				select {
+				case <-ctx.Done():
+					return blockNumToBeProcessedNext - 1
+				case <-time.After(3 * time.Second):
+				}
+
 				continue
 			}
 
 			var to int
-			if numOfBlocksToProcess > stepSizeForBigLag {
+			if step := logStep.size(); numOfBlocksToProcess > step {
 				// quick mode
-				to = blockNumToBeProcessedNext + stepSizeForBigLag - 1
+				to = blockNumToBeProcessedNext + step - 1
 			} else {
 				// normal mode, 1block each time
 				to = blockNumToBeProcessedNext
 			}
 
-			logs, err := rpcWithRetry.GetLogs(uint64(blockNumToBeProcessedNext), uint64(to), contract, interestedTopics)
+			logs, span, err := rpc.GetLogsSplitting(rpcClient, uint64(blockNumToBeProcessedNext), uint64(to), filter)
 			if err != nil {
 				return blockNumToBeProcessedNext - 1
 			}
 
+			logStep.fetched(to-blockNumToBeProcessedNext+1, int(span))
+
 			for i := 0; i < len(logs); i++ {
 				handler(structs.RemovableReceiptLog{
 					Log: logs[i],
@@ -5,6 +5,7 @@ import (
 	"ethereum-watcher/rpc"
 	"ethereum-watcher/utils"
 	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
 	"sync"
@@ -13,14 +14,37 @@ import (
 
 type ReceiptLogWatcher struct {
 	ctx                   context.Context
-	api                   string
+	rpc                   rpc.IBlockChainRPC
 	startBlockNum         int
 	contract              string
 	interestedTopics      []string
+	filter                rpc.LogFilter
 	handler               func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error
 	config                ReceiptLogWatcherConfig
 	highestSyncedBlockNum int
 	highestSyncedLogIndex int
+
+	// ends of recently processed ranges, oldest first, saved to checkpoint store
+	recentBlocks []BlockRef
+
+	// recently handled ranges, oldest first, checked against the chain when DetectReorg is on
+	processedRanges []*processedRange
+	// blocks handled before processedRanges can't be checked, by trimming or restart
+	rangesTrimmed bool
+
+	// blocks to get logs of at once in quick mode, up to StepSizeForBigLag
+	logStep logRangeStep
+
+	// last block of RunRange, -1 to follow the head
+	rangeEnd     int
+	rangeDone    bool
+	rangeSummary RangeSummary
+}
+
+type processedRange struct {
+	from, to int
+	toHash   common.Hash
+	logs     []*types.Log
 }
 
 func NewReceiptLogWatcher(
@@ -31,6 +55,26 @@ func NewReceiptLogWatcher(
 	interestedTopics []string,
 	handler func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error,
 	configs ...ReceiptLogWatcherConfig,
+) *ReceiptLogWatcher {
+	config := decideConfig(configs...)
+
+	rpcWithRetry := rpc.NewEthRPCWithRetry(api, config.RPCMaxRetry)
+	rpcWithRetry.SetRateLimiter(config.RateLimiter)
+
+	return NewReceiptLogWatcherWithRPC(ctx, rpcWithRetry, startBlockNum, contract, interestedTopics, handler, config)
+}
+
+// NewReceiptLogWatcherWithRPC is the same as NewReceiptLogWatcher,
+// but reads the chain through the given IBlockChainRPC instead of dialing an api.
+// RPCMaxRetry in config is ignored, retrying is up to the rpc passed in.
+func NewReceiptLogWatcherWithRPC(
+	ctx context.Context,
+	rpcClient rpc.IBlockChainRPC,
+	startBlockNum int,
+	contract string,
+	interestedTopics []string,
+	handler func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error,
+	configs ...ReceiptLogWatcherConfig,
 ) *ReceiptLogWatcher {
 	utils.Infoln("Topics:", interestedTopics)
 
@@ -38,16 +82,25 @@ func NewReceiptLogWatcher(
 
 	pseudoSyncedLogIndex := config.StartSyncAfterLogIndex - 1
 
+	filter := rpc.NewLogFilter(contract, interestedTopics)
+	filter.Addresses = append(filter.Addresses, config.Addresses...)
+	if len(config.Topics) > 0 {
+		filter.Topics = config.Topics
+	}
+
 	return &ReceiptLogWatcher{
 		ctx:                   ctx,
-		api:                   api,
+		rpc:                   rpc.BindContext(ctx, rpcClient),
 		startBlockNum:         startBlockNum,
 		contract:              contract,
 		interestedTopics:      interestedTopics,
+		filter:                filter,
 		handler:               handler,
 		config:                config,
 		highestSyncedBlockNum: startBlockNum,
 		highestSyncedLogIndex: pseudoSyncedLogIndex,
+		logStep:               logRangeStep{max: config.StepSizeForBigLag},
+		rangeEnd:              -1,
 	}
 }
 
@@ -69,18 +122,58 @@ func decideConfig(configs ...ReceiptLogWatcherConfig) ReceiptLogWatcherConfig {
 		if config.RPCMaxRetry <= 0 {
 			config.RPCMaxRetry = defaultConfig.RPCMaxRetry
 		}
+
+		if config.BlocksToKeepForReorg <= 0 {
+			config.BlocksToKeepForReorg = defaultConfig.BlocksToKeepForReorg
+		}
 	}
 
 	return config
 }
 
 type ReceiptLogWatcherConfig struct {
+	// StepSizeForBigLag is the max blocks to get logs of at once while lagging behind,
+	// ranges the node rejects as too large are split, and the step shrinks till it grows back after successes.
+	// Steps are fetched one by one, AbstractWatcher.SetCatchUp fetches several at once and tells plugins once it's live.
 	StepSizeForBigLag               int
 	ReturnForBlockWithNoReceiptLog  bool
 	IntervalForPollingNewBlockInSec int
 	RPCMaxRetry                     int
 	LagToHighestBlock               int
 	StartSyncAfterLogIndex          int
+
+	// Addresses are contracts to watch besides contract,
+	// logs of any contract are watched if contract is empty and there are no Addresses
+	Addresses []common.Address
+
+	// Topics if set, is the full eth_getLogs topic matrix to filter on instead of interestedTopics at topic[0],
+	// e.g. {{Transfer}, nil, {deposit addresses...}} for transfers to any of the deposit addresses
+	Topics [][]common.Hash
+
+	// SyncTarget is the head to sync up to, LagToHighestBlock counts from it
+	SyncTarget SyncTarget
+
+	// RateLimiter if set, requests queue for its tokens, share one between watchers of the same provider.
+	// Ignored by NewReceiptLogWatcherWithRPC, set it on the rpc passed in instead
+	RateLimiter *rpc.RateLimiter
+
+	// SubscribeNewHeads makes watcher wait for new heads pushed over WebSocket instead of sleeping,
+	// api has to be a ws:// one, it polls every IntervalForPollingNewBlockInSec while the subscription is down
+	SubscribeNewHeads bool
+
+	// CheckpointStore if set, progress is saved into it after each handled range,
+	// and Run resumes from it instead of startBlockNum. RunRange leaves it alone.
+	CheckpointStore CheckpointStore
+
+	// DetectReorg makes watcher check the hashes of handled ranges before each new range.
+	// Once a range is orphaned, its logs are withdrawn thru RollbackHandler,
+	// or thru the handler with log.Removed set if RollbackHandler is nil, and the range is processed again.
+	DetectReorg bool
+	// BlocksToKeepForReorg is how far back handled ranges are kept for DetectReorg,
+	// Run fails with ErrDeepReorg if a reorg goes beyond it
+	BlocksToKeepForReorg int
+	// RollbackHandler receives orphaned logs of range from - to, latest first
+	RollbackHandler func(from, to int, removedLogs []*types.Log) error
 }
 
 var defaultConfig = ReceiptLogWatcherConfig{
@@ -90,20 +183,46 @@ var defaultConfig = ReceiptLogWatcherConfig{
 	RPCMaxRetry:                     5,
 	LagToHighestBlock:               0,
 	StartSyncAfterLogIndex:          0,
+	BlocksToKeepForReorg:            64,
 }
 
 func (w *ReceiptLogWatcher) Run() error {
+	err := w.run(w.startBlockNum)
+	if err != nil && w.ctx.Err() != nil {
+		// a request aborted by shutdown
+		logrus.Infof("ReceiptLogWatcher context down while running: %s", err)
+		return nil
+	}
 
-	var blockNumToBeProcessedNext = w.startBlockNum
+	return err
+}
+
+func (w *ReceiptLogWatcher) run(startBlockNum int) error {
+
+	var blockNumToBeProcessedNext = startBlockNum
+
+	resumeFrom, err := w.resumeFromCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	if resumeFrom >= 0 {
+		blockNumToBeProcessedNext = resumeFrom
+		w.rangesTrimmed = true
+	}
 
-	rpcWithRetry := rpc.NewEthRPCWithRetry(w.api, w.config.RPCMaxRetry)
+	var newHeads *newHeadNotifier
+	if w.config.SubscribeNewHeads {
+		newHeads = newNewHeadNotifier(w.ctx, w.rpc)
+		defer newHeads.close()
+	}
 
 	for {
 		select {
 		case <-w.ctx.Done():
 			return nil
 		default:
-			highestBlock, err := rpcWithRetry.GetCurrentBlockNum()
+			highestBlock, err := getSyncTargetBlockNum(w.rpc, w.config.SyncTarget)
 			if err != nil {
 				return err
 			}
@@ -114,6 +233,17 @@ func (w *ReceiptLogWatcher) Run() error {
 
 			// [blockNumToBeProcessedNext...highestBlockCanProcess..[Lag]..CurrentHighestBlock]
 			highestBlockCanProcess := int(highestBlock) - w.config.LagToHighestBlock
+
+			if w.rangeEnd >= 0 {
+				if blockNumToBeProcessedNext > w.rangeEnd {
+					w.rangeDone = true
+					return nil
+				}
+
+				if highestBlockCanProcess > w.rangeEnd {
+					highestBlockCanProcess = w.rangeEnd
+				}
+			}
 			numOfBlocksToProcess := highestBlockCanProcess - blockNumToBeProcessedNext + 1
 
 			if numOfBlocksToProcess <= 0 {
@@ -121,28 +251,58 @@ func (w *ReceiptLogWatcher) Run() error {
 
 				logrus.Debugf("no ready block after %d(lag: %d), sleep %d seconds", highestBlockCanProcess, w.config.LagToHighestBlock, sleepSec)
 
-				select {
-				case <-time.After(time.Duration(sleepSec) * time.Second):
-					continue
-				case <-w.ctx.Done():
+				if !newHeads.wait(w.ctx, time.Duration(sleepSec)*time.Second) {
 					return nil
 				}
+
+				continue
+			}
+
+			if w.config.DetectReorg {
+				rollbackTo, err := w.rollbackOrphanedRanges()
+				if err != nil {
+					return err
+				}
+
+				if rollbackTo >= 0 {
+					blockNumToBeProcessedNext = rollbackTo
+					continue
+				}
 			}
 
 			var to int
-			if numOfBlocksToProcess > w.config.StepSizeForBigLag {
+			if step := w.logStep.size(); numOfBlocksToProcess > step {
 				// quick mode
-				to = blockNumToBeProcessedNext + w.config.StepSizeForBigLag - 1
+				to = blockNumToBeProcessedNext + step - 1
 			} else {
 				// normal mode, up to cur highest block num can process
 				to = highestBlockCanProcess
 			}
 
-			logs, err := rpcWithRetry.GetLogs(uint64(blockNumToBeProcessedNext), uint64(to), w.contract, w.interestedTopics)
+			// hash of the range end, fetched before logs so we can tell if logs are from another branch
+			var toBlock *types.Block
+			if w.config.DetectReorg || w.checkpointStore() != nil {
+				toBlock, err = w.rpc.GetBlockByNum(uint64(to))
+				if err != nil {
+					return err
+				}
+			}
+
+			logs, span, err := rpc.GetLogsSplitting(w.rpc, uint64(blockNumToBeProcessedNext), uint64(to), w.filter)
 			if err != nil {
 				return err
 			}
 
+			// in case the node ignores some positions
+			logs = w.filter.Filter(logs)
+
+			w.logStep.fetched(to-blockNumToBeProcessedNext+1, int(span))
+
+			if toBlock != nil && !logsOnBranchOf(logs, toBlock) {
+				logrus.Infof("chain changed while getting logs of block range: %d - %d, try again", blockNumToBeProcessedNext, to)
+				continue
+			}
+
 			isUpToHighestBlock := to == int(highestBlock)
 
 			if len(logs) == 0 {
@@ -165,14 +325,170 @@ func (w *ReceiptLogWatcher) Run() error {
 				}
 			}
 
+			w.countHandled(blockNumToBeProcessedNext, to, logs)
+
 			// todo rm 2nd param
 			w.updateHighestSyncedBlockNumAndLogIndex(to, -1)
 
+			if w.config.DetectReorg {
+				w.keepProcessedRange(&processedRange{blockNumToBeProcessedNext, to, toBlock.Hash(), logs})
+			}
+
+			if toBlock != nil {
+				if err := w.saveCheckpoint(BlockRef{toBlock.NumberU64(), toBlock.Hash()}); err != nil {
+					return err
+				}
+			}
+
 			blockNumToBeProcessedNext = to + 1
 		}
 	}
 }
 
+// logsOnBranchOf checks logs in the last block of range are from block toBlock
+func logsOnBranchOf(logs []*types.Log, toBlock *types.Block) bool {
+	for _, l := range logs {
+		if l.BlockNumber == toBlock.NumberU64() && l.BlockHash != toBlock.Hash() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *ReceiptLogWatcher) keepProcessedRange(r *processedRange) {
+	w.processedRanges = append(w.processedRanges, r)
+
+	for len(w.processedRanges) > 1 && r.to-w.processedRanges[0].to >= w.config.BlocksToKeepForReorg {
+		w.processedRanges = w.processedRanges[1:]
+		w.rangesTrimmed = true
+	}
+}
+
+// rollbackOrphanedRanges withdraws handled ranges not on chain any more,
+// returns the block to process again from, -1 if nothing is orphaned
+func (w *ReceiptLogWatcher) rollbackOrphanedRanges() (int, error) {
+	rollbackTo := -1
+
+	for len(w.processedRanges) > 0 {
+		last := w.processedRanges[len(w.processedRanges)-1]
+
+		block, err := w.rpc.GetBlockByNum(uint64(last.to))
+		if err != nil {
+			return -1, err
+		}
+
+		if block.Hash() == last.toHash {
+			break
+		}
+
+		logrus.Warnf("block range %d - %d is orphaned, rolling back %d logs", last.from, last.to, len(last.logs))
+
+		if err := w.rollback(last); err != nil {
+			return -1, err
+		}
+
+		w.processedRanges = w.processedRanges[:len(w.processedRanges)-1]
+		rollbackTo = last.from
+	}
+
+	if rollbackTo < 0 {
+		return -1, nil
+	}
+
+	if len(w.processedRanges) == 0 && w.rangesTrimmed {
+		return -1, fmt.Errorf("%w, all handled ranges since block %d are orphaned", ErrDeepReorg, rollbackTo)
+	}
+
+	w.recentBlocks = truncateBlockRefs(w.recentBlocks, uint64(rollbackTo-1))
+	w.updateHighestSyncedBlockNumAndLogIndex(rollbackTo-1, -1)
+
+	return rollbackTo, nil
+}
+
+func (w *ReceiptLogWatcher) rollback(r *processedRange) error {
+	removedLogs := make([]*types.Log, 0, len(r.logs))
+	for i := len(r.logs) - 1; i >= 0; i-- {
+		removedLog := *r.logs[i]
+		removedLog.Removed = true
+
+		removedLogs = append(removedLogs, &removedLog)
+	}
+
+	if w.config.RollbackHandler != nil {
+		if err := w.config.RollbackHandler(r.from, r.to, removedLogs); err != nil {
+			return fmt.Errorf("ethereum_watcher rollback handler returns error: %s", err)
+		}
+
+		return nil
+	}
+
+	if len(removedLogs) == 0 && !w.config.ReturnForBlockWithNoReceiptLog {
+		return nil
+	}
+
+	if err := w.handler(r.from, r.to, removedLogs, false); err != nil {
+		return fmt.Errorf("ethereum_watcher handler(removed) returns error: %s", err)
+	}
+
+	return nil
+}
+
+// checkpointStore is CheckpointStore, nil in RunRange
+func (w *ReceiptLogWatcher) checkpointStore() CheckpointStore {
+	if w.rangeEnd >= 0 {
+		return nil
+	}
+
+	return w.config.CheckpointStore
+}
+
+func (w *ReceiptLogWatcher) saveCheckpoint(ref BlockRef) error {
+	store := w.checkpointStore()
+	if store == nil {
+		return nil
+	}
+
+	w.recentBlocks = appendBlockRefs(w.recentBlocks, ref)
+
+	return store.Save(newCheckpoint(w.recentBlocks))
+}
+
+// resumeFromCheckpoint returns the block to process next according to checkpoint store, -1 if there is no checkpoint
+func (w *ReceiptLogWatcher) resumeFromCheckpoint() (int, error) {
+	store := w.checkpointStore()
+	if store == nil {
+		return -1, nil
+	}
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		return -1, err
+	}
+
+	if checkpoint == nil || len(checkpoint.RecentBlocks) == 0 {
+		return -1, nil
+	}
+
+	block, err := findLastCanonicalBlock(w.rpc, checkpoint)
+	if err != nil {
+		return -1, err
+	}
+
+	if block.NumberU64() != checkpoint.BlockNum {
+		logrus.Warnf("checkpoint block %d(%s) is not on chain any more, resume from block %d(%s)",
+			checkpoint.BlockNum, checkpoint.BlockHash, block.Number(), block.Hash())
+	} else {
+		logrus.Infof("resume from checkpoint block %d(%s)", block.Number(), block.Hash())
+	}
+
+	w.recentBlocks = truncateBlockRefs(checkpoint.RecentBlocks, block.NumberU64())
+
+	w.updateHighestSyncedBlockNumAndLogIndex(int(block.NumberU64()), -1)
+
+	return int(block.NumberU64()) + 1, nil
+}
+
 var progressLock = sync.Mutex{}
 
 func (w *ReceiptLogWatcher) updateHighestSyncedBlockNumAndLogIndex(block int, logIndex int) {
@@ -0,0 +1,201 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"github.com/ethereum/go-ethereum/core/types"
+	"testing"
+	"time"
+)
+
+func TestReceiptLogWatcherWithFakeChain(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+	chain.AddBlock(fakeTransferTx(), fakeTransferTx())
+	chain.AddBlocks(4)
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type handled struct {
+		from, to           int
+		logs               []*types.Log
+		isUpToHighestBlock bool
+	}
+
+	var calls []handled
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		calls = append(calls, handled{from, to, receiptLogs, isUpToHighestBlock})
+
+		if isUpToHighestBlock {
+			cancel()
+		}
+
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			StepSizeForBigLag:               5,
+			IntervalForPollingNewBlockInSec: 1,
+			ReturnForBlockWithNoReceiptLog:  true,
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returns err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiptLogWatcher didn't reach highest block")
+	}
+
+	expected := []handled{
+		{1, 5, nil, false},
+		{6, 10, nil, false},
+		{11, 12, nil, true},
+	}
+
+	if len(calls) != len(expected) {
+		t.Fatalf("expect %d handler calls, got %d: %+v", len(expected), len(calls), calls)
+	}
+
+	numOfLogs := []int{2, 1, 0}
+	for i, call := range calls {
+		if call.from != expected[i].from || call.to != expected[i].to || call.isUpToHighestBlock != expected[i].isUpToHighestBlock {
+			t.Fatalf("call %d: expect range %d-%d, got %d-%d", i, expected[i].from, expected[i].to, call.from, call.to)
+		}
+
+		if len(call.logs) != numOfLogs[i] {
+			t.Fatalf("call %d: expect %d logs, got %d", i, numOfLogs[i], len(call.logs))
+		}
+	}
+
+	if w.GetHighestSyncedBlockNum() != 12 {
+		t.Fatalf("expect highest synced block 12, got %d", w.GetHighestSyncedBlockNum())
+	}
+}
+
+func TestReceiptLogWatcherRollsBackOrphanedRanges(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(2)
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlock()
+	orphaned := chain.AddBlock(fakeTransferTx())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls [][]*types.Log
+	var newBranch []*types.Block
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		calls = append(calls, receiptLogs)
+
+		if to == 5 && newBranch == nil {
+			newBranch = chain.Reorg(2, nil, []fakechain.Tx{fakeTransferTx()}, nil)
+		} else if to == 6 {
+			cancel()
+		}
+
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			StepSizeForBigLag:               3,
+			IntervalForPollingNewBlockInSec: 1,
+			DetectReorg:                     true,
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returns err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiptLogWatcher didn't reach new head")
+	}
+
+	// 1-3, 4-5, 4-5 withdrawn, 4-6
+	if len(calls) != 4 {
+		t.Fatalf("expect 4 handler calls, got %d", len(calls))
+	}
+
+	removed := calls[2]
+	if len(removed) != 1 || !removed[0].Removed || removed[0].BlockHash != orphaned.Hash() {
+		t.Fatalf("expect log of orphaned block %s withdrawn, got %+v", orphaned.Hash(), removed)
+	}
+
+	if calls[1][0].Removed {
+		t.Fatal("log handed out before must not be changed by rollback")
+	}
+
+	added := calls[3]
+	if len(added) != 1 || added[0].Removed || added[0].BlockHash != newBranch[1].Hash() {
+		t.Fatalf("expect log of new block %s, got %+v", newBranch[1].Hash(), added)
+	}
+}
+
+func TestReceiptLogWatcherFailsOnReorgBeyondKeptRanges(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		if to == 6 {
+			chain.Reorg(3, nil, nil, nil, nil)
+		}
+
+		return nil
+	}
+
+	var rolledBack []int
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			StepSizeForBigLag:               2,
+			IntervalForPollingNewBlockInSec: 1,
+			ReturnForBlockWithNoReceiptLog:  true,
+			DetectReorg:                     true,
+			BlocksToKeepForReorg:            2,
+			RollbackHandler: func(from, to int, removedLogs []*types.Log) error {
+				rolledBack = append(rolledBack, from, to)
+				return nil
+			},
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeepReorg) {
+			t.Fatalf("expect ErrDeepReorg, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiptLogWatcher didn't detect deep reorg")
+	}
+
+	if len(rolledBack) != 2 || rolledBack[0] != 5 || rolledBack[1] != 6 {
+		t.Fatalf("expect range 5-6 rolled back, got %v", rolledBack)
+	}
+}
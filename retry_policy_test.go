@@ -0,0 +1,247 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jsonRPCError struct {
+	code int
+	msg  string
+}
+
+func (e jsonRPCError) Error() string  { return e.msg }
+func (e jsonRPCError) ErrorCode() int { return e.code }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected rpc.ErrorClass
+	}{
+		{errors.New("dial tcp: connection refused"), rpc.ErrorRetryable},
+		{gethrpc.HTTPError{StatusCode: 502, Status: "502 Bad Gateway"}, rpc.ErrorRetryable},
+		{gethrpc.HTTPError{StatusCode: 429, Status: "429 Too Many Requests"}, rpc.ErrorRateLimited},
+		{gethrpc.HTTPError{StatusCode: 401, Status: "401 Unauthorized"}, rpc.ErrorFatal},
+		{jsonRPCError{-32602, "invalid argument 0: hex string without 0x prefix"}, rpc.ErrorFatal},
+		{jsonRPCError{-32005, "daily request count exceeded, request rate limited"}, rpc.ErrorRateLimited},
+		{jsonRPCError{-32005, "query returned more than 10000 results"}, rpc.ErrorFatal},
+		{jsonRPCError{-32000, "header not found"}, rpc.ErrorFatal},
+		{&rpc.LaggingNodeError{Err: jsonRPCError{-32000, "header not found"}}, rpc.ErrorRetryable},
+		{&rpc.LaggingNodeError{Err: ethereum.NotFound}, rpc.ErrorRetryable},
+		{fmt.Errorf("get block: %w", ethereum.NotFound), rpc.ErrorFatal},
+		{&rpc.RetryAfterError{Err: errors.New("busy"), RetryAfter: time.Second}, rpc.ErrorRateLimited},
+	}
+
+	for _, c := range cases {
+		if got := rpc.ClassifyError(c.err); got != c.expected {
+			t.Errorf("%v: expect %s, got %s", c.err, c.expected, got)
+		}
+	}
+}
+
+func TestBackoffRetryPolicy(t *testing.T) {
+	policy := rpc.NewBackoffRetryPolicy(5)
+	policy.Jitter = 0
+	policy.MaxDelay = 3 * time.Second
+
+	transient := errors.New("connection reset")
+	for attempt, expected := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		wait, ok := policy.Backoff("GetLogs", attempt, transient)
+		if !ok || wait != expected {
+			t.Fatalf("attempt %d: expect wait %s, got %s(%t)", attempt, expected, wait, ok)
+		}
+	}
+
+	if _, ok := policy.Backoff("GetLogs", 5, transient); ok {
+		t.Fatal("expect to give up after MaxRetries")
+	}
+
+	if _, ok := policy.Backoff("GetBlockByNum", 0, ethereum.NotFound); ok {
+		t.Fatal("expect no retry of fatal error")
+	}
+
+	wait, ok := policy.Backoff("GetLogs", 0, &rpc.RetryAfterError{Err: transient, RetryAfter: 7 * time.Second})
+	if !ok || wait != 7*time.Second {
+		t.Fatalf("expect Retry-After honored, got %s(%t)", wait, ok)
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait, _ := policy.Backoff("GetLogs", 1, transient)
+		if wait < 500*time.Millisecond || wait > 1500*time.Millisecond {
+			t.Fatalf("jittered wait %s out of range", wait)
+		}
+	}
+}
+
+// newBlockNumServer answers eth_blockNumber after failing the first failures requests with fail
+func newBlockNumServer(t *testing.T, failures int32, fail func(w http.ResponseWriter)) (*httptest.Server, *int32) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			fail(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	server, requests := newBlockNumServer(t, 1, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	client := rpc.NewEthRPCWithRetry(server.URL, 3)
+
+	start := time.Now()
+	num, err := client.GetCurrentBlockNum()
+	if err != nil || num != 16 {
+		t.Fatalf("expect block 16, got %d, err: %v", num, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expect to wait for Retry-After 1s, waited %s", elapsed)
+	}
+
+	if atomic.LoadInt32(requests) != 2 {
+		t.Fatalf("expect 2 requests, got %d", atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryAfterOnlyComesWithItsCall(t *testing.T) {
+	var requests int32
+	rateLimited := make(chan struct{})
+
+	// the first call fails once the second one is rate limited
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			<-rateLimited
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		close(rateLimited)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := rpc.DialEthRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.WithContext(context.Background()).GetCurrentBlockNum()
+		first <- err
+	}()
+
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = client.GetCurrentBlockNum()
+
+	var retryAfterErr *rpc.RetryAfterError
+	if !errors.As(err, &retryAfterErr) || retryAfterErr.RetryAfter != 7*time.Second {
+		t.Fatalf("expect Retry-After 7s with err, got %v", err)
+	}
+
+	if err := <-first; err == nil || errors.As(err, &retryAfterErr) {
+		t.Fatalf("expect err without Retry-After of the other call, got %v", err)
+	}
+}
+
+func TestRetryStopsOnFatalErrorAndMethodPolicy(t *testing.T) {
+	server, requests := newBlockNumServer(t, 100, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid params"}}`))
+	})
+
+	client := rpc.NewEthRPCWithRetry(server.URL, 3)
+
+	if _, err := client.GetCurrentBlockNum(); err == nil {
+		t.Fatal("expect err")
+	}
+
+	if atomic.LoadInt32(requests) != 1 {
+		t.Fatalf("expect fatal error not retried, got %d requests", atomic.LoadInt32(requests))
+	}
+
+	flaky, flakyRequests := newBlockNumServer(t, 100, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	client = rpc.NewEthRPCWithRetry(flaky.URL, 3)
+	client.SetMethodRetryPolicy("GetCurrentBlockNum", &rpc.BackoffRetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond})
+
+	if _, err := client.GetCurrentBlockNum(); err == nil {
+		t.Fatal("expect err")
+	}
+
+	if atomic.LoadInt32(flakyRequests) != 2 {
+		t.Fatalf("expect method policy to retry once, got %d requests", atomic.LoadInt32(flakyRequests))
+	}
+}
+
+// laggingNodeRPC doesn't know block num the first time it's asked for it, like a backend lagging behind the head
+type laggingNodeRPC struct {
+	*fakechain.Chain
+	num    uint64
+	misses *int32
+}
+
+func (r laggingNodeRPC) GetBlockByNum(num uint64) (*types.Block, error) {
+	if num == r.num && atomic.AddInt32(r.misses, -1) >= 0 {
+		return nil, ethereum.NotFound
+	}
+
+	return r.Chain.GetBlockByNum(num)
+}
+
+func TestSyncRetriesBlockNotFoundBelowHead(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// default sync retry policy
+	misses := int32(1)
+	w := NewEthWatcher(ctx, laggingNodeRPC{Chain: chain, num: 2, misses: &misses})
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 16)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+}
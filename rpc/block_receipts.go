@@ -0,0 +1,275 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const DefaultReceiptsBatchSize = 100
+
+// IBlockReceiptsRPC is implemented by clients fetching receipts of many txs in a block with few requests
+type IBlockReceiptsRPC interface {
+	// GetTransactionReceiptsInBlock returns receipts of txHashes in the same order,
+	// all txs have to be in block blockHash
+	GetTransactionReceiptsInBlock(blockHash string, txHashes []string) ([]*types.Receipt, error)
+}
+
+var (
+	_ IBlockReceiptsRPC = (*EthBlockChainRPC)(nil)
+	_ IBlockReceiptsRPC = (*EthBlockChainRPCWithRetry)(nil)
+	_ IBlockReceiptsRPC = (*FailoverRPC)(nil)
+)
+
+// receiptFetchers is how many GetTransactionReceipt are in flight at once for clients without IBlockReceiptsRPC
+const receiptFetchers = 16
+
+// GetTransactionReceiptsInBlock fetches receipts with client's IBlockReceiptsRPC if it has one,
+// otherwise with one GetTransactionReceipt per tx, see GetTransactionReceiptsInBlockContext
+func GetTransactionReceiptsInBlock(client IBlockChainRPC, blockHash string, txHashes []string) ([]*types.Receipt, error) {
+	if c, ok := client.(IBlockReceiptsRPC); ok {
+		return c.GetTransactionReceiptsInBlock(blockHash, txHashes)
+	}
+
+	return getTransactionReceipts(client, nil, txHashes)
+}
+
+// GetTransactionReceiptsInBlockContext is GetTransactionReceiptsInBlock with requests bound to ctx.
+// Without IBlockReceiptsRPC, the first failed GetTransactionReceipt cancels the ones in flight
+// if client is an IContextRPC, txs not asked yet are skipped in any case.
+func GetTransactionReceiptsInBlockContext(ctx context.Context, client IBlockChainRPC, blockHash string, txHashes []string) ([]*types.Receipt, error) {
+	if c, ok := BindContext(ctx, client).(IBlockReceiptsRPC); ok {
+		return c.GetTransactionReceiptsInBlock(blockHash, txHashes)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	return getTransactionReceipts(BindContext(ctx, client), cancel, txHashes)
+}
+
+// getTransactionReceipts fetches receipts with up to receiptFetchers GetTransactionReceipt at once,
+// stops on the first error calling cancel if given, and returns once all calls in flight are back
+func getTransactionReceipts(client IBlockChainRPC, cancel context.CancelFunc, txHashes []string) ([]*types.Receipt, error) {
+	receipts := make([]*types.Receipt, len(txHashes))
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		next     int
+		firstErr error
+	)
+
+	// take returns the index of the next tx to fetch, false once all are taken or one failed
+	take := func() (int, bool) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr != nil || next >= len(txHashes) {
+			return 0, false
+		}
+
+		next++
+		return next - 1, true
+	}
+
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}
+
+	fetchers := receiptFetchers
+	if len(txHashes) < fetchers {
+		fetchers = len(txHashes)
+	}
+
+	for n := 0; n < fetchers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i, ok := take(); ok; i, ok = take() {
+				receipt, err := client.GetTransactionReceipt(txHashes[i])
+				if err != nil {
+					// one fails all
+					fail(err)
+					return
+				}
+
+				receipts[i] = receipt
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return receipts, nil
+}
+
+const (
+	blockReceiptsUnknown int32 = iota
+	blockReceiptsSupported
+	blockReceiptsUnsupported
+)
+
+// blockReceiptsSupport remembers if the node knows eth_getBlockReceipts, shared by copies of EthBlockChainRPC
+type blockReceiptsSupport struct {
+	state     int32
+	batchSize int32
+}
+
+// SetReceiptsBatchSize sets how many eth_getTransactionReceipt go in one batch request,
+// used if the node has no eth_getBlockReceipts
+func (rpc *EthBlockChainRPC) SetReceiptsBatchSize(size int) {
+	if size <= 0 {
+		size = DefaultReceiptsBatchSize
+	}
+
+	atomic.StoreInt32(&rpc.blockReceipts.batchSize, int32(size))
+}
+
+// GetTransactionReceiptsInBlock tries eth_getBlockReceipts first,
+// falls back to batched eth_getTransactionReceipt for good once the node doesn't support it
+func (rpc EthBlockChainRPC) GetTransactionReceiptsInBlock(blockHash string, txHashes []string) ([]*types.Receipt, error) {
+	if len(txHashes) == 0 {
+		return nil, nil
+	}
+
+	// a single receipt is cheaper than all receipts of the block
+	if len(txHashes) > 1 && atomic.LoadInt32(&rpc.blockReceipts.state) != blockReceiptsUnsupported {
+		receipts, err := rpc.getBlockReceipts(blockHash, txHashes)
+		if err == nil {
+			atomic.StoreInt32(&rpc.blockReceipts.state, blockReceiptsSupported)
+			return receipts, nil
+		}
+
+		if !isMethodNotFound(err) {
+			return nil, err
+		}
+
+		logrus.Infof("eth_getBlockReceipts not supported: %s, batching eth_getTransactionReceipt instead", err)
+		atomic.StoreInt32(&rpc.blockReceipts.state, blockReceiptsUnsupported)
+	}
+
+	return rpc.batchGetTransactionReceipts(txHashes)
+}
+
+func (rpc EthBlockChainRPC) getBlockReceipts(blockHash string, txHashes []string) ([]*types.Receipt, error) {
+	var blockReceipts []*types.Receipt
+
+	ctx, cancel, err := rpc.callContext("eth_getBlockReceipts", 1)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	err = rpc.rawRPC.CallContext(ctx, &blockReceipts, "eth_getBlockReceipts", blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockReceipts == nil {
+		return nil, ethereum.NotFound
+	}
+
+	receiptOfTx := make(map[common.Hash]*types.Receipt, len(blockReceipts))
+	for _, r := range blockReceipts {
+		receiptOfTx[r.TxHash] = r
+	}
+
+	receipts := make([]*types.Receipt, len(txHashes))
+	for i, txHash := range txHashes {
+		r, ok := receiptOfTx[common.HexToHash(txHash)]
+		if !ok {
+			return nil, fmt.Errorf("receipt of tx %s not in block %s", txHash, blockHash)
+		}
+
+		receipts[i] = r
+	}
+
+	return receipts, nil
+}
+
+func (rpc EthBlockChainRPC) batchGetTransactionReceipts(txHashes []string) ([]*types.Receipt, error) {
+	batchSize := int(atomic.LoadInt32(&rpc.blockReceipts.batchSize))
+	if batchSize <= 0 {
+		batchSize = DefaultReceiptsBatchSize
+	}
+
+	receipts := make([]*types.Receipt, len(txHashes))
+
+	for from := 0; from < len(txHashes); from += batchSize {
+		to := from + batchSize
+		if to > len(txHashes) {
+			to = len(txHashes)
+		}
+
+		batch := make([]gethrpc.BatchElem, 0, to-from)
+		for i := from; i < to; i++ {
+			batch = append(batch, gethrpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{common.HexToHash(txHashes[i])},
+				Result: &receipts[i],
+			})
+		}
+
+		ctx, cancel, err := rpc.callContext("eth_getTransactionReceipt", len(batch))
+		if err != nil {
+			return nil, err
+		}
+
+		err = rpc.rawRPC.BatchCallContext(ctx, batch)
+		cancel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, elem := range batch {
+			if elem.Error != nil {
+				return nil, elem.Error
+			}
+
+			if receipts[from+i] == nil {
+				return nil, fmt.Errorf("receipt of tx %s: %w", txHashes[from+i], ethereum.NotFound)
+			}
+		}
+	}
+
+	return receipts, nil
+}
+
+// methodNotFoundMsg is what geth and nodes following it say about unknown methods, along with code -32601
+var methodNotFoundMsg = regexp.MustCompile(`^(method not found|the method \S+ does not exist/is not available)$`)
+
+// isMethodNotFound tells if node rejected the method itself, not the params,
+// errors like "block does not exist" are not taken for it
+func isMethodNotFound(err error) bool {
+	var rpcErr gethrpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+		return true
+	}
+
+	return methodNotFoundMsg.MatchString(strings.ToLower(err.Error()))
+}
@@ -5,28 +5,114 @@ import (
 	"errors"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
 	"github.com/sirupsen/logrus"
-	"github.com/thoas/go-funk"
 	"math/big"
+	"net/http"
+	"strings"
+	"time"
 )
 
+// DefaultCallTimeout bounds each request of EthBlockChainRPC unless changed by SetCallTimeout
+const DefaultCallTimeout = 30 * time.Second
+
 type EthBlockChainRPC struct {
-	rpcImpl *ethclient.Client
+	rpcImpl       *ethclient.Client
+	rawRPC        *gethrpc.Client
+	blockReceipts *blockReceiptsSupport
+
+	// ctx all requests are made with, bound by WithContext
+	ctx         context.Context
+	callTimeout time.Duration
+	limiter     *RateLimiter
 }
 
 func NewEthRPC(api string) *EthBlockChainRPC {
-	client, err := ethclient.Dial(api)
+	rpc, err := DialEthRPC(api)
 	if err != nil {
 		panic(err)
 	}
 
-	return &EthBlockChainRPC{client}
+	return rpc
+}
+
+// DialEthRPC is NewEthRPC returning the dial error instead of panicking
+func DialEthRPC(api string) (*EthBlockChainRPC, error) {
+	var client *gethrpc.Client
+	var err error
+	if strings.HasPrefix(api, "http://") || strings.HasPrefix(api, "https://") {
+		httpClient := &http.Client{Transport: &retryAfterTransport{http.DefaultTransport}}
+		client, err = gethrpc.DialHTTPWithClient(api, httpClient)
+	} else {
+		client, err = gethrpc.Dial(api)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EthBlockChainRPC{
+		rpcImpl:       ethclient.NewClient(client),
+		rawRPC:        client,
+		blockReceipts: &blockReceiptsSupport{batchSize: DefaultReceiptsBatchSize},
+		ctx:           context.Background(),
+		callTimeout:   DefaultCallTimeout,
+	}, nil
+}
+
+// SetCallTimeout bounds each request, 0 means no timeout.
+// Copies made by WithContext before the call keep the old timeout.
+func (rpc *EthBlockChainRPC) SetCallTimeout(timeout time.Duration) {
+	rpc.callTimeout = timeout
+}
+
+// SetRateLimiter makes each request wait for limiter first, nil means no limit.
+// Copies made by WithContext before the call keep the old limiter.
+func (rpc *EthBlockChainRPC) SetRateLimiter(limiter *RateLimiter) {
+	rpc.limiter = limiter
+}
+
+// WithContext returns a copy of rpc making all requests with ctx,
+// canceling ctx aborts requests in flight
+func (rpc EthBlockChainRPC) WithContext(ctx context.Context) IBlockChainRPC {
+	rpc.ctx = ctx
+	return &rpc
+}
+
+// callContext waits for the rate limiter to send count requests of JSON-RPC method,
+// then returns the context of the call, bound ctx with call timeout
+func (rpc EthBlockChainRPC) callContext(method string, count int) (context.Context, context.CancelFunc, error) {
+	ctx := rpc.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if rpc.limiter != nil {
+		if err := rpc.limiter.Wait(ctx, method, count); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if rpc.callTimeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, rpc.callTimeout)
+		return ctx, cancel, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
 }
 
 func (rpc EthBlockChainRPC) GetBlockByNum(num uint64) (*types.Block, error) {
-	block, err := rpc.rpcImpl.BlockByNumber(context.Background(), big.NewInt(int64(num)))
+	ctx, cancel, err := rpc.callContext("eth_getBlockByNumber", 1)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	block, err := rpc.rpcImpl.BlockByNumber(ctx, big.NewInt(int64(num)))
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +124,13 @@ func (rpc EthBlockChainRPC) GetBlockByNum(num uint64) (*types.Block, error) {
 }
 
 func (rpc EthBlockChainRPC) GetTransactionReceipt(txHash string) (*types.Receipt, error) {
-	receipt, err := rpc.rpcImpl.TransactionReceipt(context.Background(), common.HexToHash(txHash))
+	ctx, cancel, err := rpc.callContext("eth_getTransactionReceipt", 1)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	receipt, err := rpc.rpcImpl.TransactionReceipt(ctx, common.HexToHash(txHash))
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +142,13 @@ func (rpc EthBlockChainRPC) GetTransactionReceipt(txHash string) (*types.Receipt
 }
 
 func (rpc EthBlockChainRPC) GetTransactionByHash(txHash string) (*types.Transaction, error) {
-	transaction, _, err := rpc.rpcImpl.TransactionByHash(context.Background(), common.HexToHash(txHash))
+	ctx, cancel, err := rpc.callContext("eth_getTransactionByHash", 1)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	transaction, _, err := rpc.rpcImpl.TransactionByHash(ctx, common.HexToHash(txHash))
 	if err != nil {
 		return nil, err
 	}
@@ -61,28 +159,84 @@ func (rpc EthBlockChainRPC) GetTransactionByHash(txHash string) (*types.Transact
 }
 
 func (rpc EthBlockChainRPC) GetCurrentBlockNum() (uint64, error) {
-	num, err := rpc.rpcImpl.BlockNumber(context.Background())
+	ctx, cancel, err := rpc.callContext("eth_blockNumber", 1)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	num, err := rpc.rpcImpl.BlockNumber(ctx)
 	return num, err
 }
 
+// GetFinalizedBlockNum returns the number of the latest block that can't be reorged,
+// only supported by post-Merge nodes
+func (rpc EthBlockChainRPC) GetFinalizedBlockNum() (uint64, error) {
+	return rpc.getTaggedBlockNum("finalized")
+}
+
+// GetSafeBlockNum returns the number of the latest block unlikely to be reorged,
+// only supported by post-Merge nodes
+func (rpc EthBlockChainRPC) GetSafeBlockNum() (uint64, error) {
+	return rpc.getTaggedBlockNum("safe")
+}
+
+func (rpc EthBlockChainRPC) getTaggedBlockNum(tag string) (uint64, error) {
+	// ethclient can't encode block tags other than latest and pending
+	var head *struct {
+		Number *hexutil.Big `json:"number"`
+	}
+
+	ctx, cancel, err := rpc.callContext("eth_getBlockByNumber", 1)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	err = rpc.rawRPC.CallContext(ctx, &head, "eth_getBlockByNumber", tag, false)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil || head.Number == nil {
+		return 0, errors.New("nil " + tag + " block")
+	}
+
+	return head.Number.ToInt().Uint64(), nil
+}
+
+// SubscribeNewHead sends each new head into ch, not supported over HTTP
+func (rpc EthBlockChainRPC) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	return rpc.rpcImpl.SubscribeNewHead(ctx, ch)
+}
+
 func (rpc EthBlockChainRPC) GetLogs(
 	fromBlockNum, toBlockNum uint64,
 	address string,
 	topics []string,
 ) ([]*types.Log, error) {
+	return rpc.GetLogsWithFilter(fromBlockNum, toBlockNum, NewLogFilter(address, topics))
+}
+
+// GetLogsWithFilter gets logs of all addresses matching the whole topic matrix in one request, see ILogFilterRPC
+func (rpc EthBlockChainRPC) GetLogsWithFilter(
+	fromBlockNum, toBlockNum uint64,
+	filter LogFilter,
+) ([]*types.Log, error) {
 
 	filterParam := ethereum.FilterQuery{
 		FromBlock: big.NewInt(int64(fromBlockNum)),
 		ToBlock:   big.NewInt(int64(toBlockNum)),
-		Addresses: []common.Address{common.HexToAddress(address)},
-		Topics: [][]common.Hash{
-			funk.Map(topics, func(topic string) common.Hash {
-				return common.HexToHash(topic)
-			}).([]common.Hash),
-		},
+		Addresses: filter.Addresses,
+		Topics:    filter.Topics,
+	}
+
+	ctx, cancel, err := rpc.callContext("eth_getLogs", 1)
+	if err != nil {
+		return nil, err
 	}
+	defer cancel()
 
-	logs, err := rpc.rpcImpl.FilterLogs(context.Background(), filterParam)
+	logs, err := rpc.rpcImpl.FilterLogs(ctx, filterParam)
 	if err != nil {
 		logrus.Warnf("EthGetLogs err: %s, params: %+v", err, filterParam)
 		return nil, err
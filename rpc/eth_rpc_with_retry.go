@@ -1,85 +1,213 @@
 package rpc
 
 import (
+	"context"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 type EthBlockChainRPCWithRetry struct {
 	*EthBlockChainRPC
-	maxRetryTimes int
+	policies *retryPolicies
 }
 
+// retryPolicies is shared by copies made by WithContext
+type retryPolicies struct {
+	lock     sync.RWMutex
+	fallback RetryPolicy
+	byMethod map[string]RetryPolicy
+}
+
+// NewEthRPCWithRetry retries each call up to maxRetryCount times with NewBackoffRetryPolicy
 func NewEthRPCWithRetry(api string, maxRetryCount int) *EthBlockChainRPCWithRetry {
 	rpc := NewEthRPC(api)
 
-	return &EthBlockChainRPCWithRetry{rpc, maxRetryCount}
+	return &EthBlockChainRPCWithRetry{
+		EthBlockChainRPC: rpc,
+		policies: &retryPolicies{
+			fallback: NewBackoffRetryPolicy(maxRetryCount),
+			byMethod: make(map[string]RetryPolicy),
+		},
+	}
 }
 
-func (rpc EthBlockChainRPCWithRetry) GetBlockByNum(num uint64) (rst *types.Block, err error) {
-	for i := 0; i <= rpc.maxRetryTimes; i++ {
-		rst, err = rpc.EthBlockChainRPC.GetBlockByNum(num)
+// SetRetryPolicy sets the policy of methods without their own one
+func (rpc *EthBlockChainRPCWithRetry) SetRetryPolicy(policy RetryPolicy) {
+	rpc.policies.lock.Lock()
+	defer rpc.policies.lock.Unlock()
+
+	rpc.policies.fallback = policy
+}
+
+// SetMethodRetryPolicy sets the policy of a single method, named as in IBlockChainRPC, e.g. "GetLogs",
+// nil falls back to the policy set by SetRetryPolicy
+func (rpc *EthBlockChainRPCWithRetry) SetMethodRetryPolicy(method string, policy RetryPolicy) {
+	rpc.policies.lock.Lock()
+	defer rpc.policies.lock.Unlock()
+
+	if policy == nil {
+		delete(rpc.policies.byMethod, method)
+	} else {
+		rpc.policies.byMethod[method] = policy
+	}
+}
+
+func (p *retryPolicies) of(method string) RetryPolicy {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if policy, ok := p.byMethod[method]; ok {
+		return policy
+	}
+
+	return p.fallback
+}
+
+// WithContext returns a copy of rpc making all requests with ctx,
+// canceling ctx aborts requests in flight and the wait between retries
+func (rpc EthBlockChainRPCWithRetry) WithContext(ctx context.Context) IBlockChainRPC {
+	bound := *rpc.EthBlockChainRPC
+	bound.ctx = ctx
+
+	return &EthBlockChainRPCWithRetry{&bound, rpc.policies}
+}
+
+// retry calls fn until it succeeds or the policy of method gives up
+func (rpc EthBlockChainRPCWithRetry) retry(method string, fn func() error) error {
+	ctx := rpc.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	policy := rpc.policies.of(method)
+
+	for attempt := 0; ; attempt++ {
+		// Retry-After comes with err, see retryAfterTransport
+		err := fn()
 		if err == nil {
-			break
-		} else {
-			time.Sleep(time.Duration(500*(i+1)) * time.Millisecond)
+			return nil
+		}
+
+		wait, ok := policy.Backoff(method, attempt, err)
+		if !ok || ctx.Err() != nil {
+			return err
+		}
+
+		logrus.Debugf("%s err: %s, retry in %s", method, err, wait)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
 		}
 	}
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetBlockByNum(num uint64) (rst *types.Block, err error) {
+	err = rpc.retry("GetBlockByNum", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetBlockByNum(num)
+		return
+	})
 
 	return
 }
 
 func (rpc EthBlockChainRPCWithRetry) GetTransactionReceipt(txHash string) (rst *types.Receipt, err error) {
-	for i := 0; i <= rpc.maxRetryTimes; i++ {
+	err = rpc.retry("GetTransactionReceipt", func() (err error) {
 		rst, err = rpc.EthBlockChainRPC.GetTransactionReceipt(txHash)
-		if err == nil {
-			break
-		} else {
-			time.Sleep(time.Duration(500*(i+1)) * time.Millisecond)
-		}
-	}
+		return
+	})
+
+	return
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetTransactionReceiptsInBlock(blockHash string, txHashes []string) (rst []*types.Receipt, err error) {
+	err = rpc.retry("GetTransactionReceiptsInBlock", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetTransactionReceiptsInBlock(blockHash, txHashes)
+		return
+	})
 
 	return
 }
 
 func (rpc EthBlockChainRPCWithRetry) GetTransactionByHash(txHash string) (rst *types.Transaction, err error) {
-	for i := 0; i <= rpc.maxRetryTimes; i++ {
+	err = rpc.retry("GetTransactionByHash", func() (err error) {
 		rst, err = rpc.EthBlockChainRPC.GetTransactionByHash(txHash)
-		if err == nil {
-			break
-		} else {
-			time.Sleep(time.Duration(500*(i+1)) * time.Millisecond)
-		}
-	}
+		return
+	})
 
 	return
 }
 
 func (rpc EthBlockChainRPCWithRetry) GetCurrentBlockNum() (rst uint64, err error) {
-	for i := 0; i <= rpc.maxRetryTimes; i++ {
+	err = rpc.retry("GetCurrentBlockNum", func() (err error) {
 		rst, err = rpc.EthBlockChainRPC.GetCurrentBlockNum()
-		if err == nil {
-			break
-		} else {
-			time.Sleep(time.Duration(500*(i+1)) * time.Millisecond)
-		}
-	}
+		return
+	})
 
 	return
 }
+
+func (rpc EthBlockChainRPCWithRetry) GetFinalizedBlockNum() (rst uint64, err error) {
+	err = rpc.retry("GetFinalizedBlockNum", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetFinalizedBlockNum()
+		return
+	})
+
+	return
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetSafeBlockNum() (rst uint64, err error) {
+	err = rpc.retry("GetSafeBlockNum", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetSafeBlockNum()
+		return
+	})
+
+	return
+}
+
 func (rpc EthBlockChainRPCWithRetry) GetLogs(
 	fromBlockNum, toBlockNum uint64,
 	address string,
 	topics []string,
 ) (rst []*types.Log, err error) {
-	for i := 0; i <= rpc.maxRetryTimes; i++ {
+	err = rpc.retry("GetLogs", func() (err error) {
 		rst, err = rpc.EthBlockChainRPC.GetLogs(fromBlockNum, toBlockNum, address, topics)
-		if err == nil {
-			break
-		} else {
-			time.Sleep(time.Duration(500*(i+1)) * time.Millisecond)
-		}
-	}
+		return
+	})
+
+	return
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetLogsWithFilter(
+	fromBlockNum, toBlockNum uint64,
+	filter LogFilter,
+) (rst []*types.Log, err error) {
+	// same policy as GetLogs
+	err = rpc.retry("GetLogs", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetLogsWithFilter(fromBlockNum, toBlockNum, filter)
+		return
+	})
+
+	return
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetPendingTransactions(txHashes []string) (rst []*MempoolTx, err error) {
+	err = rpc.retry("GetPendingTransactions", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetPendingTransactions(txHashes)
+		return
+	})
+
+	return
+}
+
+func (rpc EthBlockChainRPCWithRetry) GetTxPoolContent() (rst []*MempoolTx, err error) {
+	err = rpc.retry("GetTxPoolContent", func() (err error) {
+		rst, err = rpc.EthBlockChainRPC.GetTxPoolContent()
+		return
+	})
 
 	return
 }
@@ -0,0 +1,461 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	healthEWMAWeight = 0.2
+
+	// penalties are in the unit of latency(ms), an endpoint failing every call
+	// scores as bad as one 5 secs slower, each block of head lag as 1 sec slower
+	errorRatePenalty       = 5000.0
+	headLagPenaltyPerBlock = 1000.0
+
+	// headPollWait is how long GetCurrentBlockNum waits for all endpoints before going on with the ones answered
+	headPollWait = 500 * time.Millisecond
+)
+
+// FailoverEndpoint is one node behind FailoverRPC, Name is only used in logs and stats
+type FailoverEndpoint struct {
+	Name   string
+	Client IBlockChainRPC
+}
+
+// EndpointStat is the health of an endpoint as seen by FailoverRPC, lower Score is healthier
+type EndpointStat struct {
+	Name      string
+	Latency   time.Duration
+	ErrorRate float64
+	Head      uint64
+	Score     float64
+}
+
+type endpointHealth struct {
+	FailoverEndpoint
+
+	// moving averages of call latency in ms and of failed calls
+	latency   float64
+	errorRate float64
+	head      uint64
+	// a GetCurrentBlockNum call to it is in flight
+	pollingHead bool
+}
+
+func (e *endpointHealth) score(maxHead uint64) float64 {
+	var lag uint64
+	if maxHead > e.head {
+		lag = maxHead - e.head
+	}
+
+	return e.latency + e.errorRate*errorRatePenalty + float64(lag)*headLagPenaltyPerBlock
+}
+
+// FailoverRPC spreads calls over several endpoints, each call goes to the healthiest one
+// and fails over to the others in order of health if it errors.
+// GetCurrentBlockNum asks all endpoints, so head lag is part of the health, without waiting long for slow ones.
+type FailoverRPC struct {
+	// shared with copies made by WithContext
+	lock      *sync.Mutex
+	endpoints []*endpointHealth
+
+	ctx context.Context
+}
+
+var (
+	_ IBlockChainRPC  = (*FailoverRPC)(nil)
+	_ IHeadSubscriber = (*FailoverRPC)(nil)
+)
+
+// NewFailoverRPC dials all apis, endpoints failing to dial are skipped,
+// it only returns error if none of them can be dialed
+func NewFailoverRPC(apis ...string) (*FailoverRPC, error) {
+	var endpoints []FailoverEndpoint
+	var lastErr error
+
+	for _, api := range apis {
+		client, err := DialEthRPC(api)
+		if err != nil {
+			logrus.Warnf("dial %s err: %s, skipped", api, err)
+			lastErr = err
+			continue
+		}
+
+		endpoints = append(endpoints, FailoverEndpoint{api, client})
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoint can be dialed, last err: %v", lastErr)
+	}
+
+	return NewFailoverRPCWithEndpoints(endpoints...), nil
+}
+
+// NewFailoverRPCWithEndpoints builds FailoverRPC on top of any clients, e.g. ones with retry
+func NewFailoverRPCWithEndpoints(endpoints ...FailoverEndpoint) *FailoverRPC {
+	f := &FailoverRPC{lock: &sync.Mutex{}, ctx: context.Background()}
+	for _, e := range endpoints {
+		f.endpoints = append(f.endpoints, &endpointHealth{FailoverEndpoint: e})
+	}
+
+	return f
+}
+
+// WithContext returns a copy of f making all requests with ctx, health of endpoints is shared with f.
+// Endpoints are bound to ctx too if they are IContextRPC.
+func (f *FailoverRPC) WithContext(ctx context.Context) IBlockChainRPC {
+	return &FailoverRPC{lock: f.lock, endpoints: f.endpoints, ctx: ctx}
+}
+
+// client is e's client bound to ctx of f
+func (f *FailoverRPC) client(e *endpointHealth) IBlockChainRPC {
+	return BindContext(f.ctx, e.Client)
+}
+
+// EndpointStats returns endpoints from the healthiest to the least healthy
+func (f *FailoverRPC) EndpointStats() []EndpointStat {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	maxHead := f.maxHead()
+
+	var stats []EndpointStat
+	for _, e := range f.sortedEndpoints() {
+		stats = append(stats, EndpointStat{
+			Name:      e.Name,
+			Latency:   time.Duration(e.latency * float64(time.Millisecond)),
+			ErrorRate: e.errorRate,
+			Head:      e.head,
+			Score:     e.score(maxHead),
+		})
+	}
+
+	return stats
+}
+
+// sortedEndpoints orders endpoints by score, caller holds the lock
+func (f *FailoverRPC) sortedEndpoints() []*endpointHealth {
+	maxHead := f.maxHead()
+
+	sorted := make([]*endpointHealth, len(f.endpoints))
+	copy(sorted, f.endpoints)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].score(maxHead) < sorted[j].score(maxHead)
+	})
+
+	return sorted
+}
+
+// maxHead is the highest head any endpoint reported, caller holds the lock
+func (f *FailoverRPC) maxHead() (head uint64) {
+	for _, e := range f.endpoints {
+		if e.head > head {
+			head = e.head
+		}
+	}
+
+	return
+}
+
+func (f *FailoverRPC) byHealth() []*endpointHealth {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.sortedEndpoints()
+}
+
+// record updates health of e after a call, a not found result is no failure of the endpoint,
+// a call aborted by ctx of f tells nothing about it
+func (f *FailoverRPC) record(e *endpointHealth, latency time.Duration, err error) {
+	if err != nil && f.ctx.Err() != nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ms := float64(latency) / float64(time.Millisecond)
+	e.latency = e.latency*(1-healthEWMAWeight) + ms*healthEWMAWeight
+
+	var failed float64
+	// the range is for the caller to split, other endpoints may have larger limits
+	if err != nil && !errors.Is(err, ethereum.NotFound) && !IsLogRangeTooLarge(err) {
+		failed = 1
+	}
+
+	e.errorRate = e.errorRate*(1-healthEWMAWeight) + failed*healthEWMAWeight
+}
+
+// call runs fn against endpoints from the healthiest one until it succeeds, returns the last error if all fail.
+// Endpoints fn returns ErrNoMempool for can't serve it at all, they are skipped without touching their health.
+func (f *FailoverRPC) call(method string, fn func(client IBlockChainRPC) error) (err error) {
+	for _, e := range f.byHealth() {
+		start := time.Now()
+		callErr := fn(f.client(e))
+		if errors.Is(callErr, ErrNoMempool) {
+			if err == nil {
+				err = callErr
+			}
+
+			continue
+		}
+
+		err = callErr
+		f.record(e, time.Since(start), err)
+
+		if err == nil || f.ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, ethereum.NotFound) {
+			logrus.Debugf("%s not found on %s, try next endpoint", method, e.Name)
+		} else {
+			logrus.Warnf("%s on %s err: %s, fail over to next endpoint", method, e.Name, err)
+		}
+	}
+
+	return
+}
+
+// GetCurrentBlockNum asks all endpoints at once to keep their head lag up to date, and waits up to headPollWait
+// for them: it returns the head of the healthiest endpoint answered by then, or of the first one answering after.
+// Endpoints slower than that report in the background, one still busy with the last poll isn't asked again.
+func (f *FailoverRPC) GetCurrentBlockNum() (uint64, error) {
+	type result struct {
+		e   *endpointHealth
+		num uint64
+		err error
+	}
+
+	results := make(chan result, len(f.endpoints))
+	polled := 0
+
+	for _, e := range f.endpoints {
+		f.lock.Lock()
+		busy := e.pollingHead
+		e.pollingHead = true
+		f.lock.Unlock()
+
+		if busy {
+			continue
+		}
+
+		polled++
+		go func(e *endpointHealth) {
+			start := time.Now()
+			num, err := f.client(e).GetCurrentBlockNum()
+			f.record(e, time.Since(start), err)
+
+			f.lock.Lock()
+			e.pollingHead = false
+			if err == nil {
+				e.head = num
+			}
+			f.lock.Unlock()
+
+			if err != nil {
+				logrus.Warnf("GetCurrentBlockNum on %s err: %s", e.Name, err)
+			}
+
+			results <- result{e, num, err}
+		}(e)
+	}
+
+	timer := time.NewTimer(headPollWait)
+	defer timer.Stop()
+
+	answered := make(map[*endpointHealth]result, polled)
+	var timedOut, succeeded bool
+
+	for len(answered) < polled && !(timedOut && succeeded) {
+		select {
+		case r := <-results:
+			answered[r.e] = r
+			succeeded = succeeded || r.err == nil
+		case <-timer.C:
+			timedOut = true
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+	}
+
+	lastErr := errors.New("all endpoints are busy with the last head poll")
+	for _, e := range f.byHealth() {
+		r, ok := answered[e]
+		if !ok {
+			continue
+		}
+
+		if r.err == nil {
+			return r.num, nil
+		}
+
+		lastErr = r.err
+	}
+
+	return 0, lastErr
+}
+
+func (f *FailoverRPC) GetFinalizedBlockNum() (rst uint64, err error) {
+	err = f.call("GetFinalizedBlockNum", func(client IBlockChainRPC) (err error) {
+		rst, err = GetFinalizedBlockNum(client)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetSafeBlockNum() (rst uint64, err error) {
+	err = f.call("GetSafeBlockNum", func(client IBlockChainRPC) (err error) {
+		rst, err = GetSafeBlockNum(client)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetBlockByNum(num uint64) (rst *types.Block, err error) {
+	err = f.call("GetBlockByNum", func(client IBlockChainRPC) (err error) {
+		rst, err = client.GetBlockByNum(num)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetTransactionReceipt(txHash string) (rst *types.Receipt, err error) {
+	err = f.call("GetTransactionReceipt", func(client IBlockChainRPC) (err error) {
+		rst, err = client.GetTransactionReceipt(txHash)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetTransactionReceiptsInBlock(blockHash string, txHashes []string) (rst []*types.Receipt, err error) {
+	err = f.call("GetTransactionReceiptsInBlock", func(client IBlockChainRPC) (err error) {
+		rst, err = GetTransactionReceiptsInBlock(client, blockHash, txHashes)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetLogs(from, to uint64, address string, topics []string) (rst []*types.Log, err error) {
+	err = f.call("GetLogs", func(client IBlockChainRPC) (err error) {
+		rst, err = client.GetLogs(from, to, address, topics)
+		return
+	})
+
+	return
+}
+
+func (f *FailoverRPC) GetLogsWithFilter(from, to uint64, filter LogFilter) (rst []*types.Log, err error) {
+	err = f.call("GetLogs", func(client IBlockChainRPC) (err error) {
+		rst, err = GetLogsWithFilter(client, from, to, filter)
+		return
+	})
+
+	return
+}
+
+// SubscribeNewHead subscribes on the healthiest endpoint able to push heads,
+// once it drops the watcher subscribes again and lands on the healthiest one by then
+func (f *FailoverRPC) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	err := errors.New("no endpoint can subscribe to new heads")
+
+	for _, e := range f.byHealth() {
+		subscriber, ok := f.client(e).(IHeadSubscriber)
+		if !ok {
+			continue
+		}
+
+		var sub ethereum.Subscription
+		sub, err = subscriber.SubscribeNewHead(ctx, ch)
+		if err == nil {
+			return sub, nil
+		}
+
+		logrus.Warnf("SubscribeNewHead on %s err: %s", e.Name, err)
+	}
+
+	return nil, err
+}
+
+// SubscribeFullPendingTransactions subscribes on the healthiest endpoint able to push pending txs,
+// once it drops the watcher subscribes again and lands on the healthiest one by then
+func (f *FailoverRPC) SubscribeFullPendingTransactions(ctx context.Context, ch chan<- *MempoolTx) (ethereum.Subscription, error) {
+	return f.subscribePending("SubscribeFullPendingTransactions", func(subscriber IPendingTxSubscriber) (ethereum.Subscription, error) {
+		return subscriber.SubscribeFullPendingTransactions(ctx, ch)
+	})
+}
+
+// SubscribePendingTransactions subscribes on the healthiest endpoint able to push pending txs,
+// once it drops the watcher subscribes again and lands on the healthiest one by then
+func (f *FailoverRPC) SubscribePendingTransactions(ctx context.Context, ch chan<- common.Hash) (ethereum.Subscription, error) {
+	return f.subscribePending("SubscribePendingTransactions", func(subscriber IPendingTxSubscriber) (ethereum.Subscription, error) {
+		return subscriber.SubscribePendingTransactions(ctx, ch)
+	})
+}
+
+func (f *FailoverRPC) subscribePending(method string, subscribe func(IPendingTxSubscriber) (ethereum.Subscription, error)) (ethereum.Subscription, error) {
+	err := errors.New("no endpoint can subscribe to pending txs")
+
+	for _, e := range f.byHealth() {
+		subscriber, ok := f.client(e).(IPendingTxSubscriber)
+		if !ok {
+			continue
+		}
+
+		var sub ethereum.Subscription
+		sub, err = subscribe(subscriber)
+		if err == nil {
+			return sub, nil
+		}
+
+		logrus.Warnf("%s on %s err: %s", method, e.Name, err)
+	}
+
+	return nil, err
+}
+
+// GetPendingTransactions asks the healthiest endpoint able to tell pending txs,
+// ErrNoMempool if none is an IPendingTxSubscriber
+func (f *FailoverRPC) GetPendingTransactions(txHashes []string) (rst []*MempoolTx, err error) {
+	err = f.call("GetPendingTransactions", func(client IBlockChainRPC) (err error) {
+		subscriber, ok := client.(IPendingTxSubscriber)
+		if !ok {
+			return ErrNoMempool
+		}
+
+		rst, err = subscriber.GetPendingTransactions(txHashes)
+		return
+	})
+
+	return
+}
+
+// GetTxPoolContent asks the healthiest endpoint with the txpool namespace, ErrNoMempool if none is an ITxPoolRPC
+func (f *FailoverRPC) GetTxPoolContent() (rst []*MempoolTx, err error) {
+	err = f.call("GetTxPoolContent", func(client IBlockChainRPC) (err error) {
+		poller, ok := client.(ITxPoolRPC)
+		if !ok {
+			return ErrNoMempool
+		}
+
+		rst, err = poller.GetTxPoolContent()
+		return
+	})
+
+	return
+}
@@ -0,0 +1,67 @@
+package rpc
+
+import (
+	"github.com/ethereum/go-ethereum/core/types"
+	"strings"
+)
+
+// messages of nodes and providers rejecting eth_getLogs for a too large range or result
+var logRangeTooLargeMessages = []string{
+	"returned more than", // geth, infura: query returned more than 10000 results
+	"range too large",    // block range too large
+	"range is too large", // block range is too large
+	"exceed maximum block range",
+	"response size exceeded",   // alchemy: log response size exceeded
+	"response size should not", // response size should not greater than ...
+	"too many logs",
+	"is limited to", // quicknode: eth_getLogs is limited to a 10,000 range
+	"range limit exceeded",
+}
+
+// IsLogRangeTooLarge tells if err is eth_getLogs rejected for its block range or result being too large,
+// a smaller range may succeed
+func IsLogRangeTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range logRangeTooLargeMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetLogsSplitting gets logs of block from - to, halving the range recursively while client rejects it as too large.
+// Besides logs in order, it returns the size of the largest range fetched at once.
+func GetLogsSplitting(client IBlockChainRPC, from, to uint64, filter LogFilter) ([]*types.Log, uint64, error) {
+	logs, err := GetLogsWithFilter(client, from, to, filter)
+	if err == nil {
+		return logs, to - from + 1, nil
+	}
+
+	if from >= to || !IsLogRangeTooLarge(err) {
+		return nil, 0, err
+	}
+
+	mid := from + (to-from)/2
+
+	left, leftSize, err := GetLogsSplitting(client, from, mid, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	right, rightSize, err := GetLogsSplitting(client, mid+1, to, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if rightSize > leftSize {
+		leftSize = rightSize
+	}
+
+	return append(left, right...), leftSize, nil
+}
@@ -1,12 +1,82 @@
 package rpc
 
-import "github.com/ethereum/go-ethereum/core/types"
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+)
 
+// IBlockChainRPC is the chain access the watchers depend on,
+// implemented by EthBlockChainRPC and EthBlockChainRPCWithRetry
 type IBlockChainRPC interface {
 	GetCurrentBlockNum() (uint64, error)
+	GetBlockByNum(uint64) (*types.Block, error)
+	GetTransactionReceipt(txHash string) (*types.Receipt, error)
 
-	GetBlockByNum(uint64) (types.Block, error)
-	GetTransactionReceipt(txHash string) (types.Receipt, error)
+	GetLogs(from, to uint64, address string, topics []string) ([]*types.Log, error)
+}
+
+// IHeadSubscriber is implemented by clients which can push new heads,
+// EthBlockChainRPC only succeeds when dialed over WebSocket or IPC
+type IHeadSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// ISyncTargetRPC is implemented by clients of post-Merge nodes,
+// returning the heads tagged finalized and safe
+type ISyncTargetRPC interface {
+	GetFinalizedBlockNum() (uint64, error)
+	GetSafeBlockNum() (uint64, error)
+}
+
+// ErrNoSyncTarget is returned for finalized and safe heads asked of clients without ISyncTargetRPC
+var ErrNoSyncTarget = errors.New("client can't tell finalized and safe blocks")
+
+// GetFinalizedBlockNum gets the finalized head with client's ISyncTargetRPC, ErrNoSyncTarget if it has none
+func GetFinalizedBlockNum(client IBlockChainRPC) (uint64, error) {
+	if c, ok := client.(ISyncTargetRPC); ok {
+		return c.GetFinalizedBlockNum()
+	}
+
+	return 0, ErrNoSyncTarget
+}
+
+// GetSafeBlockNum gets the safe head with client's ISyncTargetRPC, ErrNoSyncTarget if it has none
+func GetSafeBlockNum(client IBlockChainRPC) (uint64, error) {
+	if c, ok := client.(ISyncTargetRPC); ok {
+		return c.GetSafeBlockNum()
+	}
 
-	GetLogs(from, to uint64, address string, topics []string) ([]types.Log, error)
+	return 0, ErrNoSyncTarget
 }
+
+// IContextRPC is implemented by clients whose requests can be bound to a context
+type IContextRPC interface {
+	WithContext(ctx context.Context) IBlockChainRPC
+}
+
+// BindContext binds client to ctx if it's an IContextRPC, otherwise returns client as is
+func BindContext(ctx context.Context, client IBlockChainRPC) IBlockChainRPC {
+	if c, ok := client.(IContextRPC); ok {
+		return c.WithContext(ctx)
+	}
+
+	return client
+}
+
+var (
+	_ IBlockChainRPC = (*EthBlockChainRPC)(nil)
+	_ IBlockChainRPC = (*EthBlockChainRPCWithRetry)(nil)
+
+	_ IHeadSubscriber = (*EthBlockChainRPC)(nil)
+	_ IHeadSubscriber = (*EthBlockChainRPCWithRetry)(nil)
+
+	_ ISyncTargetRPC = (*EthBlockChainRPC)(nil)
+	_ ISyncTargetRPC = (*EthBlockChainRPCWithRetry)(nil)
+	_ ISyncTargetRPC = (*FailoverRPC)(nil)
+
+	_ IContextRPC = (*EthBlockChainRPC)(nil)
+	_ IContextRPC = (*EthBlockChainRPCWithRetry)(nil)
+	_ IContextRPC = (*FailoverRPC)(nil)
+)
@@ -0,0 +1,231 @@
+package rpc
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"sort"
+	"strings"
+)
+
+// LogFilter is what eth_getLogs filters logs on besides the block range
+type LogFilter struct {
+	// Addresses of contracts emitting the logs, empty for any contract
+	Addresses []common.Address
+	// Topics is the topic matrix, Topics[i] lists the hashes accepted at position i,
+	// an empty or missing position matches anything
+	Topics [][]common.Hash
+}
+
+// NewLogFilter is the filter of GetLogs, any contract if address is empty
+func NewLogFilter(address string, topics []string) LogFilter {
+	var filter LogFilter
+	if address != "" {
+		filter.Addresses = []common.Address{common.HexToAddress(address)}
+	}
+
+	filter.Topics = Topic0Filter(topics)
+
+	return filter
+}
+
+// Match tells if l passes the filter, the same way a node does for eth_getLogs
+func (f LogFilter) Match(l *types.Log) bool {
+	if len(f.Addresses) > 0 {
+		var matched bool
+		for _, a := range f.Addresses {
+			if a == l.Address {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return MatchTopics(l, f.Topics)
+}
+
+// Filter keeps logs matching the filter, in place
+func (f LogFilter) Filter(logs []*types.Log) []*types.Log {
+	matched := logs[:0]
+	for _, l := range logs {
+		if f.Match(l) {
+			matched = append(matched, l)
+		}
+	}
+
+	return matched
+}
+
+// ILogFilterRPC is implemented by clients filtering logs on many addresses and all topic positions in one request
+type ILogFilterRPC interface {
+	GetLogsWithFilter(from, to uint64, filter LogFilter) ([]*types.Log, error)
+}
+
+var (
+	_ ILogFilterRPC = (*EthBlockChainRPC)(nil)
+	_ ILogFilterRPC = (*EthBlockChainRPCWithRetry)(nil)
+	_ ILogFilterRPC = (*FailoverRPC)(nil)
+)
+
+// GetLogsWithFilter gets logs matching filter with client's ILogFilterRPC if it has one,
+// otherwise with a GetLogs on topic[0] per address and the rest filtered here
+func GetLogsWithFilter(client IBlockChainRPC, from, to uint64, filter LogFilter) ([]*types.Log, error) {
+	if c, ok := client.(ILogFilterRPC); ok {
+		return c.GetLogsWithFilter(from, to, filter)
+	}
+
+	var topic0 []string
+	if len(filter.Topics) > 0 {
+		for _, t := range filter.Topics[0] {
+			topic0 = append(topic0, t.String())
+		}
+	}
+
+	// empty address for any contract
+	addresses := []string{""}
+	if len(filter.Addresses) > 0 {
+		addresses = addresses[:0]
+		for _, a := range filter.Addresses {
+			addresses = append(addresses, a.String())
+		}
+	}
+
+	var logs []*types.Log
+	for _, address := range addresses {
+		logsOfAddress, err := client.GetLogs(from, to, address, topic0)
+		if err != nil {
+			return nil, err
+		}
+
+		logs = append(logs, logsOfAddress...)
+	}
+
+	if len(addresses) > 1 {
+		sort.SliceStable(logs, func(i, j int) bool {
+			if logs[i].BlockNumber != logs[j].BlockNumber {
+				return logs[i].BlockNumber < logs[j].BlockNumber
+			}
+
+			return logs[i].Index < logs[j].Index
+		})
+	}
+
+	return filter.Filter(logs), nil
+}
+
+// MergeLogFilters combines filters into as few as it can without matching logs of contracts none of them asks for.
+// Filters on the same addresses are merged by MergeTopics, then the ones left with the same topics by joining addresses.
+func MergeLogFilters(filters ...LogFilter) []LogFilter {
+	type group struct {
+		filter  LogFilter
+		filters []LogFilter
+	}
+
+	groupBy := func(filters []LogFilter, key func(LogFilter) string) []*group {
+		var groups []*group
+		byKey := make(map[string]*group)
+
+		for _, f := range filters {
+			k := key(f)
+
+			g, ok := byKey[k]
+			if !ok {
+				g = &group{filter: f}
+				byKey[k] = g
+				groups = append(groups, g)
+			}
+
+			g.filters = append(g.filters, f)
+		}
+
+		return groups
+	}
+
+	var byAddresses []LogFilter
+	for _, g := range groupBy(filters, func(f LogFilter) string { return addressesKey(f.Addresses) }) {
+		topics := make([][][]common.Hash, 0, len(g.filters))
+		for _, f := range g.filters {
+			topics = append(topics, f.Topics)
+		}
+
+		byAddresses = append(byAddresses, LogFilter{
+			Addresses: uniqueAddresses(g.filter.Addresses),
+			Topics:    MergeTopics(topics...),
+		})
+	}
+
+	var merged []LogFilter
+	for _, g := range groupBy(byAddresses, func(f LogFilter) string { return topicsKey(f.Topics) }) {
+		var addresses []common.Address
+		for _, f := range g.filters {
+			// any contract covers the others
+			if len(f.Addresses) == 0 {
+				addresses = nil
+				break
+			}
+
+			addresses = append(addresses, f.Addresses...)
+		}
+
+		merged = append(merged, LogFilter{
+			Addresses: uniqueAddresses(addresses),
+			Topics:    g.filter.Topics,
+		})
+	}
+
+	return merged
+}
+
+// uniqueAddresses returns addresses sorted without duplicates
+func uniqueAddresses(addresses []common.Address) []common.Address {
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	sorted := append([]common.Address(nil), addresses...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	unique := sorted[:1]
+	for _, a := range sorted[1:] {
+		if a != unique[len(unique)-1] {
+			unique = append(unique, a)
+		}
+	}
+
+	return unique
+}
+
+func addressesKey(addresses []common.Address) string {
+	var key []string
+	for _, a := range uniqueAddresses(addresses) {
+		key = append(key, a.Hex())
+	}
+
+	return strings.Join(key, ",")
+}
+
+func topicsKey(topics [][]common.Hash) string {
+	var key []string
+	for _, position := range topics {
+		var hashes []string
+		for _, t := range position {
+			hashes = append(hashes, t.Hex())
+		}
+
+		sort.Strings(hashes)
+		key = append(key, strings.Join(hashes, ","))
+	}
+
+	// trailing wildcards are implied
+	for len(key) > 0 && key[len(key)-1] == "" {
+		key = key[:len(key)-1]
+	}
+
+	return strings.Join(key, "|")
+}
@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"sync/atomic"
+)
+
+// MempoolTx is a tx waiting in the mempool, with its sender as told by the node
+type MempoolTx struct {
+	Tx   *types.Transaction
+	From common.Address
+
+	// mined already, when got by hash
+	mined bool
+}
+
+// UnmarshalJSON decodes a tx object of eth_getTransactionByHash or txpool_content
+func (t *MempoolTx) UnmarshalJSON(data []byte) error {
+	var tx types.Transaction
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return err
+	}
+
+	var extra struct {
+		From        common.Address `json:"from"`
+		BlockNumber *hexutil.Big   `json:"blockNumber"`
+	}
+
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+
+	t.Tx = &tx
+	t.From = extra.From
+	t.mined = extra.BlockNumber != nil
+
+	return nil
+}
+
+// IPendingTxSubscriber is implemented by clients which can push txs entering the mempool,
+// EthBlockChainRPC only succeeds when dialed over WebSocket or IPC
+type IPendingTxSubscriber interface {
+	// SubscribeFullPendingTransactions pushes whole txs, nodes not supporting it fail to subscribe,
+	// or push hashes only which ends the subscription
+	SubscribeFullPendingTransactions(ctx context.Context, ch chan<- *MempoolTx) (ethereum.Subscription, error)
+	// SubscribePendingTransactions pushes hashes of txs, they are looked up by GetPendingTransactions
+	SubscribePendingTransactions(ctx context.Context, ch chan<- common.Hash) (ethereum.Subscription, error)
+	// GetPendingTransactions returns txs of txHashes still in the mempool, in batches, in the order of txHashes.
+	// Txs mined or unknown to the node are left out.
+	GetPendingTransactions(txHashes []string) ([]*MempoolTx, error)
+}
+
+// ITxPoolRPC is implemented by clients of nodes with the txpool namespace enabled
+type ITxPoolRPC interface {
+	// GetTxPoolContent returns txs ready to be mined, txs queued for a nonce gap are left out
+	GetTxPoolContent() ([]*MempoolTx, error)
+}
+
+// ErrNoMempool is returned by FailoverRPC for pending txs if none of its endpoints can tell them
+var ErrNoMempool = errors.New("client can't tell pending txs")
+
+var (
+	_ IPendingTxSubscriber = (*EthBlockChainRPC)(nil)
+	_ IPendingTxSubscriber = (*EthBlockChainRPCWithRetry)(nil)
+	_ IPendingTxSubscriber = (*FailoverRPC)(nil)
+
+	_ ITxPoolRPC = (*EthBlockChainRPC)(nil)
+	_ ITxPoolRPC = (*EthBlockChainRPCWithRetry)(nil)
+	_ ITxPoolRPC = (*FailoverRPC)(nil)
+)
+
+// SubscribeFullPendingTransactions sends txs entering the mempool into ch, not supported over HTTP
+func (rpc EthBlockChainRPC) SubscribeFullPendingTransactions(ctx context.Context, ch chan<- *MempoolTx) (ethereum.Subscription, error) {
+	return rpc.rawRPC.EthSubscribe(ctx, ch, "newPendingTransactions", true)
+}
+
+// SubscribePendingTransactions sends hashes of txs entering the mempool into ch, not supported over HTTP
+func (rpc EthBlockChainRPC) SubscribePendingTransactions(ctx context.Context, ch chan<- common.Hash) (ethereum.Subscription, error) {
+	return rpc.rawRPC.EthSubscribe(ctx, ch, "newPendingTransactions")
+}
+
+// GetPendingTransactions batches eth_getTransactionByHash, as many in a batch as receipts are
+func (rpc EthBlockChainRPC) GetPendingTransactions(txHashes []string) ([]*MempoolTx, error) {
+	batchSize := int(atomic.LoadInt32(&rpc.blockReceipts.batchSize))
+	if batchSize <= 0 {
+		batchSize = DefaultReceiptsBatchSize
+	}
+
+	var pending []*MempoolTx
+
+	for from := 0; from < len(txHashes); from += batchSize {
+		to := from + batchSize
+		if to > len(txHashes) {
+			to = len(txHashes)
+		}
+
+		txs := make([]*MempoolTx, to-from)
+		batch := make([]gethrpc.BatchElem, 0, to-from)
+		for i := from; i < to; i++ {
+			batch = append(batch, gethrpc.BatchElem{
+				Method: "eth_getTransactionByHash",
+				Args:   []interface{}{common.HexToHash(txHashes[i])},
+				Result: &txs[i-from],
+			})
+		}
+
+		ctx, cancel, err := rpc.callContext("eth_getTransactionByHash", len(batch))
+		if err != nil {
+			return nil, err
+		}
+
+		err = rpc.rawRPC.BatchCallContext(ctx, batch)
+		cancel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, elem := range batch {
+			if elem.Error != nil {
+				return nil, elem.Error
+			}
+
+			if txs[i] != nil && !txs[i].mined {
+				pending = append(pending, txs[i])
+			}
+		}
+	}
+
+	return pending, nil
+}
+
+func (rpc EthBlockChainRPC) GetTxPoolContent() ([]*MempoolTx, error) {
+	ctx, cancel, err := rpc.callContext("txpool_content", 1)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	// sender -> nonce -> tx
+	var content struct {
+		Pending map[string]map[string]*MempoolTx `json:"pending"`
+	}
+
+	if err := rpc.rawRPC.CallContext(ctx, &content, "txpool_content"); err != nil {
+		return nil, err
+	}
+
+	var txs []*MempoolTx
+	for _, byNonce := range content.Pending {
+		for _, tx := range byNonce {
+			txs = append(txs, tx)
+		}
+	}
+
+	return txs, nil
+}
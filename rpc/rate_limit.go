@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket for the requests sent to a provider,
+// share one between all clients of the same provider to keep a process under its limits.
+// Each JSON-RPC request costs 1 token unless set by SetMethodCost, e.g. to the provider's compute units.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	costs  map[string]int
+}
+
+// NewRateLimiter refills tokensPerSec tokens a second, up to burst tokens, 0 tokensPerSec means no limit
+func NewRateLimiter(tokensPerSec float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:   tokensPerSec,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		costs:  make(map[string]int),
+	}
+}
+
+// SetMethodCost sets tokens a request of JSON-RPC method costs, e.g. "eth_getLogs"
+func (l *RateLimiter) SetMethodCost(method string, cost int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.costs[method] = cost
+}
+
+// Wait queues until count requests of method can be sent, callers are served in the order they come.
+// It only fails if ctx is done first.
+func (l *RateLimiter) Wait(ctx context.Context, method string, count int) error {
+	l.lock.Lock()
+
+	cost, ok := l.costs[method]
+	if !ok {
+		cost = 1
+	}
+
+	tokens := float64(cost * count)
+	if tokens <= 0 || l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	l.refill(now)
+
+	// take tokens ahead, waiting callers are in debt and later ones wait behind them
+	l.tokens -= tokens
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		l.refill(time.Now())
+		l.tokens += tokens
+		l.lock.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// refill adds tokens since last refill, caller holds the lock
+func (l *RateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+
+	l.last = now
+}
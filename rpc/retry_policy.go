@@ -0,0 +1,271 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorClass tells how a failed call should be retried
+type ErrorClass int
+
+const (
+	// ErrorRetryable is a transient failure, e.g. network error or 5xx
+	ErrorRetryable ErrorClass = iota
+	// ErrorRateLimited means the node asks to slow down, retried after a longer wait or the Retry-After hint
+	ErrorRateLimited
+	// ErrorFatal won't succeed by retrying, e.g. invalid params, block not found past the head or too large log range
+	ErrorFatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorRateLimited:
+		return "rate-limited"
+	case ErrorFatal:
+		return "fatal"
+	default:
+		return "retryable"
+	}
+}
+
+// RetryPolicy decides if and when a failed call is tried again
+type RetryPolicy interface {
+	// Backoff returns how long to wait before trying method again after attempt(from 0) failed with err,
+	// false to give up and return err
+	Backoff(method string, attempt int, err error) (time.Duration, bool)
+}
+
+// RetryAfterError carries how long a rate limiting server asked to wait
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// LaggingNodeError is a block the node doesn't know although it's at or below a head already seen,
+// e.g. a lagging backend behind a load balancer, it's retried
+type LaggingNodeError struct {
+	Err error
+}
+
+func (e *LaggingNodeError) Error() string {
+	return fmt.Sprintf("node lagging behind head: %s", e.Err)
+}
+
+func (e *LaggingNodeError) Unwrap() error {
+	return e.Err
+}
+
+// IsBlockNotFound tells if err is a block, its header or receipts unknown to the node
+func IsBlockNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ethereum.NotFound) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "header not found") || strings.Contains(msg, "unknown block")
+}
+
+// ClassifyError is the default error classification of BackoffRetryPolicy
+func ClassifyError(err error) ErrorClass {
+	var retryAfterErr *RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return ErrorRateLimited
+	}
+
+	var laggingErr *LaggingNodeError
+	if errors.As(err, &laggingErr) {
+		return ErrorRetryable
+	}
+
+	// a smaller range is needed, see GetLogsSplitting
+	if IsLogRangeTooLarge(err) {
+		return ErrorFatal
+	}
+
+	if errors.Is(err, ethereum.NotFound) || errors.Is(err, context.Canceled) {
+		return ErrorFatal
+	}
+
+	var httpErr gethrpc.HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorRateLimited
+		case httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusRequestTimeout:
+			return ErrorRetryable
+		case httpErr.StatusCode >= 400:
+			return ErrorFatal
+		}
+	}
+
+	var rpcErr gethrpc.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.ErrorCode() {
+		// parse error, invalid request, method not found, invalid params
+		case -32700, -32600, -32601, -32602:
+			return ErrorFatal
+		// limit exceeded
+		case -32005:
+			return ErrorRateLimited
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests") ||
+		strings.Contains(msg, "exceeded") && strings.Contains(msg, "limit"):
+		return ErrorRateLimited
+	case strings.Contains(msg, "header not found") || strings.Contains(msg, "unknown block") ||
+		strings.Contains(msg, "invalid argument") || strings.Contains(msg, "invalid params"):
+		return ErrorFatal
+	}
+
+	return ErrorRetryable
+}
+
+// BackoffRetryPolicy retries with exponential backoff and jitter,
+// fatal errors are never retried, rate limited ones wait for the Retry-After hint if there is one
+type BackoffRetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it, 0 - 1
+	Jitter float64
+	// Classify overrides ClassifyError
+	Classify func(err error) ErrorClass
+}
+
+// NewBackoffRetryPolicy retries up to maxRetries times, waiting 0.5s, 1s, 2s... up to 30s, with 20% jitter
+func NewBackoffRetryPolicy(maxRetries int) *BackoffRetryPolicy {
+	return &BackoffRetryPolicy{
+		MaxRetries: maxRetries,
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   30 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
+
+func (p *BackoffRetryPolicy) Backoff(method string, attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.MaxRetries {
+		return 0, false
+	}
+
+	classify := p.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+
+	switch classify(err) {
+	case ErrorFatal:
+		return 0, false
+	case ErrorRateLimited:
+		var retryAfterErr *RetryAfterError
+		if errors.As(err, &retryAfterErr) {
+			// the server knows best, even above MaxDelay
+			return retryAfterErr.RetryAfter, true
+		}
+
+		// no hint, back off one step further than for a transient error
+		return p.delay(attempt + 1), true
+	default:
+		return p.delay(attempt), true
+	}
+}
+
+func (p *BackoffRetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// retryAfterTransport fails rate limited responses with a RetryAfterError, geth's HTTPError drops headers.
+// The error is returned by the call made the request only.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return resp, nil
+	}
+
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return nil, &RetryAfterError{
+		Err:        gethrpc.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body},
+		RetryAfter: wait,
+	}
+}
+
+// parseRetryAfter reads Retry-After in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		if at.Before(now) {
+			return 0, true
+		}
+
+		return at.Sub(now), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Topic0Filter is the topic matrix matching any of topics at position 0, the filter of GetLogs
+func Topic0Filter(topics []string) [][]common.Hash {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	hashes := make([]common.Hash, 0, len(topics))
+	for _, t := range topics {
+		hashes = append(hashes, common.HexToHash(t))
+	}
+
+	return [][]common.Hash{hashes}
+}
+
+// MatchTopics tells if l passes the topic matrix, the same way a node does for eth_getLogs
+func MatchTopics(l *types.Log, topics [][]common.Hash) bool {
+	for i, accepted := range topics {
+		if len(accepted) == 0 {
+			continue
+		}
+
+		if i >= len(l.Topics) {
+			return false
+		}
+
+		var matched bool
+		for _, t := range accepted {
+			if t == l.Topics[i] {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MergeTopics returns a topic matrix matching logs matched by any of filters,
+// it may match more, e.g. {{A}, {X}} merged with {{B}, {Y}} also matches {B, X}
+func MergeTopics(filters ...[][]common.Hash) [][]common.Hash {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	width := len(filters[0])
+	for _, f := range filters {
+		if len(f) < width {
+			width = len(f)
+		}
+	}
+
+	merged := make([][]common.Hash, width)
+	for i := 0; i < width; i++ {
+		seen := make(map[common.Hash]bool)
+
+		for _, f := range filters {
+			// a wildcard in any filter makes the position a wildcard
+			if len(f[i]) == 0 {
+				seen = nil
+				break
+			}
+
+			for _, t := range f[i] {
+				if !seen[t] {
+					seen[t] = true
+					merged[i] = append(merged[i], t)
+				}
+			}
+		}
+
+		if seen == nil {
+			merged[i] = nil
+		}
+	}
+
+	// trailing wildcards are implied
+	for len(merged) > 0 && len(merged[len(merged)-1]) == 0 {
+		merged = merged[:len(merged)-1]
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+
+	return merged
+}
@@ -0,0 +1,328 @@
+package ethereum_watcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what happens to an item for a plugin whose queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room, a slow plugin slows down the others and eventually syncing
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest item in the queue, dropped items don't hold checkpoint back
+	OverflowDropOldest
+	// OverflowFail stops watcher with a *DeliveryError of ErrPluginQueueFull
+	OverflowFail
+)
+
+var (
+	ErrPluginQueueFull = errors.New("plugin queue is full")
+	ErrPluginTimeout   = errors.New("plugin timed out")
+
+	errPluginBusy = errors.New("plugin still busy with a call timed out")
+)
+
+// PluginPanicError is a panic recovered from a plugin
+type PluginPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PluginPanicError) Error() string {
+	return fmt.Sprintf("plugin panic: %v", e.Value)
+}
+
+// PluginOptions is how a plugin is run, each registered plugin has its own goroutine fed thru a queue.
+// Panics and timeouts are errors handled by the DeliveryPolicy of Register*ErrPlugin,
+// for other plugins they are logged and the item is skipped.
+type PluginOptions struct {
+	// QueueSize is the max items waiting for the plugin, at least 1
+	QueueSize int
+	// Timeout of each call to the plugin, 0 for no timeout.
+	// A call timed out is left running, the plugin gets no more item till it's back,
+	// so calls to a plugin never overlap and items keep their order.
+	Timeout  time.Duration
+	Overflow OverflowPolicy
+}
+
+// SetPluginOptions sets options of plugins registered from then on,
+// default is a queue of 256 items blocking when it's full, without timeout.
+// Options of a registered plugin are changed by PluginHandle.SetOptions.
+func (watcher *AbstractWatcher) SetPluginOptions(options PluginOptions) {
+	watcher.pluginsLock.Lock()
+	defer watcher.pluginsLock.Unlock()
+
+	watcher.pluginOptions = options
+}
+
+// SetOptions changes how the plugin is run, items queued already are kept even if more than options.QueueSize
+func (h *PluginHandle) SetOptions(options PluginOptions) {
+	h.runner.setOptions(options)
+}
+
+// dispatch is an item given to plugins, reported to deliveries once all of them are done with it
+type dispatch struct {
+	deliveries *deliveryTracker
+	blockNum   uint64
+	left       int32
+	rejected   int32
+}
+
+// newDispatch is held by the dispatcher till it has given the item to all plugins
+func (watcher *AbstractWatcher) newDispatch(blockNum uint64) *dispatch {
+	return &dispatch{deliveries: watcher.deliveries, blockNum: blockNum, left: 1}
+}
+
+func (d *dispatch) add() {
+	atomic.AddInt32(&d.left, 1)
+}
+
+func (d *dispatch) done(accepted bool) {
+	if !accepted {
+		atomic.StoreInt32(&d.rejected, 1)
+	}
+
+	// items not of a block, e.g. pending txs, don't hold checkpoint back
+	if atomic.AddInt32(&d.left, -1) == 0 && d.deliveries != nil {
+		d.deliveries.dispatched(d.blockNum, atomic.LoadInt32(&d.rejected) == 0)
+	}
+}
+
+// runPlugin has call run by runner, or right here for a plugin put into the plugin slices directly without one.
+// call returns false if the plugin failed to take care of item.
+func (watcher *AbstractWatcher) runPlugin(runner *pluginRunner, d *dispatch, item interface{}, call func(calls *pluginCalls) bool) {
+	d.add()
+
+	if runner == nil {
+		watcher.pluginsLock.RLock()
+		calls := watcher.newPluginCalls(watcher.pluginOptions.Timeout)
+		watcher.pluginsLock.RUnlock()
+
+		d.done(call(calls))
+		return
+	}
+
+	runner.push(&pluginTask{dispatch: d, item: item, call: call})
+}
+
+type pluginTask struct {
+	dispatch *dispatch
+	item     interface{}
+	call     func(calls *pluginCalls) bool
+}
+
+// pluginRunner calls a plugin in its own goroutine, started by the first item
+type pluginRunner struct {
+	deliveries *deliveryTracker
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	options PluginOptions
+	queue   []*pluginTask
+	started bool
+	closed  bool
+	closing chan struct{}
+	exited  chan struct{}
+
+	// only used by the runner goroutine
+	calls *pluginCalls
+}
+
+func (watcher *AbstractWatcher) newPluginRunner() *pluginRunner {
+	r := &pluginRunner{
+		deliveries: watcher.deliveries,
+		options:    watcher.pluginOptions,
+		closing:    make(chan struct{}),
+		exited:     make(chan struct{}),
+		calls:      watcher.newPluginCalls(0),
+	}
+	r.cond = sync.NewCond(&r.lock)
+	r.calls.closing = r.closing
+
+	return r
+}
+
+func (r *pluginRunner) setOptions(options PluginOptions) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.options = options
+	r.cond.Broadcast()
+}
+
+// push queues t, a full queue is handled by the overflow policy
+func (r *pluginRunner) push(t *pluginTask) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.started && !r.closed {
+		r.started = true
+		go r.run()
+	}
+
+	for !r.closed && len(r.queue) >= r.options.QueueSize && len(r.queue) > 0 {
+		switch r.options.Overflow {
+		case OverflowDropOldest:
+			dropped := r.queue[0]
+			r.queue[0] = nil
+			r.queue = r.queue[1:]
+
+			logrus.Warnf("plugin queue is full, drop %s of block %d", itemKind(dropped.item), dropped.dispatch.blockNum)
+			dropped.dispatch.done(true)
+		case OverflowFail:
+			r.deliveries.stop(&DeliveryError{BlockNum: t.dispatch.blockNum, Item: t.item, Err: ErrPluginQueueFull})
+			t.dispatch.done(false)
+
+			return
+		default:
+			r.cond.Wait()
+		}
+	}
+
+	// plugin is gone
+	if r.closed {
+		t.dispatch.done(true)
+		return
+	}
+
+	r.queue = append(r.queue, t)
+	r.cond.Broadcast()
+}
+
+func (r *pluginRunner) run() {
+	defer close(r.exited)
+
+	for {
+		r.lock.Lock()
+		for len(r.queue) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+
+		if len(r.queue) == 0 {
+			r.lock.Unlock()
+			return
+		}
+
+		t := r.queue[0]
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.calls.timeout = r.options.Timeout
+
+		r.cond.Broadcast()
+		r.lock.Unlock()
+
+		t.dispatch.done(t.call(r.calls))
+	}
+}
+
+// close stops runner once queued items are done, or right away dropping them if discard.
+// Items left for a plugin still busy with a call timed out are given up, not waited for.
+func (r *pluginRunner) close(discard bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.closed {
+		close(r.closing)
+	}
+
+	r.closed = true
+
+	if discard {
+		for _, t := range r.queue {
+			t.dispatch.done(true)
+		}
+
+		r.queue = nil
+	}
+
+	if !r.started {
+		r.started = true
+		close(r.exited)
+	}
+
+	r.cond.Broadcast()
+}
+
+func (r *pluginRunner) wait() {
+	<-r.exited
+}
+
+// pluginCalls calls a plugin one call at a time
+type pluginCalls struct {
+	timeout time.Duration
+	// closed once the last call timed out is back, nil if it's not left running
+	abandoned chan struct{}
+	// waiting for the abandoned call gives up once watcher is done or stopped, or the runner is closed
+	ctxDone <-chan struct{}
+	stopped <-chan struct{}
+	closing <-chan struct{}
+}
+
+func (watcher *AbstractWatcher) newPluginCalls(timeout time.Duration) *pluginCalls {
+	return &pluginCalls{timeout: timeout, ctxDone: watcher.Ctx.Done(), stopped: watcher.deliveries.stopped}
+}
+
+// call calls the plugin once the call timed out before is back,
+// a panic is returned as *PluginPanicError and a call longer than timeout as ErrPluginTimeout.
+// errPluginBusy is returned if watcher is done or stopped, or the runner closed meanwhile, the plugin isn't called then.
+// A nil c calls right away without timeout.
+func (c *pluginCalls) call(call func() error) error {
+	if c == nil {
+		return callRecovering(call)
+	}
+
+	if c.abandoned != nil {
+		select {
+		case <-c.abandoned:
+			c.abandoned = nil
+		case <-c.ctxDone:
+			return errPluginBusy
+		case <-c.stopped:
+			return errPluginBusy
+		case <-c.closing:
+			return errPluginBusy
+		}
+	}
+
+	if c.timeout <= 0 {
+		return callRecovering(call)
+	}
+
+	result := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		result <- callRecovering(call)
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		c.abandoned = finished
+		return ErrPluginTimeout
+	}
+}
+
+func callRecovering(call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PluginPanicError{Value: r, Stack: debug.Stack()}
+			logrus.Errorf("%s\n%s", panicErr, panicErr.Stack)
+
+			err = panicErr
+		}
+	}()
+
+	return call()
+}
@@ -0,0 +1,301 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPluginPanicIsolated(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	panicking := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		if b.NumberU64() == 2 {
+			panic("boom")
+		}
+
+		panicking <- b
+	}))
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	expectBlock(t, panicking, chain.Block(1), false)
+	expectBlock(t, panicking, chain.Block(3), false)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestPluginPanicDoesNotHoldCheckpoint(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetCheckpointStore(store)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		if b.NumberU64() == 2 {
+			panic("boom")
+		}
+
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	expectBlock(t, blocks, chain.Block(1), false)
+	expectBlock(t, blocks, chain.Block(3), false)
+
+	chain.AddBlock()
+	expectBlock(t, blocks, chain.Block(4), false)
+
+	waitWatcherExit(t, cancel, done)
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint == nil || checkpoint.BlockNum != 4 {
+		t.Fatalf("expect checkpoint at block 4 past the panic, got %+v", checkpoint)
+	}
+}
+
+func TestPluginTimedOutGetsNoOverlappingCall(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetPluginOptions(PluginOptions{QueueSize: 16, Timeout: 50 * time.Millisecond})
+
+	var running int32
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			t.Errorf("block %d given while the call timed out is running", b.NumberU64())
+		}
+		defer atomic.AddInt32(&running, -1)
+
+		if b.NumberU64() == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	expectBlock(t, blocks, chain.Block(1), false)
+	expectBlock(t, blocks, chain.Block(2), false)
+	expectBlock(t, blocks, chain.Block(3), false)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestRunRangeNotHeldByPluginNeverBack(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetPluginOptions(PluginOptions{QueueSize: 16, Timeout: 50 * time.Millisecond})
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		if b.NumberU64() == 1 {
+			<-stuck
+		}
+	}))
+
+	blocks := make(chan *structs.RemovableBlock, 16)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.RunRange(1, 3)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunRange held by a plugin timed out and never back")
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+}
+
+func TestRunnersExitOnRPCError(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlock(fakeTransferTx())
+
+	client := newReceiptFailingRPC(chain, chain.Block(2).Transactions()[0].Hash().String(), 1, false)
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewEthWatcher(ctx, client)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetSyncRetryPolicy(nil)
+	w.SetCheckpointStore(store)
+
+	blocks := make(chan *structs.RemovableBlock, 16)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		// still busy with block 1 when block 2 fails
+		time.Sleep(200 * time.Millisecond)
+		blocks <- b
+	}))
+	// receipts are fetched for it
+	w.RegisterTxReceiptPlugin(plugin.NewTxReceiptPlugin(func(tx *structs.RemovableTxAndReceipt) {}))
+
+	select {
+	case err := <-runFakeWatcher(t, w, 1):
+		if !errors.Is(err, errReceiptNotFound) {
+			t.Fatalf("expect %s, got %v", errReceiptNotFound, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't exit on rpc error")
+	}
+
+	for _, runner := range w.pluginRunners() {
+		select {
+		case <-runner.exited:
+		default:
+			t.Fatal("plugin runner left running")
+		}
+	}
+
+	if _, ok := <-w.NewBlockChan; ok {
+		t.Fatal("expect block chan closed")
+	}
+
+	expectBlock(t, blocks, chain.Block(1), false)
+
+	checkpoint, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint == nil || checkpoint.BlockNum != 1 {
+		t.Fatalf("expect checkpoint at block 1 saved on exit, got %+v", checkpoint)
+	}
+}
+
+func TestSlowPluginDoesNotStallOthers(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	release := make(chan struct{})
+	slow := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		<-release
+		slow <- b
+	})).SetOptions(PluginOptions{QueueSize: 1, Overflow: OverflowDropOldest})
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+	expectBlock(t, blocks, chain.Block(1), false)
+
+	for i := uint64(2); i <= 5; i++ {
+		chain.AddBlock()
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	close(release)
+
+	// block 1 is being accepted, only the newest is left in the queue
+	expectBlock(t, slow, chain.Block(1), false)
+	expectBlock(t, slow, chain.Block(5), false)
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(slow) != 0 {
+		t.Fatalf("expect blocks 2 - 4 dropped, got %d more", len(slow))
+	}
+}
+
+func TestPluginTimeoutAndOverflowStopWatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  PluginOptions
+		expected error
+	}{
+		{"timeout", PluginOptions{QueueSize: 16, Timeout: 50 * time.Millisecond}, ErrPluginTimeout},
+		{"queue full", PluginOptions{QueueSize: 1, Overflow: OverflowFail}, ErrPluginQueueFull},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			chain.AddBlocks(5)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			w := NewEthWatcher(ctx, chain)
+			w.SetSleepSecondsForNewBlock(1)
+			w.SetPluginOptions(tc.options)
+
+			stuck := make(chan struct{})
+			defer close(stuck)
+
+			w.RegisterBlockErrPlugin(plugin.NewBlockErrPlugin(func(b *structs.RemovableBlock) error {
+				<-stuck
+				return nil
+			}), StopOnError())
+
+			select {
+			case err := <-runFakeWatcher(t, w, 1):
+				if !errors.Is(err, tc.expected) {
+					t.Fatalf("expect %s, got %v", tc.expected, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("watcher didn't stop")
+			}
+		})
+	}
+}
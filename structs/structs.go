@@ -1,6 +1,9 @@
 package structs
 
-import "github.com/ethereum/go-ethereum/core/types"
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
 
 type RemovableBlock struct {
 	*types.Block
@@ -52,3 +55,42 @@ func NewRemovableTx(tx *types.Transaction, removed bool) RemovableTx {
 		removed,
 	}
 }
+
+// PendingTxStatus is what happened to a tx seen in the mempool
+type PendingTxStatus int
+
+const (
+	// PendingTxPending is a tx entering the mempool, or back to it once the block it's mined in is reorged out
+	PendingTxPending PendingTxStatus = iota
+	// PendingTxMined is a tx mined into block BlockNumber, told once the block has the confirmations set on watcher
+	PendingTxMined
+	// PendingTxReplaced is a tx replaced by ReplacedBy with the same sender and nonce, pending or mined
+	PendingTxReplaced
+	// PendingTxDropped is a tx gone from the mempool without being mined
+	PendingTxDropped
+)
+
+func (s PendingTxStatus) String() string {
+	switch s {
+	case PendingTxMined:
+		return "mined"
+	case PendingTxReplaced:
+		return "replaced"
+	case PendingTxDropped:
+		return "dropped"
+	default:
+		return "pending"
+	}
+}
+
+// PendingTx is an event of a tx seen in the mempool
+type PendingTx struct {
+	Tx     *types.Transaction
+	From   common.Address
+	Status PendingTxStatus
+
+	// BlockNumber is set with PendingTxMined
+	BlockNumber uint64
+	// ReplacedBy is set with PendingTxReplaced
+	ReplacedBy *types.Transaction
+}
@@ -0,0 +1,49 @@
+package ethereum_watcher
+
+import (
+	"ethereum-watcher/rpc"
+)
+
+// SyncTarget decides which head a watcher syncs up to
+type SyncTarget int
+
+const (
+	// SyncToLatestBlock follows the newest block, reorgs are handled by the watcher
+	SyncToLatestBlock SyncTarget = iota
+	// SyncToSafeBlock follows the block tagged safe by post-Merge nodes
+	SyncToSafeBlock
+	// SyncToFinalizedBlock follows the block tagged finalized by post-Merge nodes,
+	// plugins only see blocks which can't be reorged
+	SyncToFinalizedBlock
+)
+
+func (t SyncTarget) String() string {
+	switch t {
+	case SyncToSafeBlock:
+		return "safe"
+	case SyncToFinalizedBlock:
+		return "finalized"
+	default:
+		return "latest"
+	}
+}
+
+func getSyncTargetBlockNum(rpcClient rpc.IBlockChainRPC, target SyncTarget) (uint64, error) {
+	switch target {
+	case SyncToSafeBlock:
+		return rpc.GetSafeBlockNum(rpcClient)
+	case SyncToFinalizedBlock:
+		return rpc.GetFinalizedBlockNum(rpcClient)
+	default:
+		return rpcClient.GetCurrentBlockNum()
+	}
+}
+
+// SetSyncTarget makes watcher sync up to the safe or finalized block instead of the latest one,
+// only for chains with post-Merge finality and rpc implementing rpc.ISyncTargetRPC, watcher exits with
+// rpc.ErrNoSyncTarget otherwise.
+// The target is watcher-wide: all plugins of a watcher share one synced chain, checkpoint and reorg handling,
+// so plugins wanting the latest blocks and ones wanting final blocks only go to two watchers sharing rpc.
+func (watcher *AbstractWatcher) SetSyncTarget(target SyncTarget) {
+	watcher.syncTarget = target
+}
@@ -0,0 +1,117 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"errors"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/core/types"
+	"testing"
+	"time"
+)
+
+func TestAbstractWatcherSyncToFinalizedBlock(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+	chain.SetFinalized(6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+	w.SetSyncTarget(SyncToFinalizedBlock)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 6; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+	expectNoBlock(t, blocks, 1500*time.Millisecond)
+
+	chain.SetFinalized(8)
+	expectBlock(t, blocks, chain.Block(7), false)
+	expectBlock(t, blocks, chain.Block(8), false)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+// latestOnlyRPC hides rpc.ISyncTargetRPC of the chain
+type latestOnlyRPC struct {
+	rpc.IBlockChainRPC
+}
+
+func TestSyncTargetWithoutSyncTargetRPC(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+
+	w := NewEthWatcher(context.Background(), latestOnlyRPC{chain})
+	w.SetSyncTarget(SyncToFinalizedBlock)
+
+	done := runFakeWatcher(t, w, 1)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, rpc.ErrNoSyncTarget) {
+			t.Fatalf("expect ErrNoSyncTarget, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't exit")
+	}
+}
+
+func TestReceiptLogWatcherSyncToSafeBlock(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(3)
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlocks(2)
+	chain.AddBlock(fakeTransferTx())
+	chain.SetSafe(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var to int
+	var numOfLogs int
+	handler := func(from, blockTo int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+		to = blockTo
+		numOfLogs += len(receiptLogs)
+
+		if isUpToHighestBlock {
+			cancel()
+		}
+
+		return nil
+	}
+
+	w := NewReceiptLogWatcherWithRPC(ctx, chain, 1, fakeContract.String(), []string{fakeTopic.String()}, handler,
+		ReceiptLogWatcherConfig{
+			IntervalForPollingNewBlockInSec: 1,
+			ReturnForBlockWithNoReceiptLog:  true,
+			SyncTarget:                      SyncToSafeBlock,
+		},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returns err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiptLogWatcher didn't reach safe block")
+	}
+
+	if to != 5 || numOfLogs != 1 {
+		t.Fatalf("expect 1 log up to block 5, got %d logs up to %d", numOfLogs, to)
+	}
+}
@@ -0,0 +1,224 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/rpc"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"testing"
+	"time"
+)
+
+var (
+	fakeSender  = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	fakeDeposit = []common.Address{
+		common.HexToAddress("0x2222222222222222222222222222222222222222"),
+		common.HexToAddress("0x3333333333333333333333333333333333333333"),
+	}
+	fakeOther = common.HexToAddress("0x4444444444444444444444444444444444444444")
+)
+
+func fakeTransferToTx(to common.Address) fakechain.Tx {
+	return fakechain.Tx{
+		To: fakeContract,
+		Logs: []*types.Log{{
+			Address: fakeContract,
+			Topics:  []common.Hash{fakeTopic, common.BytesToHash(fakeSender.Bytes()), common.BytesToHash(to.Bytes())},
+		}},
+	}
+}
+
+// depositTopics matches transfers to any of fakeDeposit
+func depositTopics() [][]common.Hash {
+	var deposits []common.Hash
+	for _, d := range fakeDeposit {
+		deposits = append(deposits, common.BytesToHash(d.Bytes()))
+	}
+
+	return [][]common.Hash{{fakeTopic}, nil, deposits}
+}
+
+// topic0OnlyRPC hides GetLogsWithFilter of the client, like a custom client with GetLogs only
+type topic0OnlyRPC struct {
+	rpc.IBlockChainRPC
+}
+
+func TestMatchAndMergeTopics(t *testing.T) {
+	a, b, x, y := common.HexToHash("0xa"), common.HexToHash("0xb"), common.HexToHash("0x1"), common.HexToHash("0x2")
+
+	l := &types.Log{Topics: []common.Hash{a, x}}
+
+	cases := []struct {
+		topics   [][]common.Hash
+		expected bool
+	}{
+		{nil, true},
+		{[][]common.Hash{{a}}, true},
+		{[][]common.Hash{{b}}, false},
+		{[][]common.Hash{nil, {y, x}}, true},
+		{[][]common.Hash{{a}, {y}}, false},
+		{[][]common.Hash{{a}, nil, nil}, true},
+		{[][]common.Hash{{a}, nil, {x}}, false},
+	}
+
+	for i, c := range cases {
+		if rpc.MatchTopics(l, c.topics) != c.expected {
+			t.Errorf("case %d: expect %t for %v", i, c.expected, c.topics)
+		}
+	}
+
+	merged := rpc.MergeTopics([][]common.Hash{{a}, {x}}, [][]common.Hash{{b, a}, {y}})
+	if len(merged) != 2 || len(merged[0]) != 2 || len(merged[1]) != 2 {
+		t.Fatalf("expect {{a, b}, {x, y}}, got %v", merged)
+	}
+
+	if merged := rpc.MergeTopics([][]common.Hash{{a}, {x}}, [][]common.Hash{{b}}); len(merged) != 1 || len(merged[0]) != 2 {
+		t.Fatalf("expect {{a, b}}, got %v", merged)
+	}
+
+	if merged := rpc.MergeTopics([][]common.Hash{{a}, {x}}, nil); merged != nil {
+		t.Fatalf("expect wildcard, got %v", merged)
+	}
+}
+
+func TestReceiptLogPluginWithoutTopics(t *testing.T) {
+	l := &structs.RemovableReceiptLog{Log: &types.Log{Address: fakeContract, Topics: []common.Hash{fakeTopic}}}
+
+	cases := []struct {
+		name     string
+		plugin   *plugin.ReceiptLogPlugin
+		expected bool
+	}{
+		{"nil topics", plugin.NewReceiptLogPlugin(fakeContract.String(), nil, nil), false},
+		{"empty topics", plugin.NewReceiptLogPlugin(fakeContract.String(), []string{}, nil), false},
+		{"topic", plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()}, nil), true},
+		{"any topic thru filter", plugin.NewReceiptLogPluginWithFilter(rpc.NewLogFilter(fakeContract.String(), nil), nil), true},
+		{"any topic thru topic matrix", plugin.NewReceiptLogPluginWithTopics(fakeContract.String(), nil, nil), true},
+	}
+
+	for _, c := range cases {
+		if got := c.plugin.NeedReceiptLog(l); got != c.expected {
+			t.Errorf("%s: expect %t, got %t", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestReceiptLogWatcherWithTopicMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client func(chain *fakechain.Chain) rpc.IBlockChainRPC
+	}{
+		{"server side", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return chain }},
+		{"client side", func(chain *fakechain.Chain) rpc.IBlockChainRPC { return topic0OnlyRPC{chain} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := fakechain.New()
+			chain.AddBlock(fakeTransferToTx(fakeDeposit[0]), fakeTransferToTx(fakeOther))
+			chain.AddBlock(fakeTransferToTx(fakeOther))
+			chain.AddBlock(fakeTransferToTx(fakeDeposit[1]), fakeTransferTx())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var logs []*types.Log
+			handler := func(from, to int, receiptLogs []*types.Log, isUpToHighestBlock bool) error {
+				logs = append(logs, receiptLogs...)
+
+				if isUpToHighestBlock {
+					cancel()
+				}
+
+				return nil
+			}
+
+			w := NewReceiptLogWatcherWithRPC(ctx, tc.client(chain), 1, fakeContract.String(), nil, handler,
+				ReceiptLogWatcherConfig{
+					IntervalForPollingNewBlockInSec: 1,
+					ReturnForBlockWithNoReceiptLog:  true,
+					Topics:                          depositTopics(),
+				},
+			)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- w.Run()
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run returns err: %s", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ReceiptLogWatcher didn't reach highest block")
+			}
+
+			if len(logs) != 2 {
+				t.Fatalf("expect 2 deposit logs, got %d", len(logs))
+			}
+
+			for i, l := range logs {
+				if l.Topics[2] != common.BytesToHash(fakeDeposit[i].Bytes()) {
+					t.Fatalf("log %d: expect transfer to %s, got %s", i, fakeDeposit[i], l.Topics[2])
+				}
+			}
+		})
+	}
+}
+
+func TestReceiptLogPluginsWithTopicMatrix(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	deposits := make(chan *structs.RemovableReceiptLog, 16)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPluginWithTopics(fakeContract.String(), depositTopics(),
+		func(l *structs.RemovableReceiptLog) {
+			deposits <- l
+		},
+	))
+
+	transfers := make(chan *structs.RemovableReceiptLog, 16)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			transfers <- l
+		},
+	))
+
+	done := runFakeWatcher(t, w, 1)
+
+	chain.AddBlock(fakeTransferToTx(fakeOther), fakeTransferToTx(fakeDeposit[1]))
+	chain.AddBlock(fakeTransferTx())
+
+	receiveLog := func(ch chan *structs.RemovableReceiptLog) *structs.RemovableReceiptLog {
+		t.Helper()
+
+		select {
+		case l := <-ch:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("no receipt log received")
+			return nil
+		}
+	}
+
+	if l := receiveLog(deposits); l.Log.Topics[2] != common.BytesToHash(fakeDeposit[1].Bytes()) {
+		t.Fatalf("unexpected deposit log: %+v", l.Log)
+	}
+
+	for i := 0; i < 3; i++ {
+		receiveLog(transfers)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(deposits) != 0 {
+		t.Fatalf("expect only 1 deposit log, got %d more", len(deposits))
+	}
+}
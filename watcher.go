@@ -3,19 +3,23 @@ package ethereum_watcher
 import (
 	"container/list"
 	"context"
-	"errors"
 	"ethereum-watcher/plugin"
 	"ethereum-watcher/rpc"
 	"ethereum-watcher/structs"
 	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
+	"sort"
 	"sync"
 	"time"
 )
 
+// receiptLogsBigStep is the max blocks to get receipt logs of at once while catching up
+const receiptLogsBigStep = 50
+
 type AbstractWatcher struct {
-	rpc *rpc.EthBlockChainRPCWithRetry
+	rpc rpc.IBlockChainRPC
 
 	Ctx  context.Context
 	lock sync.RWMutex
@@ -26,50 +30,132 @@ type AbstractWatcher struct {
 
 	SyncedBlocks         *list.List
 	SyncedTxAndReceipts  *list.List
+	SyncedReceiptLogs    *list.List
 	MaxSyncedBlockToKeep int
 
+	// plugins registered, change them thru Register*Plugin and PluginHandle while running
 	BlockPlugins      []plugin.IBlockPlugin
 	TxPlugins         []plugin.ITxPlugin
 	TxReceiptPlugins  []plugin.ITxReceiptPlugin
 	ReceiptLogPlugins []plugin.IReceiptLogPlugin
+	PendingTxPlugins  []plugin.IPendingTxPlugin
+	pluginsLock       sync.RWMutex
+	// runners of registered plugins, index by index with the plugins
+	blockPluginRunners      []*pluginRunner
+	txPluginRunners         []*pluginRunner
+	txReceiptPluginRunners  []*pluginRunner
+	receiptLogPluginRunners []*pluginRunner
+	pendingTxPluginRunners  []*pluginRunner
+	pluginOptions           PluginOptions
+	// log plugins waiting for their backfill before going live
+	pendingBackfills []*logBackfill
+	// items sent to the channels but not dispatched to plugins yet
+	itemsInFlight sync.WaitGroup
+	deliveries    *deliveryTracker
 
 	ReceiptCatchUpFromBlock uint64
+	// blocks to get receipt logs of at once while catching up
+	logStep logRangeStep
 
 	sleepSecondsForNewBlock int
 	wg                      sync.WaitGroup
+
+	subscribeNewHeads bool
+	newHeads          *newHeadNotifier
+
+	prefetcher *blockPrefetcher
+
+	// pending txs for PendingTxPlugins, see SetMempoolOptions
+	mempoolOptions MempoolOptions
+	mempool        *mempoolWatcher
+
+	// blocks further than liveDistance behind the head are caught up in steps of logs by catchUpWorkers, see SetCatchUp
+	liveDistance   uint64
+	catchUpWorkers int
+	// plugins are told watcher is within liveDistance of the head
+	live bool
+	// a block is fetched again along with its receipts under it if any of them failed
+	syncRetryPolicy rpc.RetryPolicy
+
+	checkpointStore CheckpointStore
+
+	deepReorgPolicy      DeepReorgPolicy
+	deepReorgResyncRange uint64
+	deepReorgCallback    func(event *DeepReorgEvent)
+	checkpointBlocks     []BlockRef
+	// blocks cleaned from SyncedBlocks before plugins accepted them, checkpointed later
+	uncheckpointedBlocks []BlockRef
+
+	// inRange is set by RunRange, which stops at rangeEnd instead of following the head
+	inRange  bool
+	rangeEnd uint64
+	// items sent to plugins, only touched by the sync loop
+	rangeSummary RangeSummary
+
+	syncTarget            SyncTarget
+	confirmations         uint64
+	unconfirmedBlocks     *list.List
+	lastConfirmedBlockNum uint64
 }
 
+// DefaultSyncRetries is how many times a block is fetched again before watcher gives up on it
+const DefaultSyncRetries = 3
+
 func NewHttpBasedEthWatcher(ctx context.Context, api string) *AbstractWatcher {
 	rpcWithRetry := rpc.NewEthRPCWithRetry(api, 5)
 
+	return NewEthWatcher(ctx, rpcWithRetry)
+}
+
+// NewWsBasedEthWatcher creates a watcher woken up by newHeads pushed over WebSocket,
+// it polls every sleepSecondsForNewBlock while the subscription is down
+func NewWsBasedEthWatcher(ctx context.Context, wsAPI string) *AbstractWatcher {
+	watcher := NewHttpBasedEthWatcher(ctx, wsAPI)
+	watcher.SetSubscribeNewHeads(true)
+
+	return watcher
+}
+
+// NewEthWatcher creates a watcher on top of any IBlockChainRPC implementation,
+// e.g. a custom client, a test double or an instrumented wrapper.
+// Requests are made with ctx if rpcClient is an rpc.IContextRPC, so canceling ctx aborts them.
+func NewEthWatcher(ctx context.Context, rpcClient rpc.IBlockChainRPC) *AbstractWatcher {
 	return &AbstractWatcher{
 		Ctx:                     ctx,
-		rpc:                     rpcWithRetry,
+		rpc:                     rpc.BindContext(ctx, rpcClient),
 		NewBlockChan:            make(chan *structs.RemovableBlock, 32),
 		NewTxAndReceiptChan:     make(chan *structs.RemovableTxAndReceipt, 518),
 		NewReceiptLogChan:       make(chan *structs.RemovableReceiptLog, 518),
 		SyncedBlocks:            list.New(),
 		SyncedTxAndReceipts:     list.New(),
+		logStep:                 logRangeStep{max: receiptLogsBigStep},
+		SyncedReceiptLogs:       list.New(),
 		MaxSyncedBlockToKeep:    64,
+		unconfirmedBlocks:       list.New(),
+		deliveries:              newDeliveryTracker(),
+		pluginOptions:           PluginOptions{QueueSize: 256},
+		syncRetryPolicy:         rpc.NewBackoffRetryPolicy(DefaultSyncRetries),
 		sleepSecondsForNewBlock: 5,
 		wg:                      sync.WaitGroup{},
 	}
 }
 
-func (watcher *AbstractWatcher) RegisterBlockPlugin(plugin plugin.IBlockPlugin) {
-	watcher.BlockPlugins = append(watcher.BlockPlugins, plugin)
-}
-
-func (watcher *AbstractWatcher) RegisterTxPlugin(plugin plugin.ITxPlugin) {
-	watcher.TxPlugins = append(watcher.TxPlugins, plugin)
+// SetSubscribeNewHeads makes watcher wait for new heads pushed by rpc instead of sleeping,
+// rpc has to implement rpc.IHeadSubscriber
+func (watcher *AbstractWatcher) SetSubscribeNewHeads(subscribe bool) {
+	watcher.subscribeNewHeads = subscribe
 }
 
-func (watcher *AbstractWatcher) RegisterTxReceiptPlugin(plugin plugin.ITxReceiptPlugin) {
-	watcher.TxReceiptPlugins = append(watcher.TxReceiptPlugins, plugin)
+// SetCheckpointStore makes watcher persist its progress into store,
+// and resume from it instead of the start block when run again. RunRange leaves store alone.
+func (watcher *AbstractWatcher) SetCheckpointStore(store CheckpointStore) {
+	watcher.checkpointStore = store
 }
 
-func (watcher *AbstractWatcher) RegisterReceiptLogPlugin(plugin plugin.IReceiptLogPlugin) {
-	watcher.ReceiptLogPlugins = append(watcher.ReceiptLogPlugins, plugin)
+// SetSyncRetryPolicy sets how a block is fetched again, along with all its receipts, after fetching it or any of them failed,
+// nil makes watcher exit on the first failure. Default is rpc.NewBackoffRetryPolicy(DefaultSyncRetries).
+func (watcher *AbstractWatcher) SetSyncRetryPolicy(policy rpc.RetryPolicy) {
+	watcher.syncRetryPolicy = policy
 }
 
 // RunTillExit start sync from the latest block
@@ -84,23 +170,37 @@ func (watcher *AbstractWatcher) RunTillExitFromBlock(startBlockNum uint64) error
 	watcher.wg.Add(1)
 	go func() {
 		for block := range watcher.NewBlockChan {
+			block := block
+			d := watcher.newDispatch(block.NumberU64())
+
 			// run through block plugins
-			for i := 0; i < len(watcher.BlockPlugins); i++ {
-				blockPlugin := watcher.BlockPlugins[i]
+			blockPlugins, runners := watcher.blockPlugins()
+			for i := 0; i < len(blockPlugins); i++ {
+				blockPlugin := blockPlugins[i]
 
-				blockPlugin.AcceptBlock(block)
+				watcher.runPlugin(runners[i], d, block, func(calls *pluginCalls) bool {
+					return watcher.acceptBlock(blockPlugin, block, calls)
+				})
 			}
 
 			// run thru tx plugins
-			txPlugins := watcher.TxPlugins
+			txPlugins, runners := watcher.txPlugins()
 			for i := 0; i < len(txPlugins); i++ {
 				txPlugin := txPlugins[i]
 
-				for j := 0; j < len(block.Transactions()); j++ {
-					tx := structs.NewRemovableTx(block.Transactions()[j], false)
-					txPlugin.AcceptTx(tx)
-				}
+				watcher.runPlugin(runners[i], d, block, func(calls *pluginCalls) bool {
+					accepted := true
+					for j := 0; j < len(block.Transactions()); j++ {
+						tx := structs.NewRemovableTx(block.Transactions()[j], false)
+						accepted = watcher.acceptTx(txPlugin, tx, block.NumberU64(), calls) && accepted
+					}
+
+					return accepted
+				})
 			}
+
+			d.done(true)
+			watcher.itemsInFlight.Done()
 		}
 
 		watcher.wg.Done()
@@ -109,20 +209,27 @@ func (watcher *AbstractWatcher) RunTillExitFromBlock(startBlockNum uint64) error
 	watcher.wg.Add(1)
 	go func() {
 		for removableTxAndReceipt := range watcher.NewTxAndReceiptChan {
+			removableTxAndReceipt := removableTxAndReceipt
+			d := watcher.newDispatch(removableTxAndReceipt.Receipt.BlockNumber.Uint64())
 
-			txReceiptPlugins := watcher.TxReceiptPlugins
+			txReceiptPlugins, runners := watcher.txReceiptPlugins()
 			for i := 0; i < len(txReceiptPlugins); i++ {
 				txReceiptPlugin := txReceiptPlugins[i]
 
-				if p, ok := txReceiptPlugin.(*plugin.TxReceiptPluginWithFilter); ok {
+				if p, ok := txReceiptPlugin.(plugin.ITxReceiptFilterPlugin); ok {
 					// for filter plugin, only feed receipt it wants
-					if p.NeedReceipt(removableTxAndReceipt.Tx) {
-						txReceiptPlugin.Accept(removableTxAndReceipt)
+					if !p.NeedReceipt(removableTxAndReceipt.Tx) {
+						continue
 					}
-				} else {
-					txReceiptPlugin.Accept(removableTxAndReceipt)
 				}
+
+				watcher.runPlugin(runners[i], d, removableTxAndReceipt, func(calls *pluginCalls) bool {
+					return watcher.acceptTxAndReceipt(txReceiptPlugin, removableTxAndReceipt, calls)
+				})
 			}
+
+			d.done(true)
+			watcher.itemsInFlight.Done()
 		}
 
 		watcher.wg.Done()
@@ -133,98 +240,273 @@ func (watcher *AbstractWatcher) RunTillExitFromBlock(startBlockNum uint64) error
 		for removableReceiptLog := range watcher.NewReceiptLogChan {
 			logrus.Debugf("get receipt log from chan: %+v, txHash: %s", removableReceiptLog, removableReceiptLog.Log.TxHash.String())
 
-			receiptLogsPlugins := watcher.ReceiptLogPlugins
+			removableReceiptLog := removableReceiptLog
+			d := watcher.newDispatch(removableReceiptLog.Log.BlockNumber)
+
+			receiptLogsPlugins, runners := watcher.receiptLogPlugins()
 			for i := 0; i < len(receiptLogsPlugins); i++ {
 				p := receiptLogsPlugins[i]
 
 				if p.NeedReceiptLog(removableReceiptLog) {
 					logrus.Debugln("receipt log accepted")
-					p.Accept(removableReceiptLog)
+					watcher.runPlugin(runners[i], d, removableReceiptLog, func(calls *pluginCalls) bool {
+						return watcher.acceptReceiptLog(p, removableReceiptLog, calls)
+					})
 				} else {
 					logrus.Debugln("receipt log not accepted")
 				}
 			}
+
+			d.done(true)
+			watcher.itemsInFlight.Done()
 		}
 
 		watcher.wg.Done()
 	}()
 
+	watcher.startMempool()
+	// plugins are done with items sent and checkpoint is saved however watcher exits
+	defer closeWatcher(watcher)
+
+	err := watcher.syncTillExit(startBlockNum)
+	if deliveryErr := watcher.deliveries.error(); deliveryErr != nil && err == deliveryErr {
+		// a plugin failed to accept an item, no more is delivered
+		return err
+	}
+
+	if err != nil && watcher.Ctx.Err() != nil {
+		// a request aborted by shutdown
+		logrus.Infof("watcher context down while syncing: %s", err)
+
+		return nil
+	}
+
+	return err
+}
+
+// syncTillExit syncs blocks from startBlockNum until Ctx is done
+func (watcher *AbstractWatcher) syncTillExit(startBlockNum uint64) error {
+	if err := watcher.resumeFromCheckpoint(); err != nil {
+		return err
+	}
+
+	if watcher.subscribeNewHeads {
+		watcher.newHeads = newNewHeadNotifier(watcher.Ctx, watcher.rpc)
+		defer watcher.newHeads.close()
+	}
+
+	// waiting for new blocks ends when a plugin stops watcher too
+	waitCtx, cancelWait := context.WithCancel(watcher.Ctx)
+	defer cancelWait()
+
+	go func() {
+		select {
+		case <-watcher.deliveries.stopped:
+			cancelWait()
+		case <-waitCtx.Done():
+		}
+	}()
+
 	for {
-		latestBlockNum, err := watcher.rpc.GetCurrentBlockNum()
+		if err := watcher.deliveries.error(); err != nil {
+			return err
+		}
+
+		latestBlockNum, err := getSyncTargetBlockNum(watcher.rpc, watcher.syncTarget)
 		if err != nil {
 			return err
 		}
 
-		if startBlockNum <= 0 {
+		// a range starts at its first block, even block 0
+		if startBlockNum <= 0 && !watcher.inRange {
 			startBlockNum = latestBlockNum
 		}
 
-		noNewBlockForSync := watcher.LatestSyncedBlockNum() >= latestBlockNum
+		headBlockNum := latestBlockNum
+		if watcher.inRange && watcher.rangeEnd < latestBlockNum {
+			latestBlockNum = watcher.rangeEnd
+		}
+
+		if err := watcher.runBackfills(startBlockNum); err != nil {
+			return err
+		}
+
+		// plugins may have caught up since the last block
+		if err := watcher.saveCheckpointLocked(); err != nil {
+			return err
+		}
+
+		if watcher.inRange && watcher.syncedTo(watcher.rangeEnd) {
+			// blocks of the range still held are confirmed by the head, not the range end
+			watcher.lock.Lock()
+			watcher.releaseConfirmedBlocks(headBlockNum)
+			watcher.lock.Unlock()
+
+			if watcher.rangeDone() {
+				return nil
+			}
+		}
+
+		watcher.checkLive(headBlockNum)
+
+		noNewBlockForSync := watcher.syncedTo(latestBlockNum)
 		logrus.Debugln("watcher.LatestSyncedBlockNum()", watcher.LatestSyncedBlockNum())
 
 		if noNewBlockForSync {
-			logrus.Debugf("no new block to sync, sleep for %d secs", watcher.sleepSecondsForNewBlock)
+			logrus.Debugf("no new block to sync, wait for new head up to %d secs", watcher.sleepSecondsForNewBlock)
+
+			if !watcher.newHeads.wait(waitCtx, time.Duration(watcher.sleepSecondsForNewBlock)*time.Second) {
+				if err := watcher.deliveries.error(); err != nil {
+					return err
+				}
 
-			// sleep for 3 secs
-			select {
-			case <-watcher.Ctx.Done():
-				closeWatcher(watcher)
 				return nil
-			case <-time.After(time.Duration(watcher.sleepSecondsForNewBlock) * time.Second):
-				continue
 			}
+
+			continue
 		}
 
-		for watcher.LatestSyncedBlockNum() < latestBlockNum {
+		for !watcher.syncedTo(latestBlockNum) {
 			select {
 			case <-watcher.Ctx.Done():
 				logrus.Info("watcher context down, closing channels to exit...")
-				closeWatcher(watcher)
-				logrus.Info("watcher done!")
 
 				return nil
+			case <-watcher.deliveries.stopped:
+				return watcher.deliveries.error()
 			default:
-				var newBlockNumToSync uint64
-				if watcher.LatestSyncedBlockNum() <= 0 {
-					newBlockNumToSync = startBlockNum
-				} else {
-					newBlockNumToSync = watcher.LatestSyncedBlockNum() + 1
-				}
-
-				logrus.Debugln("newBlockNumToSync:", newBlockNumToSync)
-
-				newBlock, err := watcher.rpc.GetBlockByNum(newBlockNumToSync)
-				if err != nil {
+				if err := watcher.runBackfills(startBlockNum); err != nil {
 					return err
 				}
 
-				if newBlock == nil {
-					msg := fmt.Sprintf("GetBlockByNum(%d) returns nil block", newBlockNumToSync)
-					return errors.New(msg)
+				newBlockNumToSync := startBlockNum
+				if watcher.syncedTo(0) {
+					newBlockNumToSync = watcher.LatestSyncedBlockNum() + 1
 				}
 
-				if watcher.FoundFork(newBlock) {
-					logrus.Infoln("found fork, popping")
-					err = watcher.popBlocksUntilReachMainChain()
+				logrus.Debugln("newBlockNumToSync:", newBlockNumToSync)
+
+				if till := watcher.catchUpTill(newBlockNumToSync, headBlockNum, latestBlockNum); till != 0 {
+					err = watcher.retrySync(waitCtx, newBlockNumToSync, func() error {
+						return watcher.catchUp(waitCtx, newBlockNumToSync, till)
+					})
 				} else {
-					logrus.Debugln("adding new block:", newBlock.Number())
-					err = watcher.addNewBlock(structs.NewRemovableBlock(newBlock, false), latestBlockNum)
+					err = watcher.syncBlock(waitCtx, newBlockNumToSync, latestBlockNum)
 				}
 
 				if err != nil {
+					// a plugin stopping watcher cuts retries short
+					if deliveryErr := watcher.deliveries.error(); deliveryErr != nil {
+						return deliveryErr
+					}
+
 					return err
 				}
+
+				watcher.checkLive(headBlockNum)
 			}
 		}
 	}
 }
 
+// syncBlock adds block num, or pops blocks if it's on a fork.
+// Block and receipts are fetched again as a whole under syncRetryPolicy if any of them failed.
+func (watcher *AbstractWatcher) syncBlock(ctx context.Context, num, head uint64) error {
+	var (
+		fetched  *prefetchedBlock
+		forked   bool
+		txs      []*types.Transaction
+		receipts []*types.Receipt
+	)
+
+	err := watcher.retrySync(ctx, num, func() (err error) {
+		fetched, err = watcher.fetchBlock(num, head)
+		if err != nil {
+			return err
+		}
+
+		if forked = watcher.FoundFork(fetched.block); forked {
+			return nil
+		}
+
+		txs, receipts, err = watcher.getReceipts(ctx, fetched.block, fetched.receipts)
+		if err != nil {
+			return fmt.Errorf("get receipts of block %d err: %w", num, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !forked {
+		logrus.Debugln("adding new block:", num)
+		return watcher.addNewBlock(structs.NewRemovableBlock(fetched.block, false), head, txs, receipts)
+	}
+
+	logrus.Infoln("found fork, popping")
+
+	deepReorg, err := watcher.popBlocksUntilReachMainChain()
+	if err == nil && deepReorg != nil {
+		err = watcher.handleDeepReorg(deepReorg)
+	}
+
+	return err
+}
+
+// retrySync calls fetch till it succeeds, under syncRetryPolicy.
+// Blocks synced are at or below the head seen, so one not found is a lagging node and retried.
+func (watcher *AbstractWatcher) retrySync(ctx context.Context, num uint64, fetch func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil || watcher.syncRetryPolicy == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if rpc.IsBlockNotFound(err) {
+			err = &rpc.LaggingNodeError{Err: err}
+		}
+
+		wait, retry := watcher.syncRetryPolicy.Backoff("SyncBlock", attempt, err)
+		if !retry {
+			return err
+		}
+
+		logrus.Warnf("sync block %d err, retry in %s: %s", num, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// closeWatcher waits for plugins to be done with items sent and saves checkpoint
 func closeWatcher(w *AbstractWatcher) {
+	w.mempool.stop()
+
 	close(w.NewBlockChan)
 	close(w.NewTxAndReceiptChan)
 	close(w.NewReceiptLogChan)
 
 	w.wg.Wait()
+
+	for _, runner := range w.pluginRunners() {
+		runner.close(false)
+		runner.wait()
+	}
+
+	// plugins are done with all items sent
+	if err := w.saveCheckpointLocked(); err != nil {
+		logrus.Warnf("save checkpoint err: %s", err)
+	}
+
+	logrus.Info("watcher done!")
 }
 
 func (watcher *AbstractWatcher) SetSleepSecondsForNewBlock(sec int) {
@@ -244,14 +526,26 @@ func (watcher *AbstractWatcher) LatestSyncedBlockNum() uint64 {
 	return b.Number().Uint64()
 }
 
+// syncedTo tells if blocks up to num are synced, syncedTo(0) if any block is
+func (watcher *AbstractWatcher) syncedTo(num uint64) bool {
+	watcher.lock.RLock()
+	defer watcher.lock.RUnlock()
+
+	if watcher.SyncedBlocks.Len() <= 0 {
+		return false
+	}
+
+	return watcher.SyncedBlocks.Back().Value.(*types.Block).NumberU64() >= num
+}
+
 // go thru plugins to check if this watcher need fetch receipt for tx
 // network load for fetching receipts per tx is heavy,
 // we use this method to make sure we only do the work we need
 func (watcher *AbstractWatcher) needReceipt(tx *types.Transaction) bool {
-	plugins := watcher.TxReceiptPlugins
+	plugins, _ := watcher.txReceiptPlugins()
 
 	for _, p := range plugins {
-		if filterPlugin, ok := p.(plugin.TxReceiptPluginWithFilter); ok {
+		if filterPlugin, ok := p.(plugin.ITxReceiptFilterPlugin); ok {
 			if filterPlugin.NeedReceipt(tx) {
 				return true
 			}
@@ -265,82 +559,36 @@ func (watcher *AbstractWatcher) needReceipt(tx *types.Transaction) bool {
 }
 
 // return query map: contractAddress -> interested 1stTopics
-func (watcher *AbstractWatcher) getReceiptLogQueryMap() (queryMap map[string][]string) {
-	queryMap = make(map[string][]string, 16)
+// getReceiptLogFilters returns filters to get logs of all plugins with in as few requests as it can,
+// each plugin picks its own logs out by NeedReceiptLog
+func (watcher *AbstractWatcher) getReceiptLogFilters() []rpc.LogFilter {
+	plugins, _ := watcher.receiptLogPlugins()
 
-	for _, p := range watcher.ReceiptLogPlugins {
-		key := p.FromContract()
-
-		if v, exist := queryMap[key]; exist {
-			queryMap[key] = append(v, p.InterestedTopics()...)
-		} else {
-			queryMap[key] = p.InterestedTopics()
-		}
+	filters := make([]rpc.LogFilter, 0, len(plugins))
+	for _, p := range plugins {
+		filters = append(filters, plugin.LogFilterOf(p))
 	}
 
-	return
+	return rpc.MergeLogFilters(filters...)
 }
 
-func (watcher *AbstractWatcher) addNewBlock(block *structs.RemovableBlock, curHighestBlockNum uint64) error {
+// addNewBlock syncs block with receipts of txs in it watcher needs, fetched by getReceipts
+func (watcher *AbstractWatcher) addNewBlock(block *structs.RemovableBlock, curHighestBlockNum uint64, txs []*types.Transaction, receipts []*types.Receipt) error {
 	watcher.lock.Lock()
 	defer watcher.lock.Unlock()
 
-	// get tx receipts in block, which is time-consuming
-	signals := make([]*SyncSignal, 0, len(block.Transactions()))
-	for i := 0; i < len(block.Transactions()); i++ {
-		tx := block.Transactions()[i]
-
-		if !watcher.needReceipt(tx) {
-			//logrus.Debugf("no need to get receipt of tx(%s), skipped", tx.GetHash())
-			continue
-		} else {
-			logrus.Debugf("needReceipt of tx: %s in block: %d", tx.Hash(), block.Number())
-		}
-
-		syncSigName := fmt.Sprintf("B:%d T:%s", block.Number(), tx.Hash())
-
-		sig := newSyncSignal(syncSigName)
-		signals = append(signals, sig)
-
-		go func() {
-			txReceipt, err := watcher.rpc.GetTransactionReceipt(tx.Hash().String())
-
-			if err != nil {
-				fmt.Printf("GetTransactionReceipt fail, err: %s", err)
-				sig.err = err
-
-				// one fails all
-				return
-			}
-
-			sig.WaitPermission()
-
-			sig.rst = structs.NewRemovableTxAndReceipt(tx, txReceipt, false, block.Time())
-
-			sig.Done()
-		}()
-	}
-
-	for i := 0; i < len(signals); i++ {
-		sig := signals[i]
-		sig.Permit()
-		sig.WaitDone()
-
-		if sig.err != nil {
-			return sig.err
-		}
-	}
+	for i, receipt := range receipts {
+		txAndReceipt := structs.NewRemovableTxAndReceipt(txs[i], receipt, false, block.Time())
 
-	for i := 0; i < len(signals); i++ {
-		watcher.SyncedTxAndReceipts.PushBack(signals[i].rst.TxAndReceipt)
-		watcher.NewTxAndReceiptChan <- signals[i].rst
+		watcher.SyncedTxAndReceipts.PushBack(txAndReceipt.TxAndReceipt)
+		watcher.deliverTxAndReceipt(txAndReceipt)
 	}
 
-	queryMap := watcher.getReceiptLogQueryMap()
-	logrus.Debugln("getReceiptLogQueryMap:", queryMap)
+	logFilters := watcher.getReceiptLogFilters()
+	logrus.Debugln("getReceiptLogFilters:", logFilters)
 
-	bigStep := uint64(50)
-	if curHighestBlockNum-block.Number().Uint64() > bigStep {
+	bigStep := uint64(watcher.logStep.size())
+	if distance := curHighestBlockNum - block.Number().Uint64(); distance > bigStep && distance > watcher.liveDistance {
 		// only do request with bigStep
 		if watcher.ReceiptCatchUpFromBlock == 0 {
 			// init
@@ -348,17 +596,15 @@ func (watcher *AbstractWatcher) addNewBlock(block *structs.RemovableBlock, curHi
 			watcher.ReceiptCatchUpFromBlock = block.Number().Uint64()
 		} else {
 			// check if we need do requests
-			if (block.Number().Uint64() - watcher.ReceiptCatchUpFromBlock + 1) == bigStep {
+			if (block.Number().Uint64() - watcher.ReceiptCatchUpFromBlock + 1) >= bigStep {
 				fromBlock := watcher.ReceiptCatchUpFromBlock
 				toBlock := block.Number()
 
 				logrus.Debugf("bigStep, doing request, range: %d -> %d (minus: %d)", fromBlock, toBlock, block.Number().Uint64()-watcher.ReceiptCatchUpFromBlock)
 
-				for k, v := range queryMap {
-					err := watcher.fetchReceiptLogs(false, fromBlock, toBlock.Uint64(), k, v)
-					if err != nil {
-						return err
-					}
+				err := watcher.fetchReceiptLogs(false, fromBlock, toBlock.Uint64(), logFilters)
+				if err != nil {
+					return err
 				}
 
 				// update catch up block
@@ -371,21 +617,43 @@ func (watcher *AbstractWatcher) addNewBlock(block *structs.RemovableBlock, curHi
 		// reset
 		if watcher.ReceiptCatchUpFromBlock != 0 {
 			logrus.Debugf("exit bigStep mode, ReceiptCatchUpFromBlock: %d, curBlock: %d, gap: %d", watcher.ReceiptCatchUpFromBlock, block.Number(), curHighestBlockNum-block.Number().Uint64())
+
+			// blocks held in bigStep mode still need their logs
+			if watcher.ReceiptCatchUpFromBlock < block.Number().Uint64() {
+				err := watcher.fetchReceiptLogs(false, watcher.ReceiptCatchUpFromBlock, block.Number().Uint64()-1, logFilters)
+				if err != nil {
+					return err
+				}
+			}
+
 			watcher.ReceiptCatchUpFromBlock = 0
 		}
 
-		for k, v := range queryMap {
-			err := watcher.fetchReceiptLogs(block.IsRemoved, block.Number().Uint64(), block.Number().Uint64(), k, v)
-			if err != nil {
-				return err
-			}
+		err := watcher.fetchReceiptLogs(block.IsRemoved, block.Number().Uint64(), block.Number().Uint64(), logFilters)
+		if err != nil {
+			return err
 		}
 	}
 
-	// clean synced data
+	watcher.trimSyncedBlocks()
+
+	// block
+	watcher.SyncedBlocks.PushBack(block.Block)
+	watcher.deliverBlock(block)
+	watcher.releaseConfirmedBlocks(curHighestBlockNum)
+
+	return watcher.saveCheckpoint()
+}
+
+// trimSyncedBlocks cleans synced data to make room for a new block, caller holds the lock
+func (watcher *AbstractWatcher) trimSyncedBlocks() {
 	for watcher.SyncedBlocks.Len() >= watcher.MaxSyncedBlockToKeep {
 		// clean block
-		b := watcher.SyncedBlocks.Remove(watcher.SyncedBlocks.Front()).(types.Block)
+		b := watcher.SyncedBlocks.Remove(watcher.SyncedBlocks.Front()).(*types.Block)
+
+		if n := len(watcher.checkpointBlocks); watcher.checkpointStore != nil && (n == 0 || watcher.checkpointBlocks[n-1].Num < b.NumberU64()) {
+			watcher.uncheckpointedBlocks = append(watcher.uncheckpointedBlocks, BlockRef{b.NumberU64(), b.Hash()})
+		}
 
 		// clean txAndReceipt
 		for watcher.SyncedTxAndReceipts.Front() != nil {
@@ -397,87 +665,267 @@ func (watcher *AbstractWatcher) addNewBlock(block *structs.RemovableBlock, curHi
 				break
 			}
 		}
-	}
 
-	// block
-	watcher.SyncedBlocks.PushBack(block.Block)
-	watcher.NewBlockChan <- block
+		// clean receiptLog
+		for watcher.SyncedReceiptLogs.Front() != nil {
+			head := watcher.SyncedReceiptLogs.Front()
 
-	return nil
+			if head.Value.(*types.Log).BlockNumber <= b.Number().Uint64() {
+				watcher.SyncedReceiptLogs.Remove(head)
+			} else {
+				break
+			}
+		}
+	}
 }
 
-func (watcher *AbstractWatcher) fetchReceiptLogs(isRemoved bool, from, to uint64, address string, topics []string) error {
+// getReceipts returns txs in block watcher needs receipts of, and their receipts in order,
+// from prefetchedReceipts if all of them are there. Fetching them is canceled with ctx or on the first failure.
+func (watcher *AbstractWatcher) getReceipts(ctx context.Context, block *types.Block, prefetchedReceipts map[common.Hash]*types.Receipt) ([]*types.Transaction, []*types.Receipt, error) {
+	var txs []*types.Transaction
+	for _, tx := range block.Transactions() {
+		if watcher.needReceipt(tx) {
+			logrus.Debugf("needReceipt of tx: %s in block: %d", tx.Hash(), block.Number())
+			txs = append(txs, tx)
+		}
+	}
+
+	if len(txs) == 0 {
+		return nil, nil, nil
+	}
+
+	receipts := make([]*types.Receipt, 0, len(txs))
+	txHashes := make([]string, 0, len(txs))
+	for _, tx := range txs {
+		if receipt, ok := prefetchedReceipts[tx.Hash()]; ok {
+			receipts = append(receipts, receipt)
+		}
+
+		txHashes = append(txHashes, tx.Hash().String())
+	}
+
+	if len(receipts) == len(txs) {
+		return txs, receipts, nil
+	}
 
-	receiptLogs, err := watcher.rpc.GetLogs(from, to, address, topics)
+	receipts, err := rpc.GetTransactionReceiptsInBlockContext(ctx, watcher.rpc, block.Hash().String(), txHashes)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	for i := 0; i < len(receiptLogs); i++ {
-		log := receiptLogs[i]
-		logrus.Debugln("insert into chan: ", log.TxHash.String())
+	return txs, receipts, nil
+}
 
-		watcher.NewReceiptLogChan <- &structs.RemovableReceiptLog{
-			Log:       log,
-			IsRemoved: isRemoved,
+// saveCheckpoint persists synced blocks whose receipt logs are all delivered, caller holds the lock
+func (watcher *AbstractWatcher) saveCheckpoint() error {
+	if watcher.checkpointStore == nil || watcher.inRange {
+		return nil
+	}
+
+	// in bigStep mode, logs of blocks since ReceiptCatchUpFromBlock are not fetched yet
+	var pendingFrom uint64
+	if plugins, _ := watcher.receiptLogPlugins(); len(plugins) > 0 {
+		pendingFrom = watcher.ReceiptCatchUpFromBlock
+	}
+
+	// blocks waiting for confirmations are not delivered yet
+	if unconfirmed := watcher.firstUnconfirmedBlockNum(); unconfirmed != 0 && (pendingFrom == 0 || unconfirmed < pendingFrom) {
+		pendingFrom = unconfirmed
+	}
+
+	// items sent are not accepted by all plugins yet
+	if undelivered := watcher.deliveries.firstPending(); undelivered != 0 && (pendingFrom == 0 || undelivered < pendingFrom) {
+		pendingFrom = undelivered
+	}
+
+	refs := make([]BlockRef, 0, len(watcher.uncheckpointedBlocks)+watcher.SyncedBlocks.Len())
+	for _, ref := range watcher.uncheckpointedBlocks {
+		if pendingFrom != 0 && ref.Num >= pendingFrom {
+			break
 		}
+
+		refs = append(refs, ref)
 	}
 
-	return nil
+	watcher.uncheckpointedBlocks = watcher.uncheckpointedBlocks[len(refs):]
+
+	for e := watcher.SyncedBlocks.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*types.Block)
+
+		if pendingFrom != 0 && b.NumberU64() >= pendingFrom {
+			break
+		}
+
+		refs = append(refs, BlockRef{b.NumberU64(), b.Hash()})
+	}
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	// nothing new since last save
+	if n := len(watcher.checkpointBlocks); n > 0 && watcher.checkpointBlocks[n-1] == refs[len(refs)-1] {
+		return nil
+	}
+
+	watcher.checkpointBlocks = appendBlockRefs(watcher.checkpointBlocks, refs...)
+
+	return watcher.checkpointStore.Save(newCheckpoint(watcher.checkpointBlocks))
 }
 
-type SyncSignal struct {
-	name       string
-	permission chan bool
-	jobDone    chan bool
-	rst        *structs.RemovableTxAndReceipt
-	err        error
+func (watcher *AbstractWatcher) saveCheckpointLocked() error {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	return watcher.saveCheckpoint()
 }
 
-func newSyncSignal(name string) *SyncSignal {
-	return &SyncSignal{
-		name:       name,
-		permission: make(chan bool, 1),
-		jobDone:    make(chan bool, 1),
+// resumeFromCheckpoint restores the last synced block from checkpoint store,
+// rewinding to the last checkpoint block still on chain if the chain reorged while watcher was down
+func (watcher *AbstractWatcher) resumeFromCheckpoint() error {
+	if watcher.checkpointStore == nil || watcher.inRange || watcher.syncedTo(0) {
+		return nil
 	}
-}
 
-func (s *SyncSignal) Permit() {
-	s.permission <- true
+	checkpoint, err := watcher.checkpointStore.Load()
+	if err != nil || checkpoint == nil || len(checkpoint.RecentBlocks) == 0 {
+		return err
+	}
+
+	block, err := findLastCanonicalBlock(watcher.rpc, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if block.NumberU64() != checkpoint.BlockNum {
+		logrus.Warnf("checkpoint block %d(%s) is not on chain any more, resume from block %d(%s)",
+			checkpoint.BlockNum, checkpoint.BlockHash, block.Number(), block.Hash())
+	} else {
+		logrus.Infof("resume from checkpoint block %d(%s)", block.Number(), block.Hash())
+	}
+
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	watcher.SyncedBlocks.PushBack(block)
+	watcher.checkpointBlocks = truncateBlockRefs(checkpoint.RecentBlocks, block.NumberU64())
+
+	return nil
 }
 
-func (s *SyncSignal) WaitPermission() {
-	<-s.permission
+// fetchReceiptLogs gets logs of block from - to with each of filters and delivers them in order
+func (watcher *AbstractWatcher) fetchReceiptLogs(isRemoved bool, from, to uint64, filters []rpc.LogFilter) error {
+	receiptLogs, span, err := getReceiptLogs(watcher.rpc, from, to, filters)
+	if err != nil {
+		return err
+	}
+
+	if len(filters) > 0 {
+		watcher.logStep.fetched(int(to-from+1), int(span))
+	}
+
+	watcher.deliverReceiptLogs(isRemoved, receiptLogs)
+
+	return nil
 }
 
-func (s *SyncSignal) Done() {
-	s.jobDone <- true
+// getReceiptLogs gets logs of block from - to with each of filters in order, a log matched by more than one filter is returned once.
+// Besides logs, it returns the size of the largest range fetched at once by all filters.
+func getReceiptLogs(client rpc.IBlockChainRPC, from, to uint64, filters []rpc.LogFilter) ([]*types.Log, uint64, error) {
+	type logKey struct {
+		block common.Hash
+		index uint
+	}
+
+	var receiptLogs []*types.Log
+	seen := make(map[logKey]bool)
+	span := to - from + 1
+
+	for _, filter := range filters {
+		logs, filterSpan, err := rpc.GetLogsSplitting(client, from, to, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if filterSpan < span {
+			span = filterSpan
+		}
+
+		for _, l := range logs {
+			key := logKey{l.BlockHash, l.Index}
+			if !seen[key] {
+				seen[key] = true
+				receiptLogs = append(receiptLogs, l)
+			}
+		}
+	}
+
+	if len(filters) > 1 {
+		sort.SliceStable(receiptLogs, func(i, j int) bool {
+			if receiptLogs[i].BlockNumber != receiptLogs[j].BlockNumber {
+				return receiptLogs[i].BlockNumber < receiptLogs[j].BlockNumber
+			}
+
+			return receiptLogs[i].Index < receiptLogs[j].Index
+		})
+	}
+
+	return receiptLogs, span, nil
 }
 
-func (s *SyncSignal) WaitDone() {
-	<-s.jobDone
+// deliverReceiptLogs delivers logs in order, caller holds the lock
+func (watcher *AbstractWatcher) deliverReceiptLogs(isRemoved bool, receiptLogs []*types.Log) {
+	for i := 0; i < len(receiptLogs); i++ {
+		log := receiptLogs[i]
+		logrus.Debugln("insert into chan: ", log.TxHash.String())
+
+		if !isRemoved {
+			watcher.SyncedReceiptLogs.PushBack(log)
+		}
+
+		watcher.deliverReceiptLog(&structs.RemovableReceiptLog{
+			Log:       log,
+			IsRemoved: isRemoved,
+		})
+	}
 }
 
-func (watcher *AbstractWatcher) popBlocksUntilReachMainChain() error {
+// popBlocksUntilReachMainChain withdraws synced blocks not on chain any more,
+// returns a DeepReorgEvent if all synced blocks are popped before reaching the main chain
+func (watcher *AbstractWatcher) popBlocksUntilReachMainChain() (*DeepReorgEvent, error) {
 	watcher.lock.Lock()
 	defer watcher.lock.Unlock()
 
+	var lowestPopped, highestPopped *types.Block
+
 	for {
 		if watcher.SyncedBlocks.Back() == nil {
-			return nil
+			if lowestPopped == nil {
+				return nil, watcher.saveCheckpoint()
+			}
+
+			return watcher.checkBelowSyncedBlocks(lowestPopped, highestPopped)
 		}
 
 		// NOTE: instead of watcher.LatestSyncedBlockNum() cuz it has lock
-		lastSyncedBlock := watcher.SyncedBlocks.Back().Value.(types.Block)
+		lastSyncedBlock := watcher.SyncedBlocks.Back().Value.(*types.Block)
 		block, err := watcher.rpc.GetBlockByNum(lastSyncedBlock.Number().Uint64())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if block.Hash() != lastSyncedBlock.Hash() {
 			fmt.Println("removing tail block:", watcher.SyncedBlocks.Back())
 			removedBlock := watcher.SyncedBlocks.Remove(watcher.SyncedBlocks.Back()).(*types.Block)
 
+			lowestPopped = removedBlock
+			if highestPopped == nil {
+				highestPopped = removedBlock
+			}
+
+			// block still waiting for confirmations is never seen by plugins, nothing to withdraw
+			delivered := !watcher.dropUnconfirmedBlock(removedBlock.NumberU64())
+
 			for watcher.SyncedTxAndReceipts.Back() != nil {
 
 				tail := watcher.SyncedTxAndReceipts.Back()
@@ -486,16 +934,43 @@ func (watcher *AbstractWatcher) popBlocksUntilReachMainChain() error {
 					fmt.Printf("removing tail txAndReceipt: %+v", tail.Value)
 					tuple := watcher.SyncedTxAndReceipts.Remove(tail).(*structs.TxAndReceipt)
 
-					watcher.NewTxAndReceiptChan <- structs.NewRemovableTxAndReceipt(tuple.Tx, tuple.Receipt, true, block.Time())
+					if delivered {
+						watcher.sendTxAndReceipt(structs.NewRemovableTxAndReceipt(tuple.Tx, tuple.Receipt, true, block.Time()))
+					}
 				} else {
 					fmt.Printf("all txAndReceipts removed for block: %+v", removedBlock)
 					break
 				}
 			}
 
-			watcher.NewBlockChan <- structs.NewRemovableBlock(removedBlock, true)
+			// withdraw logs of the block, latest delivered first.
+			// logs fetched by range are not strictly sorted by block, so go thru all of them
+			for e := watcher.SyncedReceiptLogs.Back(); e != nil; {
+				prev := e.Prev()
+
+				if log := e.Value.(*types.Log); log.BlockNumber == removedBlock.NumberU64() {
+					watcher.SyncedReceiptLogs.Remove(e)
+
+					if delivered {
+						removedLog := *log
+						removedLog.Removed = true
+
+						watcher.sendReceiptLog(&structs.RemovableReceiptLog{
+							Log:       &removedLog,
+							IsRemoved: true,
+						})
+					}
+				}
+
+				e = prev
+			}
+
+			if delivered {
+				watcher.sendBlock(structs.NewRemovableBlock(removedBlock, true))
+				watcher.mempool.reorged(removedBlock)
+			}
 		} else {
-			return nil
+			return nil, watcher.saveCheckpoint()
 		}
 	}
 }
@@ -0,0 +1,209 @@
+package ethereum_watcher
+
+import (
+	"context"
+	"ethereum-watcher/fakechain"
+	"ethereum-watcher/plugin"
+	"ethereum-watcher/structs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"testing"
+	"time"
+)
+
+var (
+	fakeContract = common.HexToAddress("0x63bB8a255a8c045122EFf28B3093Cc225B711F6D")
+	fakeTopic    = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+)
+
+func fakeTransferTx() fakechain.Tx {
+	return fakechain.Tx{
+		To:   fakeContract,
+		Logs: []*types.Log{{Address: fakeContract, Topics: []common.Hash{fakeTopic}}},
+	}
+}
+
+func runFakeWatcher(t *testing.T, w *AbstractWatcher, startBlockNum uint64) <-chan error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.RunTillExitFromBlock(startBlockNum)
+	}()
+
+	return done
+}
+
+func waitWatcherExit(t *testing.T, cancel context.CancelFunc, done <-chan error) {
+	t.Helper()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("watcher exit with err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't exit after ctx canceled")
+	}
+}
+
+func receiveBlock(t *testing.T, blocks <-chan *structs.RemovableBlock) *structs.RemovableBlock {
+	t.Helper()
+
+	select {
+	case b := <-blocks:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for block")
+		return nil
+	}
+}
+
+func expectBlock(t *testing.T, blocks <-chan *structs.RemovableBlock, expected *types.Block, isRemoved bool) {
+	t.Helper()
+
+	b := receiveBlock(t, blocks)
+	if b.Hash() != expected.Hash() || b.IsRemoved != isRemoved {
+		t.Fatalf("expect block %d(%s, removed: %t), got %d(%s, removed: %t)",
+			expected.NumberU64(), expected.Hash(), isRemoved, b.NumberU64(), b.Hash(), b.IsRemoved)
+	}
+}
+
+func TestRunTillExitFromBlockWithFakeChain(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 3)
+
+	for i := uint64(3); i <= 10; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	chain.AddBlocks(2)
+	expectBlock(t, blocks, chain.Block(11), false)
+	expectBlock(t, blocks, chain.Block(12), false)
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestAbstractWatcherPopsForkedBlocks(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 10; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	orphaned := []*types.Block{chain.Block(9), chain.Block(10)}
+	chain.Reorg(2, nil, nil, nil)
+
+	expectBlock(t, blocks, orphaned[1], true)
+	expectBlock(t, blocks, orphaned[0], true)
+
+	for i := uint64(9); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+}
+
+func TestFoundFork(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(5)
+
+	w := NewEthWatcher(context.Background(), chain)
+	for i := uint64(1); i <= 5; i++ {
+		w.SyncedBlocks.PushBack(chain.Block(i))
+	}
+
+	chain.AddBlock()
+	if w.FoundFork(chain.Block(6)) {
+		t.Fatal("child of synced tip shouldn't be a fork")
+	}
+
+	chain.Reorg(2, nil, nil)
+	if !w.FoundFork(chain.Block(6)) {
+		t.Fatal("block on another branch should be a fork")
+	}
+}
+
+func TestTxReceiptAndReceiptLogPluginsWithFakeChain(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(2)
+	chain.AddBlock(fakechain.Tx{To: common.HexToAddress("0x01")}, fakeTransferTx())
+	chain.AddBlocks(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	receipts := make(chan *structs.RemovableTxAndReceipt, 64)
+	w.RegisterTxReceiptPlugin(plugin.NewTxReceiptPluginWithFilter(
+		func(r *structs.RemovableTxAndReceipt) {
+			receipts <- r
+		},
+		func(tx *types.Transaction) bool {
+			return *tx.To() == fakeContract
+		},
+	))
+
+	receiptLogs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			receiptLogs <- l
+		},
+	))
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	for i := uint64(1); i <= 5; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(receipts) != 1 {
+		t.Fatalf("expect 1 filtered receipt, got %d", len(receipts))
+	}
+
+	r := <-receipts
+	if r.Receipt.TxHash != chain.Block(3).Transactions()[1].Hash() || r.IsRemoved {
+		t.Fatalf("unexpected receipt: %+v", r.Receipt)
+	}
+
+	if len(receiptLogs) != 1 {
+		t.Fatalf("expect 1 receipt log, got %d", len(receiptLogs))
+	}
+
+	l := <-receiptLogs
+	if l.Log.BlockNumber != 3 || l.Log.Topics[0] != fakeTopic || l.IsRemoved {
+		t.Fatalf("unexpected receipt log: %+v", l.Log)
+	}
+}
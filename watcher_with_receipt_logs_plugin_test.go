@@ -2,12 +2,15 @@ package ethereum_watcher
 
 import (
 	"context"
+	"ethereum-watcher/fakechain"
 	"ethereum-watcher/plugin"
 	"ethereum-watcher/structs"
 	"ethereum-watcher/utils"
 	"fmt"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
 	"testing"
+	"time"
 )
 
 func TestReceiptLogsPlugin(t *testing.T) {
@@ -33,3 +36,73 @@ func TestReceiptLogsPlugin(t *testing.T) {
 
 	fmt.Println("err:", err)
 }
+
+func TestReceiptLogsPluginWithdrawsLogsOfForkedBlocks(t *testing.T) {
+	chain := fakechain.New()
+	chain.AddBlocks(7)
+	chain.AddBlock(fakeTransferTx())
+	chain.AddBlock(fakeTransferTx(), fakeTransferTx())
+	chain.AddBlock(fakeTransferTx())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewEthWatcher(ctx, chain)
+	w.SetSleepSecondsForNewBlock(1)
+
+	receiptLogs := make(chan *structs.RemovableReceiptLog, 64)
+	w.RegisterReceiptLogPlugin(plugin.NewReceiptLogPlugin(fakeContract.String(), []string{fakeTopic.String()},
+		func(l *structs.RemovableReceiptLog) {
+			receiptLogs <- l
+		},
+	))
+
+	blocks := make(chan *structs.RemovableBlock, 64)
+	w.RegisterBlockPlugin(plugin.NewSimpleBlockPlugin(func(b *structs.RemovableBlock) {
+		blocks <- b
+	}))
+
+	done := runFakeWatcher(t, w, 1)
+
+	receiveLog := func() *structs.RemovableReceiptLog {
+		select {
+		case l := <-receiptLogs:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for receipt log")
+			return nil
+		}
+	}
+
+	var delivered []*types.Log
+	for i := 0; i < 4; i++ {
+		delivered = append(delivered, receiveLog().Log)
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	// block 9 and 10 are orphaned, the new branch has no logs
+	orphaned := []*types.Block{chain.Block(9), chain.Block(10)}
+	chain.Reorg(2, nil, nil, nil)
+
+	for i := 3; i >= 1; i-- {
+		l := receiveLog()
+
+		if !l.IsRemoved || !l.Log.Removed || l.Log.TxHash != delivered[i].TxHash || l.Log.Index != delivered[i].Index {
+			t.Fatalf("expect removed log %d of tx %s, got %+v", delivered[i].Index, delivered[i].TxHash, l)
+		}
+	}
+
+	expectBlock(t, blocks, orphaned[1], true)
+	expectBlock(t, blocks, orphaned[0], true)
+
+	for i := uint64(9); i <= 11; i++ {
+		expectBlock(t, blocks, chain.Block(i), false)
+	}
+
+	waitWatcherExit(t, cancel, done)
+
+	if len(receiptLogs) != 0 {
+		t.Fatalf("unexpected receipt log: %+v", <-receiptLogs)
+	}
+}